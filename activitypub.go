@@ -16,6 +16,13 @@ import (
 	"time"
 )
 
+// wantsActivityJSON returns whether the client asked for an ActivityStreams
+// representation of the requested resource.
+func wantsActivityJSON(r *http.Request) bool {
+	accept := r.Header.Get("Accept")
+	return strings.Contains(accept, "application/activity+json") || strings.Contains(accept, "application/ld+json")
+}
+
 func handleFetchUser(app *app, w http.ResponseWriter, r *http.Request) error {
 	w.Header().Set("Server", serverName)
 
@@ -23,7 +30,7 @@ func handleFetchUser(app *app, w http.ResponseWriter, r *http.Request) error {
 	alias := vars["alias"]
 	u, err := app.getLocalUser(alias)
 	if err != nil {
-		return err
+		return renderDeletedUser(app, w, alias, err)
 	}
 
 	p := u.AsPerson(app)
@@ -185,9 +192,34 @@ func handleFetchInbox(app *app, w http.ResponseWriter, r *http.Request) error {
 		return err
 	}
 
+	switch t, _ := m["type"].(string); t {
+	case "Move":
+		err = handleMoveActivity(app, r, m)
+		if err != nil {
+			return err
+		}
+		return impart.RenderActivityJSON(w, nil, http.StatusAccepted)
+	case "Delete":
+		err = handleDeleteActivity(app, r, m)
+		if err != nil {
+			return err
+		}
+		return impart.RenderActivityJSON(w, nil, http.StatusAccepted)
+	case "Create", "Update":
+		if o, ok := m["object"].(map[string]interface{}); ok && isActorType(o["type"]) {
+			err = handleUpdateActor(app, r, m)
+		} else {
+			err = handleCreateActivity(app, r, m)
+		}
+		if err != nil {
+			return err
+		}
+		return impart.RenderActivityJSON(w, nil, http.StatusAccepted)
+	}
+
 	a := streams.NewAccept()
 	var to *url.URL
-	var isFollow, isUnfollow, isAccept, isCreate bool
+	var isFollow, isUnfollow, isAccept bool
 	fullActor := &activitystreams.Person{}
 	var remoteUser *User
 
@@ -276,116 +308,6 @@ func handleFetchInbox(app *app, w http.ResponseWriter, r *http.Request) error {
 			}
 			return impart.RenderActivityJSON(w, nil, http.StatusAccepted)
 		},
-		CreateCallback: func(f *streams.Create) error {
-			// TODO: move everything to handleCreateCallback
-			isCreate = true
-
-			_, id := f.GetId()
-			_, actorIRI := f.GetActor(0)
-			var published time.Time
-			var postType, name, content string
-			var url *url.URL
-			artRes := &streams.Resolver{
-				ArticleCallback: func(a *streams.Article) error {
-					_, published = a.GetPublished()
-					_, postType = a.GetType(0)
-					_, url = a.GetUrl(0)
-					_, name = a.GetName(0)
-					_, content = a.GetContent(0)
-					return nil
-				},
-				NoteCallback: func(a *streams.Note) error {
-					_, published = a.GetPublished()
-					_, postType = a.GetType(0)
-					_, url = a.GetUrl(0)
-					_, content = a.GetContent(0)
-					return nil
-				},
-			}
-			_, err = f.ResolveObject(artRes, 0)
-			if err != nil {
-				return err
-			}
-			// FIXME: this won't work if the user doesn't exist locally
-			fullActor, remoteUser, err = fetchActor(app, actorIRI.String())
-			if err != nil {
-				return err
-			}
-
-			// Insert post
-			err = app.createPost(&Post{
-				ActivityID: id.String(),
-				Type:       postType,
-				Published:  published,
-				URL:        url.String(),
-				Name:       name,
-				Content:    content,
-				OwnerID:    remoteUser.ID,
-				actorID:    actorIRI.String(),
-			})
-			if err != nil {
-				return err
-			}
-
-			return impart.RenderActivityJSON(w, nil, http.StatusAccepted)
-		},
-		UpdateCallback: func(f *streams.Update) error {
-			isCreate = true
-
-			_, id := f.GetId()
-			_, actorIRI := f.GetActor(0)
-			var name, content string
-			var url *url.URL
-			artRes := &streams.Resolver{
-				ArticleCallback: func(a *streams.Article) error {
-					_, url = a.GetUrl(0)
-					_, name = a.GetName(0)
-					_, content = a.GetContent(0)
-					return nil
-				},
-				NoteCallback: func(a *streams.Note) error {
-					_, url = a.GetUrl(0)
-					_, name = a.GetName(0)
-					_, content = a.GetContent(0)
-					return nil
-				},
-			}
-			_, err = f.ResolveObject(artRes, 0)
-			if err != nil {
-				return err
-			}
-			// FIXME: this won't work if the user doesn't exist locally
-			fullActor, remoteUser, err = fetchActor(app, actorIRI.String())
-			if err != nil {
-				return err
-			}
-
-			// Update post
-			err = app.updatePost(&Post{
-				ActivityID: id.String(),
-				URL:        url.String(),
-				Name:       name,
-				Content:    content,
-			})
-			if err != nil {
-				return err
-			}
-
-			return impart.RenderActivityJSON(w, nil, http.StatusAccepted)
-		},
-		DeleteCallback: func(f *streams.Delete) error {
-			isCreate = true
-
-			_, id := f.GetId()
-
-			// Delete post
-			err = app.deletePost(id.String())
-			if err != nil {
-				return err
-			}
-
-			return impart.RenderActivityJSON(w, nil, http.StatusAccepted)
-		},
 	}
 	if err := res.Deserialize(m); err != nil {
 		// 3) Any errors from #2 can be handled, or the payload is an unknown type.
@@ -408,11 +330,9 @@ func handleFetchInbox(app *app, w http.ResponseWriter, r *http.Request) error {
 			}
 		}
 		fetchUserPosts(app, remoteUser)
-	} else if isCreate {
-		return nil
 	}
 
-	p := u.AsPerson(app)
+	p := u.AsPerson(app).Person
 	go func() {
 		time.Sleep(2 * time.Second)
 		am, err := a.Serialize()
@@ -475,116 +395,268 @@ func handleFollowUser(app *app, w http.ResponseWriter, r *http.Request) error {
 		return impart.HTTPError{http.StatusUnauthorized, "Not logged in."}
 	}
 
-	handle := r.FormValue("user")
+	handle := strings.TrimPrefix(strings.TrimSpace(r.FormValue("user")), "@")
+	var remoteUser *User
+	var err error
+	if isFeedURL(handle) {
+		remoteUser, err = subscribeFeed(app, handle)
+	} else {
+		remoteUser, err = findUser(app, handle)
+	}
+	if err != nil {
+		return err
+	}
+
+	// Send follow request
+	u, err := app.getLocalUser(cu.PreferredUsername)
+	if err != nil {
+		return err
+	}
+	err = followUser(app, u, remoteUser)
+	if err != nil {
+		logError("Couldn't post! %v", err)
+	}
+	if !strings.HasPrefix(r.URL.Path, "/api") {
+		if remoteUser.Type == feedUserType {
+			addSessionFlash(app, w, r, "Subscribed to "+remoteUser.Name+".")
+			return impart.HTTPError{http.StatusFound, "/"}
+		}
+		addSessionFlash(app, w, r, "Follow request sent to "+handle+".")
+		return impart.HTTPError{http.StatusFound, "/"}
+	}
+	return impart.WriteSuccess(w, "", http.StatusOK)
+}
+
+// findUser looks up the remote user with the given handle via webfinger,
+// fetching and saving their actor if we haven't seen them before.
+func findUser(app *app, handle string) (*User, error) {
 	// Make webfinger request
 	userItems := strings.Split(handle, "@")
+	if len(userItems) != 2 || userItems[0] == "" || userItems[1] == "" {
+		return nil, impart.HTTPError{http.StatusBadRequest, "Enter a fediverse handle like user@example.com."}
+	}
 	wfr, err := doWebfinger(userItems[1], userItems[0])
 	if err != nil {
 		logInfo("Webfinger failed: %v", err)
-		return err
+		return nil, err
 	}
 
 	// Save webfinger result
 	logInfo("Webfinger success. Saving: %+v", wfr)
 	app.addFoundUser(wfr)
 
-	remoteUser, err := app.getActor(wfr.ActorIRI)
+	return findActor(app, wfr.ActorIRI)
+}
+
+// findActor returns the user with the given actor IRI, fetching and saving
+// them if we don't know them yet.
+func findActor(app *app, actorIRI string) (*User, error) {
+	remoteUser, err := app.getActor(actorIRI)
 	if err != nil {
 		if iErr, ok := err.(impart.HTTPError); ok {
 			if iErr.Status == http.StatusNotFound {
 				// Look up actor
-				remotePerson, _, err := fetchActor(app, wfr.ActorIRI)
+				remotePerson, _, err := fetchActor(app, actorIRI)
 				if err != nil {
 					logInfo("Actor fetch failed: %+v", err)
-					return err
+					return nil, err
+				}
+				if remotePerson.ID != actorIRI {
+					logInfo("Fetched actor %s, not %s", remotePerson.ID, actorIRI)
+					return nil, impart.HTTPError{http.StatusBadRequest, "Actor has a different ID."}
 				}
 
 				// Save user locally
 				logInfo("Actor fetch success")
-				//logInfo("Actor fetch success: %+v", remotePerson)
 				_, err = app.addUser(remotePerson)
 				if err != nil {
-					return err
+					return nil, err
 				}
-				remoteUser, err = app.getActor(wfr.ActorIRI)
-				if err != nil {
-					return err
-				}
-			} else {
-				logError("Not NotFound error: %+v", err)
+				return app.getActor(actorIRI)
 			}
+			logError("Not NotFound error: %+v", err)
 		} else {
 			logError("Unable to get actor: %+v", err)
 		}
-	} else {
-		logInfo("Actor is local")
+		return nil, err
 	}
+	logInfo("Actor is local")
+	return remoteUser, nil
+}
 
-	// Send follow request
-	u, err := app.getLocalUser(cu.PreferredUsername)
-	if err != nil {
-		return err
+// followUser sends a follow request from the given local user to remoteUser,
+// or subscribes them right away if remoteUser is a feed.
+func followUser(app *app, u *LocalUser, remoteUser *User) error {
+	if remoteUser.Type == feedUserType {
+		return app.addFollow(u.ID, remoteUser.ID)
 	}
-	followActivity := activitystreams.NewFollowActivity(u.AccountRoot(app), wfr.ActorIRI)
+
+	followActivity := activitystreams.NewFollowActivity(u.AccountRoot(app), remoteUser.BaseObject.ID)
 	followActivity.ID = u.AccountRoot(app) + "#follow"
-	err = makeActivityPost(u.AsPerson(app), remoteUser.Inbox, followActivity)
-	if err != nil {
-		logError("Couldn't post! %v", err)
-	}
-	return impart.WriteSuccess(w, "", http.StatusOK)
+	return makeActivityPost(u.AsPerson(app).Person, remoteUser.Inbox, followActivity)
 }
 
-func fetchUserPosts(app *app, u *User) error {
-	return fetchActorOutbox(app, u.Outbox)
+// objectActivity is an activity with its whole object embedded, like the
+// Update{Person} sent when a local user changes their profile.
+type objectActivity struct {
+	activitystreams.BaseObject
+	Actor     string      `json:"actor"`
+	Published time.Time   `json:"published"`
+	To        []string    `json:"to,omitempty"`
+	Object    interface{} `json:"object"`
 }
 
-func handleCreateCallback(app *app, f *streams.Create) error {
-	_, id := f.GetId()
-	_, actorIRI := f.GetActor(0)
-	var published time.Time
-	var postType, name, content string
-	var url *url.URL
-	artRes := &streams.Resolver{
-		ArticleCallback: func(a *streams.Article) error {
-			_, published = a.GetPublished()
-			_, postType = a.GetType(0)
-			_, url = a.GetUrl(0)
-			_, name = a.GetName(0)
-			_, content = a.GetContent(0)
-			return nil
+// sendProfileUpdate tells all of the given user's followers that their
+// profile changed, so remote servers refresh their copy of it.
+func sendProfileUpdate(app *app, u *LocalUser) {
+	p := u.AsPerson(app)
+	now := time.Now().UTC()
+	a := &objectActivity{
+		BaseObject: activitystreams.BaseObject{
+			Context: []interface{}{
+				activitystreams.Namespace,
+			},
+			Type: "Update",
+			ID:   p.ID + "#updates/" + strconv.FormatInt(now.UnixNano(), 10),
 		},
-		NoteCallback: func(a *streams.Note) error {
-			_, published = a.GetPublished()
-			_, postType = a.GetType(0)
-			_, url = a.GetUrl(0)
-			_, content = a.GetContent(0)
-			return nil
+		Actor:     p.ID,
+		Published: now,
+		To:        []string{activitystreams.PublicNS},
+		Object:    p,
+	}
+	postToFollowers(app, u, a)
+}
+
+// postToFollowers delivers the given activity to the inbox of every follower
+// of the given user.
+func postToFollowers(app *app, u *LocalUser, m interface{}) {
+	inboxes, err := app.getFollowerInboxes(u.ID)
+	if err != nil {
+		logError("Unable to get follower inboxes: %v", err)
+		return
+	}
+
+	p := u.AsPerson(app).Person
+	for _, inbox := range inboxes {
+		err = makeActivityPost(p, inbox, m)
+		if err != nil {
+			logError("Unable to deliver to %s: %v", inbox, err)
+		}
+	}
+}
+
+// unfollowUser stops following the given remote user and tells their server
+// with an Undo{Follow}.
+func unfollowUser(app *app, u *LocalUser, remoteUser *User) error {
+	err := app.removeFollow(u.ID, remoteUser.ID)
+	if err != nil {
+		logError("Couldn't remove follow: %v", err)
+		return impart.HTTPError{http.StatusInternalServerError, "Couldn't unfollow user."}
+	}
+	if remoteUser.Type == feedUserType {
+		return nil
+	}
+
+	follow := activitystreams.NewFollowActivity(u.AccountRoot(app), remoteUser.BaseObject.ID)
+	follow.ID = u.AccountRoot(app) + "#follow"
+	follow.Context = nil
+	undo := &objectActivity{
+		BaseObject: activitystreams.BaseObject{
+			Context: []interface{}{
+				activitystreams.Namespace,
+			},
+			Type: "Undo",
+			ID:   u.AccountRoot(app) + "#unfollow/" + strconv.FormatInt(time.Now().UnixNano(), 10),
 		},
+		Actor:     u.AccountRoot(app),
+		Published: time.Now().UTC(),
+		Object:    follow,
 	}
-	_, err := f.ResolveObject(artRes, 0)
+	err = makeActivityPost(u.AsPerson(app).Person, remoteUser.Inbox, undo)
 	if err != nil {
-		return err
+		logError("Couldn't post Undo: %v", err)
 	}
-	// FIXME: this won't work if the user doesn't exist locally
-	_, remoteUser, err := fetchActor(app, actorIRI.String())
+	return nil
+}
+
+func fetchUserPosts(app *app, u *User) error {
+	return fetchActorOutbox(app, u.BaseObject.ID, u.Outbox)
+}
+
+// handleCreateActivity stores the post in a Create, or saves the changes to
+// it in an Update. Only the post's author can do either.
+func handleCreateActivity(app *app, r *http.Request, m map[string]interface{}) error {
+	actor := jsonID(m["actor"])
+	if owner, err := app.getKeyOwner(signatureKeyID(r)); err != nil || owner != actor {
+		return impart.HTTPError{http.StatusForbidden, "Activity must be signed by the actor."}
+	}
+	return saveActivityObject(app, actor, m)
+}
+
+// sameHost returns whether the given IRIs are on the same host.
+func sameHost(a, b string) bool {
+	au, err := url.Parse(a)
+	if err != nil || au.Host == "" {
+		return false
+	}
+	bu, err := url.Parse(b)
 	if err != nil {
-		return err
+		return false
 	}
+	return strings.EqualFold(au.Host, bu.Host)
+}
 
-	// Insert post
-	err = app.createPost(&Post{
-		ActivityID: id.String(),
-		Type:       postType,
-		Published:  published,
-		URL:        url.String(),
-		Name:       name,
-		Content:    content,
-		OwnerID:    remoteUser.ID,
-		actorID:    actorIRI.String(),
-	})
+// saveActivityObject stores the post in a Create or Update activity, if it's
+// by someone we know and of a type we show. The activity must be by owner,
+// and the post must be on their server, so no one can put words in someone
+// else's mouth, or take over the ID of someone else's post.
+func saveActivityObject(app *app, owner string, m map[string]interface{}) error {
+	actor := jsonID(m["actor"])
+	if actor != owner {
+		return impart.HTTPError{http.StatusForbidden, "Activity must be by the actor."}
+	}
+	o, ok := m["object"].(map[string]interface{})
+	if !ok {
+		// Objects only given by IRI would have to be fetched; servers we
+		// follow embed them
+		return nil
+	}
+	p, err := parseObject(o)
 	if err != nil {
-		return err
+		logInfo("Ignoring object: %v", err)
+		return nil
 	}
+	if p.actorID == "" {
+		p.actorID = actor
+	}
+	if p.actorID != actor {
+		return impart.HTTPError{http.StatusForbidden, "Object must be by the actor."}
+	}
+	if !sameHost(p.ActivityID, actor) {
+		return impart.HTTPError{http.StatusForbidden, "Object must be on the actor's server."}
+	}
+	remoteUser, err := app.getActor(actor)
+	if err != nil {
+		// We don't know them, so no one here follows them
+		return nil
+	}
+	p.OwnerID = remoteUser.ID
 
-	return nil
+	if t, _ := m["type"].(string); t == "Update" {
+		return app.updatePost(p)
+	}
+	// Posts used to be saved under their Create's ID, so move any we got
+	// that way to the object's ID before saving it
+	if createID := jsonID(m["id"]); createID != "" && createID != p.ActivityID && len(createID) <= maxIRILen {
+		err = app.renamePost(actor, createID, p.ActivityID)
+		if err != nil {
+			return err
+		}
+	}
+	err = app.createPost(p)
+	if mysqlErr, ok := err.(*mysql.MySQLError); ok && mysqlErr.Number == mySQLErrDuplicateKey {
+		// We already have it, maybe from their outbox
+		return nil
+	}
+	return err
 }
@@ -0,0 +1,126 @@
+package readas
+
+import (
+	"github.com/gorilla/mux"
+	"github.com/writeas/impart"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// followedUser is how the API lists a user that someone follows.
+type followedUser struct {
+	Handle  string `json:"handle"`
+	ActorID string `json:"actor_id"`
+	Name    string `json:"name"`
+	URL     string `json:"url"`
+}
+
+func apiPage(r *http.Request) int {
+	page, err := strconv.Atoi(r.FormValue("page"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+	return page
+}
+
+func handleFetchFeed(app *app, w http.ResponseWriter, r *http.Request) error {
+	cu := getUserSession(app, r)
+	if cu == nil {
+		return impart.HTTPError{http.StatusUnauthorized, "Not logged in."}
+	}
+
+	posts, err := app.getUserFeed(cu.ID, apiPage(r))
+	if err != nil {
+		return err
+	}
+	return impart.WriteSuccess(w, posts, http.StatusOK)
+}
+
+func handleFetchSaved(app *app, w http.ResponseWriter, r *http.Request) error {
+	cu := getUserSession(app, r)
+	if cu == nil {
+		return impart.HTTPError{http.StatusUnauthorized, "Not logged in."}
+	}
+
+	posts, err := app.getSavedPosts(cu.ID, apiPage(r))
+	if err != nil {
+		return err
+	}
+	return impart.WriteSuccess(w, posts, http.StatusOK)
+}
+
+func handleFetchPost(app *app, w http.ResponseWriter, r *http.Request) error {
+	cu := getUserSession(app, r)
+	if cu == nil {
+		return impart.HTTPError{http.StatusUnauthorized, "Not logged in."}
+	}
+
+	vars := mux.Vars(r)
+	id, err := strconv.ParseInt(vars["id"], 10, 64)
+	if err != nil {
+		return impart.HTTPError{http.StatusBadRequest, "Invalid post ID."}
+	}
+	p, err := app.getPost(id, cu.ID)
+	if err != nil {
+		return err
+	}
+	return impart.WriteSuccess(w, p, http.StatusOK)
+}
+
+func handleFetchFollowingUsers(app *app, w http.ResponseWriter, r *http.Request) error {
+	cu := getUserSession(app, r)
+	if cu == nil {
+		return impart.HTTPError{http.StatusUnauthorized, "Not logged in."}
+	}
+
+	users, err := app.getFollowingUsers(cu.ID)
+	if err != nil {
+		return err
+	}
+	res := []followedUser{}
+	for _, u := range *users {
+		res = append(res, followedUser{
+			Handle:  u.Handle(),
+			ActorID: u.BaseObject.ID,
+			Name:    u.Name,
+			URL:     u.URL,
+		})
+	}
+	return impart.WriteSuccess(w, res, http.StatusOK)
+}
+
+// handleUnfollowUser unfollows the user given by either their handle or actor
+// IRI.
+func handleUnfollowUser(app *app, w http.ResponseWriter, r *http.Request) error {
+	cu := getUserSession(app, r)
+	if cu == nil {
+		return impart.HTTPError{http.StatusUnauthorized, "Not logged in."}
+	}
+
+	user := strings.TrimPrefix(strings.TrimSpace(r.FormValue("user")), "@")
+	var remoteUser *User
+	var err error
+	if strings.Contains(user, "://") {
+		remoteUser, err = app.getActor(user)
+	} else {
+		userItems := strings.Split(user, "@")
+		if len(userItems) != 2 {
+			return impart.HTTPError{http.StatusBadRequest, "Enter a fediverse handle like user@example.com."}
+		}
+		remoteUser, err = app.getActorByHandle(userItems[0], userItems[1])
+	}
+	if err != nil {
+		return err
+	}
+
+	u, err := app.getLocalUser(cu.PreferredUsername)
+	if err != nil {
+		return err
+	}
+	err = unfollowUser(app, u, remoteUser)
+	if err != nil {
+		return err
+	}
+	return impart.WriteSuccess(w, "", http.StatusOK)
+}
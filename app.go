@@ -1,6 +1,7 @@
 package readas
 
 import (
+	"archive/zip"
 	"database/sql"
 	"encoding/json"
 	"flag"
@@ -14,6 +15,7 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"strings"
 )
 
 const (
@@ -40,9 +42,23 @@ type config struct {
 	Host         string `json:"host"`
 	Port         int    `json:"port"`
 	MySQLConnStr string `json:"mysql_connection"`
+	MediaDir     string `json:"media_dir"`
+	MediaCacheMB int    `json:"media_cache_size"`
 
 	// Instance
-	Name string `json:"instance_name"`
+	Name       string `json:"instance_name"`
+	Require2FA bool   `json:"require_2fa"`
+
+	// Content
+	EmbedHosts  []string `json:"embed_hosts"`
+	StripStyles bool     `json:"strip_styles"`
+
+	// Email
+	SMTPHost     string `json:"smtp_host"`
+	SMTPPort     int    `json:"smtp_port"`
+	SMTPUser     string `json:"smtp_user"`
+	SMTPPassword string `json:"smtp_password"`
+	EmailFrom    string `json:"email_from"`
 }
 
 func Serve() {
@@ -51,20 +67,53 @@ func Serve() {
 	}
 
 	var newUser, newPass string
+	var resetPass bool
+	var exportAuthor, exportFrom, exportTo string
+	var exportSaved bool
 	flag.IntVar(&app.cfg.Port, "p", 8080, "Port to start server on")
 	flag.StringVar(&app.cfg.Host, "h", "", "Site's base URL")
 
 	// options for creating a new user
 	flag.StringVar(&newUser, "user", "", "New user's username. Should be paired with --pass")
 	flag.StringVar(&newPass, "pass", "", "Password for new user. Should be paired with --user")
-	flag.Parse()
+	flag.BoolVar(&resetPass, "reset-pass", false, "Reset the --user's password to --pass and log them out everywhere")
+
+	// options for exporting posts with export-epub
+	flag.BoolVar(&exportSaved, "saved", false, "Only export posts the user saved")
+	flag.StringVar(&exportAuthor, "author", "", "Only export posts by this followed user@host or feed URL")
+	flag.StringVar(&exportFrom, "from", "", "Only export posts published on or after this date (YYYY-MM-DD)")
+	flag.StringVar(&exportTo, "to", "", "Only export posts published on or before this date (YYYY-MM-DD)")
+
+	// Commands come before any options, like `readas export --user matt library.zip`
+	command, args := "", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+	}
+	flag.CommandLine.Parse(args)
+	switch command {
+	case "":
+	case "import":
+		if newUser == "" || flag.NArg() != 1 {
+			log.Fatal("usage: readas import --user USERNAME FILE.zip")
+		}
+	case "export":
+		if newUser == "" || flag.NArg() != 1 {
+			log.Fatal("usage: readas export --user USERNAME FILE.zip")
+		}
+	case "export-epub":
+		if newUser == "" || flag.NArg() != 1 {
+			log.Fatal("usage: readas export-epub --user USERNAME [--saved] [--author HANDLE] [--from DATE] [--to DATE] FILE.epub")
+		}
+	default:
+		log.Fatalf("Unknown command: %s", command)
+	}
 
 	if app.cfg.Host == "" || os.Getenv("RA_MYSQL_CONNECTION") == "" {
 		log.Printf("Reading %s", configFile)
 		// Read configuration if information not passed in via flags or environment vars
 		f, err := ioutil.ReadFile(configFile)
 		if err != nil {
-			log.Fatal("File error: %v\n", err)
+			log.Fatalf("File error: %v\n", err)
 		}
 
 		err = json.Unmarshal(f, &app.cfg)
@@ -73,6 +122,11 @@ func Serve() {
 		}
 	}
 
+	if app.cfg.MediaDir == "" {
+		app.cfg.MediaDir = "media"
+	}
+	initContentPolicy(app.cfg)
+
 	userAgent = "Go (" + serverName + "/" + softwareVersion + "; +" + app.cfg.Host + ")"
 
 	logInfo = log.New(os.Stdout, "", log.Ldate|log.Ltime).Printf
@@ -83,6 +137,82 @@ func Serve() {
 		log.Fatal(err)
 	}
 
+	if command == "import" {
+		importFile := flag.Arg(0)
+		u, err := app.getLocalUser(newUser)
+		if err != nil {
+			log.Fatalf("Unable to get user: %v", err)
+		}
+		z, err := zip.OpenReader(importFile)
+		if err != nil {
+			log.Fatalf("Unable to open %s: %v", importFile, err)
+		}
+		res, err := importArchive(app, u, &z.Reader)
+		z.Close()
+		if err != nil {
+			log.Fatalf("Unable to import archive: %v", err)
+		}
+		logInfo("Restored %d users, %d posts and %d follows", res.Users, res.Posts, res.Follows)
+		for _, id := range res.Failed {
+			logInfo("Couldn't restore %s", id)
+		}
+		resendFollows(app, u, res.resend)
+		return
+	}
+	if command == "export" {
+		archiveFile := flag.Arg(0)
+		u, err := app.getLocalUser(newUser)
+		if err != nil {
+			log.Fatalf("Unable to get user: %v", err)
+		}
+		f, err := os.Create(archiveFile)
+		if err != nil {
+			log.Fatalf("Unable to create %s: %v", archiveFile, err)
+		}
+		n, err := exportArchive(app, u, f)
+		if cErr := f.Close(); err == nil {
+			err = cErr
+		}
+		if err != nil {
+			os.Remove(archiveFile)
+			log.Fatalf("Unable to export library: %v", err)
+		}
+		logInfo("Exported %d posts to %s", n, archiveFile)
+		return
+	}
+	if command == "export-epub" {
+		exportFile := flag.Arg(0)
+		u, err := app.getLocalUser(newUser)
+		if err != nil {
+			log.Fatalf("Unable to get user: %v", err)
+		}
+		sel := &exportSelection{Saved: exportSaved}
+		err = sel.parseExportDates(exportFrom, exportTo)
+		if err != nil {
+			log.Fatalf("Invalid --from or --to date: %v", err)
+		}
+		if exportAuthor != "" {
+			sel.Author, err = findFollowedUser(app, u.ID, exportAuthor)
+			if err != nil {
+				log.Fatalf("Unable to find author: %v", err)
+			}
+		}
+		f, err := os.Create(exportFile)
+		if err != nil {
+			log.Fatalf("Unable to create %s: %v", exportFile, err)
+		}
+		n, err := exportEPUB(app, u, sel, f)
+		if cErr := f.Close(); err == nil {
+			err = cErr
+		}
+		if err != nil {
+			os.Remove(exportFile)
+			log.Fatalf("Unable to export posts: %v", err)
+		}
+		logInfo("Exported %d posts to %s", n, exportFile)
+		return
+	}
+
 	// Do any configuration
 	if newUser != "" || newPass != "" {
 		if newUser == "" {
@@ -90,11 +220,27 @@ func Serve() {
 		} else if newPass == "" {
 			log.Fatal("missing --pass parameter")
 		}
-		logInfo("Creating new user: %s", newUser)
 		hashedPass, err := auth.HashPass([]byte(newPass))
 		if err != nil {
 			log.Fatalf("Unable to hash pass: %v", err)
 		}
+		if resetPass {
+			logInfo("Resetting password for user: %s", newUser)
+			u, err := app.getLocalUser(newUser)
+			if err != nil {
+				log.Fatalf("Unable to get user: %v", err)
+			}
+			err = app.updatePassword(u.ID, hashedPass)
+			if err != nil {
+				log.Fatalf("Unable to reset password: %v", err)
+			}
+			err = app.deleteUserSessions(u.ID, "")
+			if err != nil {
+				log.Fatalf("Unable to log out sessions: %v", err)
+			}
+			return
+		}
+		logInfo("Creating new user: %s", newUser)
 		app.createUser(&LocalUser{
 			PreferredUsername: newUser,
 			HashedPass:        hashedPass,
@@ -116,7 +262,11 @@ func Serve() {
 		log.Fatal(err)
 	}
 	initSession(app)
+	initMediaProxy(app)
 	initRoutes(app)
+	go pollFeeds(app)
+	go sendDigests(app)
+	go refreshActors(app)
 
 	http.Handle("/", app.router)
 	logInfo("Serving on localhost:%d", app.cfg.Port)
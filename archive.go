@@ -0,0 +1,425 @@
+package readas
+
+import (
+	"archive/zip"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"github.com/writeas/impart"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// A library archive is a ZIP file with everything Read.as has stored for a
+// user: each post in their library as Markdown and HTML, and their read and
+// saved posts, follows, and the remote users behind them as JSON. Archives can
+// be imported to restore the account on another instance. Importing only
+// trusts the archive for what the user did: the users and posts in it are
+// fetched again from where they came from.
+
+// archivePost is how a post is listed in an archive's library.json.
+type archivePost struct {
+	File          string    `json:"file"`
+	Title         string    `json:"title"`
+	Author        string    `json:"author"`
+	AuthorName    string    `json:"author_name"`
+	AuthorActorID string    `json:"author_actor_id"`
+	URL           string    `json:"url"`
+	Published     time.Time `json:"published"`
+	ActivityID    string    `json:"activity_id"`
+	Type          string    `json:"type"`
+	Name          string    `json:"name,omitempty"`
+	Content       string    `json:"content"`
+	Read          bool      `json:"read"`
+	Saved         bool      `json:"saved"`
+}
+
+// archiveUser is a remote user or feed in an archive's users.json.
+type archiveUser struct {
+	ActorID     string `json:"actor_id"`
+	Username    string `json:"username"`
+	Host        string `json:"host,omitempty"`
+	Type        string `json:"type"`
+	Name        string `json:"name"`
+	Summary     string `json:"summary"`
+	URL         string `json:"url,omitempty"`
+	Inbox       string `json:"inbox,omitempty"`
+	SharedInbox string `json:"shared_inbox,omitempty"`
+	Outbox      string `json:"outbox,omitempty"`
+	Followers   string `json:"followers,omitempty"`
+	Following   string `json:"following,omitempty"`
+	Avatar      string `json:"avatar,omitempty"`
+	AvatarType  string `json:"avatar_type,omitempty"`
+}
+
+func newArchiveUser(u *User) *archiveUser {
+	return &archiveUser{
+		ActorID:     u.BaseObject.ID,
+		Username:    u.PreferredUsername,
+		Host:        u.Host,
+		Type:        u.Type,
+		Name:        u.Name,
+		Summary:     u.Summary,
+		URL:         u.URL,
+		Inbox:       u.Inbox,
+		SharedInbox: u.Endpoints.SharedInbox,
+		Outbox:      u.Outbox,
+		Followers:   u.Followers,
+		Following:   u.Following,
+		Avatar:      u.Icon.URL,
+		AvatarType:  u.Icon.Type,
+	}
+}
+
+// slug returns a short, filename-safe version of s.
+func slug(s string) string {
+	var sb strings.Builder
+	dash := false
+	for _, r := range strings.ToLower(s) {
+		if r < unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r)) {
+			if dash && sb.Len() > 0 {
+				sb.WriteByte('-')
+			}
+			sb.WriteRune(r)
+			dash = false
+		} else {
+			dash = true
+		}
+		if sb.Len() >= 50 {
+			break
+		}
+	}
+	return sb.String()
+}
+
+func archiveFileName(p *Post) string {
+	name := p.Published.UTC().Format(exportDateFormat)
+	if s := slug(p.Name); s != "" {
+		name += "-" + s
+	}
+	return name + "-" + strconv.FormatInt(p.ID, 10)
+}
+
+// yamlString quotes s for YAML front matter. JSON strings are valid YAML.
+func yamlString(s string) string {
+	b, _ := json.Marshal(s)
+	return string(b)
+}
+
+// postMarkdown returns the post as Markdown with YAML front matter.
+func postMarkdown(p *Post) (string, error) {
+	body, err := htmlToMarkdown(string(p.OriginalContent()))
+	if err != nil {
+		return "", err
+	}
+	var sb strings.Builder
+	sb.WriteString("---\n")
+	fmt.Fprintf(&sb, "title: %s\n", yamlString(postTitle(p)))
+	fmt.Fprintf(&sb, "author: %s\n", yamlString(p.Owner.Handle()))
+	fmt.Fprintf(&sb, "author_name: %s\n", yamlString(p.Owner.Name))
+	fmt.Fprintf(&sb, "url: %s\n", yamlString(p.URL))
+	fmt.Fprintf(&sb, "published: %s\n", p.Published.UTC().Format(time.RFC3339))
+	fmt.Fprintf(&sb, "activity_id: %s\n", yamlString(p.ActivityID))
+	fmt.Fprintf(&sb, "read: %t\n", p.IsRead)
+	fmt.Fprintf(&sb, "saved: %t\n", p.IsSaved)
+	sb.WriteString("---\n\n")
+	if p.Name != "" {
+		sb.WriteString("# " + markdownEscaper.Replace(p.Name) + "\n\n")
+	}
+	sb.WriteString(body)
+	return sb.String(), nil
+}
+
+func writeArchiveJSON(z *zip.Writer, name string, v interface{}) error {
+	f, err := z.Create(name)
+	if err != nil {
+		return err
+	}
+	e := json.NewEncoder(f)
+	e.SetIndent("", "  ")
+	return e.Encode(v)
+}
+
+// exportArchive writes the given user's whole library to w as a ZIP file.
+func exportArchive(app *app, u *LocalUser, w io.Writer) (int, error) {
+	posts, err := app.getLibraryPosts(u.ID)
+	if err != nil {
+		return 0, err
+	}
+	users, err := app.getFollowingUsers(u.ID)
+	if err != nil {
+		return 0, err
+	}
+
+	z := zip.NewWriter(w)
+	library := []archivePost{}
+	userIDs := []int64{}
+	for _, fu := range *users {
+		userIDs = append(userIDs, fu.ID)
+	}
+	for i := range *posts {
+		p := &(*posts)[i]
+		name := "posts/" + archiveFileName(p)
+
+		md, err := postMarkdown(p)
+		if err != nil {
+			return 0, err
+		}
+		f, err := z.Create(name + ".md")
+		if err != nil {
+			return 0, err
+		}
+		_, err = io.WriteString(f, md)
+		if err != nil {
+			return 0, err
+		}
+
+		f, err = z.Create(name + ".html")
+		if err != nil {
+			return 0, err
+		}
+		err = archiveTemplates.ExecuteTemplate(f, "post.html", p)
+		if err != nil {
+			return 0, err
+		}
+
+		library = append(library, archivePost{
+			File:          name + ".md",
+			Title:         postTitle(p),
+			Author:        p.Owner.Handle(),
+			AuthorName:    p.Owner.Name,
+			AuthorActorID: p.Owner.BaseObject.ID,
+			URL:           p.URL,
+			Published:     p.Published.UTC(),
+			ActivityID:    p.ActivityID,
+			Type:          p.Type,
+			Name:          p.Name,
+			Content:       p.Content,
+			Read:          p.IsRead,
+			Saved:         p.IsSaved,
+		})
+		userIDs = append(userIDs, p.OwnerID)
+	}
+	err = writeArchiveJSON(z, "library.json", library)
+	if err != nil {
+		return 0, err
+	}
+
+	following := []followedUser{}
+	for _, fu := range *users {
+		following = append(following, followedUser{
+			Handle:  fu.Handle(),
+			ActorID: fu.BaseObject.ID,
+			Name:    fu.Name,
+			URL:     fu.URL,
+		})
+	}
+	err = writeArchiveJSON(z, "following.json", following)
+	if err != nil {
+		return 0, err
+	}
+
+	archived := []archiveUser{}
+	seen := map[int64]bool{}
+	for _, id := range userIDs {
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		ru, err := app.getUserByID(id)
+		if err != nil {
+			return 0, err
+		}
+		archived = append(archived, *newArchiveUser(ru))
+	}
+	err = writeArchiveJSON(z, "users.json", archived)
+	if err != nil {
+		return 0, err
+	}
+
+	return len(library), z.Close()
+}
+
+// handleExportArchive downloads the user's whole library as a ZIP file.
+func handleExportArchive(app *app, w http.ResponseWriter, r *http.Request) error {
+	cu := getUserSession(app, r)
+	if cu == nil {
+		return impart.HTTPError{http.StatusUnauthorized, "Not logged in."}
+	}
+	u, err := app.getLocalUser(cu.PreferredUsername)
+	if err != nil {
+		return err
+	}
+
+	// Stream the archive as it's written, rather than holding a whole
+	// library in memory
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", `attachment; filename="readas-`+u.PreferredUsername+`-`+time.Now().Format(exportDateFormat)+`.zip"`)
+	_, err = exportArchive(app, u, w)
+	if err != nil {
+		logError("Couldn't export library for %s: %v", u.PreferredUsername, err)
+	}
+	return err
+}
+
+// archiveImport is what happened when an archive was imported.
+type archiveImport struct {
+	Users   int
+	Posts   int
+	Follows int
+	Failed  []string
+
+	// resend is everyone on the fediverse whose Follow needs to be sent
+	// again from this instance.
+	resend []*User
+}
+
+func readArchiveJSON(z *zip.Reader, name string, v interface{}) error {
+	for _, f := range z.File {
+		if f.Name != name {
+			continue
+		}
+		r, err := f.Open()
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		return json.NewDecoder(r).Decode(v)
+	}
+	return fmt.Errorf("%s is missing; is this a Read.as archive?", name)
+}
+
+// restorePost returns the ID of our copy of an archived post. Posts we don't
+// have yet are fetched again from their server, rather than taken from the
+// archive, so an archive can't put words in anyone's mouth. Feed items can't
+// be fetched on their own, so they're only found if they're still in their
+// feed.
+func restorePost(app *app, ap *archivePost, isFeed bool) (int64, error) {
+	id, err := app.getPostID(ap.ActivityID)
+	if err != sql.ErrNoRows {
+		return id, err
+	}
+	if isFeed {
+		return 0, err
+	}
+
+	b, err := resolveIRI(ap.ActivityID)
+	if err != nil {
+		return 0, err
+	}
+	var o map[string]interface{}
+	err = json.Unmarshal(b, &o)
+	if err != nil {
+		return 0, err
+	}
+	if jsonID(o["id"]) != ap.ActivityID {
+		return 0, fmt.Errorf("fetched %s, not %s", jsonID(o["id"]), ap.ActivityID)
+	}
+	err = saveActivityObject(app, ap.AuthorActorID, map[string]interface{}{
+		"type":   "Create",
+		"actor":  ap.AuthorActorID,
+		"object": o,
+	})
+	if err != nil {
+		return 0, err
+	}
+	return app.getPostID(ap.ActivityID)
+}
+
+// importArchive restores the remote users, posts, read and saved state, and
+// follows from a library archive into the given user's account. Users, feeds
+// and posts are fetched again rather than taken from the archive, unless we
+// already have them. Everything that already exists is left as it is, so the
+// same archive can be imported more than once.
+func importArchive(app *app, u *LocalUser, z *zip.Reader) (*archiveImport, error) {
+	users := []archiveUser{}
+	library := []archivePost{}
+	following := []followedUser{}
+	err := readArchiveJSON(z, "users.json", &users)
+	if err != nil {
+		return nil, err
+	}
+	err = readArchiveJSON(z, "library.json", &library)
+	if err != nil {
+		return nil, err
+	}
+	err = readArchiveJSON(z, "following.json", &following)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &archiveImport{}
+	feeds := map[string]bool{}
+	for _, au := range users {
+		if au.ActorID == "" {
+			continue
+		}
+		if au.Type == feedUserType {
+			feeds[au.ActorID] = true
+			_, err = subscribeFeed(app, au.ActorID)
+		} else {
+			_, err = findActor(app, au.ActorID)
+		}
+		if err != nil {
+			res.Failed = append(res.Failed, au.ActorID)
+			continue
+		}
+		res.Users++
+	}
+
+	for i := range library {
+		ap := &library[i]
+		if ap.ActivityID == "" || ap.AuthorActorID == "" {
+			continue
+		}
+		postID, err := restorePost(app, ap, feeds[ap.AuthorActorID])
+		if err == nil && ap.Read {
+			err = app.setPostRead(u.ID, postID, true)
+		}
+		if err == nil && ap.Saved {
+			err = app.setPostSaved(u.ID, postID, true)
+		}
+		if err != nil {
+			res.Failed = append(res.Failed, ap.ActivityID)
+			continue
+		}
+		res.Posts++
+	}
+
+	for _, f := range following {
+		ru, err := app.getActor(f.ActorID)
+		if err == nil {
+			err = app.addFollow(u.ID, ru.ID)
+		}
+		if err != nil {
+			res.Failed = append(res.Failed, f.ActorID)
+			continue
+		}
+		res.Follows++
+		if ru.Type != feedUserType {
+			res.resend = append(res.resend, ru)
+		}
+	}
+
+	return res, nil
+}
+
+// resendFollows sends a Follow to everyone the user followed on their old
+// instance, so their posts start arriving here.
+func resendFollows(app *app, u *LocalUser, users []*User) {
+	for i, ru := range users {
+		if i > 0 {
+			time.Sleep(importInterval)
+		}
+		err := followUser(app, u, ru)
+		if err != nil {
+			logError("Couldn't follow %s: %v", ru.BaseObject.ID, err)
+			continue
+		}
+		logInfo("Sent follow to %s", ru.BaseObject.ID)
+	}
+}
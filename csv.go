@@ -0,0 +1,73 @@
+package readas
+
+import (
+	"encoding/csv"
+	"github.com/writeas/impart"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// followingCSVHeader is the header of the following_accounts.csv files
+// Mastodon exports, which other fediverse servers also import.
+var followingCSVHeader = []string{"Account address", "Show boosts", "Notify on new posts", "Languages"}
+
+// parseFollowingCSV returns the handles in a Mastodon following list. It also
+// accepts older exports without a header, plain lists with one handle per
+// line, and actor IRIs in place of handles.
+func parseFollowingCSV(r io.Reader) ([]importEntry, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	cr.TrimLeadingSpace = true
+
+	entries := []importEntry{}
+	for {
+		rec, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		handle := strings.TrimPrefix(strings.TrimSpace(rec[0]), "@")
+		if handle == "" || handle == followingCSVHeader[0] {
+			continue
+		}
+		entries = append(entries, importEntry{Target: handle})
+	}
+	return entries, nil
+}
+
+// handleExportFollowingCSV downloads the fediverse accounts the user follows in
+// Mastodon's following_accounts.csv format.
+func handleExportFollowingCSV(app *app, w http.ResponseWriter, r *http.Request) error {
+	cu := getUserSession(app, r)
+	if cu == nil {
+		return impart.HTTPError{http.StatusUnauthorized, "Not logged in."}
+	}
+
+	users, err := app.getFollowingUsers(cu.ID)
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="following_accounts.csv"`)
+	cw := csv.NewWriter(w)
+	cw.Write(followingCSVHeader)
+	for _, u := range *users {
+		// Feeds are exported as OPML instead
+		if u.Type == feedUserType {
+			continue
+		}
+		account := u.PreferredUsername + "@" + u.Host
+		if u.Host == "" {
+			// We never looked them up by handle, so we only know their actor
+			// IRI, which Read.as imports too
+			account = u.BaseObject.ID
+		}
+		cw.Write([]string{account, "true", "false", ""})
+	}
+	cw.Flush()
+	return cw.Error()
+}
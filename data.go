@@ -9,6 +9,8 @@ import (
 	"github.com/writeas/web-core/activitystreams"
 	"net/http"
 	"os"
+	"strings"
+	"time"
 
 	_ "github.com/go-sql-driver/mysql"
 )
@@ -96,7 +98,7 @@ func (app *app) addUser(u *activitystreams.Person) (int64, error) {
 		return 0, err
 	}
 
-	stmt := "INSERT INTO users (actor_id, username, type, name, summary, created, url, following_iri, followers_iri, inbox_iri, outbox_iri, shared_inbox_iri, avatar, avatar_type) VALUES (?, ?, ?, ?, ?, NOW(), ?, ?, ?, ?, ?, ?, ?, ?)"
+	stmt := "INSERT INTO users (actor_id, username, type, name, summary, created, url, following_iri, followers_iri, inbox_iri, outbox_iri, shared_inbox_iri, avatar, avatar_type, last_fetched) VALUES (?, ?, ?, ?, ?, NOW(), ?, ?, ?, ?, ?, ?, ?, ?, NOW())"
 	res, err := t.Exec(stmt, u.BaseObject.ID, u.PreferredUsername, u.Type, u.Name, u.Summary, u.URL, u.Following, u.Followers, u.Inbox, u.Outbox, u.Endpoints.SharedInbox, u.Icon.URL, u.Icon.Type)
 	if err != nil {
 		t.Rollback()
@@ -111,7 +113,9 @@ func (app *app) addUser(u *activitystreams.Person) (int64, error) {
 	}
 
 	// Add in key
-	_, err = t.Exec("INSERT INTO userkeys (id, user_id, public_key) VALUES (?, ?, ?)", u.PublicKey.ID, followerID, u.PublicKey.PublicKeyPEM)
+	if u.PublicKey.ID != "" {
+		_, err = t.Exec("INSERT INTO userkeys (id, user_id, public_key) VALUES (?, ?, ?)", u.PublicKey.ID, followerID, u.PublicKey.PublicKeyPEM)
+	}
 	if err != nil {
 		if mysqlErr, ok := err.(*mysql.MySQLError); ok {
 			if mysqlErr.Number != mySQLErrDuplicateKey {
@@ -144,225 +148,1649 @@ func (app *app) addUser(u *activitystreams.Person) (int64, error) {
 	return followerID, nil
 }
 
+// updateUser saves a remote user's refetched actor, along with their key and
+// handle.
+func (app *app) updateUser(userID int64, u *activitystreams.Person) error {
+	t, err := app.db.Begin()
+	if err != nil {
+		logError("Unable to start transaction: %v", err)
+		return err
+	}
+
+	_, err = t.Exec(`UPDATE users SET username = ?, type = ?, name = ?, summary = ?, url = ?, following_iri = ?, followers_iri = ?, inbox_iri = ?, outbox_iri = ?, shared_inbox_iri = ?, avatar = ?, avatar_type = ?, last_fetched = NOW()
+		WHERE id = ? AND password IS NULL`,
+		u.PreferredUsername, u.Type, u.Name, u.Summary, u.URL, u.Following, u.Followers, u.Inbox, u.Outbox, u.Endpoints.SharedInbox, u.Icon.URL, u.Icon.Type, userID)
+	if err != nil {
+		t.Rollback()
+		logError("Couldn't update user: %v", err)
+		return err
+	}
+
+	if u.PublicKey.ID != "" {
+		// Replace the key, whether it was rotated or just given a new ID. Old
+		// keys are only deleted once the new one is stored for this user, so
+		// a key ID that belongs to someone else doesn't leave them without one.
+		var keyOwner int64
+		_, err = t.Exec("INSERT INTO userkeys (id, user_id, public_key) VALUES (?, ?, ?) ON DUPLICATE KEY UPDATE public_key = IF(user_id = VALUES(user_id), VALUES(public_key), public_key)", u.PublicKey.ID, userID, u.PublicKey.PublicKeyPEM)
+		if err == nil {
+			err = t.QueryRow("SELECT user_id FROM userkeys WHERE id = ?", u.PublicKey.ID).Scan(&keyOwner)
+		}
+		if err == nil && keyOwner != userID {
+			err = fmt.Errorf("key %s belongs to another user", u.PublicKey.ID)
+		}
+		if err == nil {
+			_, err = t.Exec("DELETE FROM userkeys WHERE user_id = ? AND private_key IS NULL AND id != ?", userID, u.PublicKey.ID)
+		}
+		if err != nil {
+			t.Rollback()
+			logError("Couldn't update user key: %v", err)
+			return err
+		}
+	}
+
+	// Handles can be renamed, but stay on the same host
+	_, err = t.Exec("UPDATE IGNORE foundusers SET username = ?, user_id = ? WHERE actor_id = ?", u.PreferredUsername, userID, u.ID)
+	if err != nil {
+		t.Rollback()
+		logError("Couldn't update found user: %v", err)
+		return err
+	}
+
+	err = t.Commit()
+	if err != nil {
+		t.Rollback()
+		logError("Rolling back after Commit(): %v\n", err)
+		return err
+	}
+	return nil
+}
+
+// setUserFetched records that the given remote user was just fetched.
+func (app *app) setUserFetched(userID int64) error {
+	_, err := app.db.Exec("UPDATE users SET last_fetched = NOW() WHERE id = ?", userID)
+	if err != nil {
+		logError("Couldn't update last_fetched: %v", err)
+	}
+	return err
+}
+
+// getStaleActors returns up to limit fediverse users who haven't been
+// fetched for at least maxAge, least recently fetched first.
+func (app *app) getStaleActors(maxAge time.Duration, limit int) (*[]User, error) {
+	rows, err := app.db.Query(`SELECT id, actor_id
+		FROM users
+		WHERE password IS NULL AND deleted IS NULL AND IFNULL(type, '') != '`+feedUserType+`'
+			AND (last_fetched IS NULL OR last_fetched < NOW() - INTERVAL ? SECOND)
+		ORDER BY last_fetched
+		LIMIT ?`, int(maxAge.Seconds()), limit)
+	if err != nil {
+		logError("Failed selecting stale actors: %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := []User{}
+	for rows.Next() {
+		u := User{}
+		err = rows.Scan(&u.ID, &u.BaseObject.ID)
+		if err != nil {
+			logError("Failed scanning row in getStaleActors: %v", err)
+			break
+		}
+
+		users = append(users, u)
+	}
+	err = rows.Err()
+	if err != nil {
+		logError("Error after Next() on rows in getStaleActors: %v", err)
+	}
+
+	return &users, nil
+}
+
 func (app *app) getLocalUser(username string) (*LocalUser, error) {
 	u := LocalUser{}
 
-	condition := "username = ?"
+	condition := "username = ? AND password IS NOT NULL"
 	value := username
-	stmt := "SELECT u.id, username, password, name, summary, private_key, public_key FROM users u LEFT JOIN userkeys uk ON u.id = uk.user_id WHERE " + condition
-	err := app.db.QueryRow(stmt, value).Scan(&u.ID, &u.PreferredUsername, &u.HashedPass, &u.Name, &u.Summary, &u.privKey, &u.pubKey)
+	stmt := "SELECT u.id, username, password, name, summary, IFNULL(avatar, ''), IFNULL(avatar_type, ''), IFNULL(totp_secret, ''), IFNULL(feed_token, ''), IFNULL(email, ''), IFNULL(digest, ''), IFNULL(also_known_as, ''), IFNULL(moved_to, ''), IFNULL(feed_types, ''), expand_warnings, private_key, public_key FROM users u LEFT JOIN userkeys uk ON u.id = uk.user_id WHERE " + condition
+	var aliases, feedTypes string
+	err := app.db.QueryRow(stmt, value).Scan(&u.ID, &u.PreferredUsername, &u.HashedPass, &u.Name, &u.Summary, &u.Avatar, &u.AvatarType, &u.totpSecret, &u.FeedToken, &u.Email, &u.Digest, &aliases, &u.MovedTo, &feedTypes, &u.ExpandWarnings, &u.privKey, &u.pubKey)
 	switch {
 	case err == sql.ErrNoRows:
 		return nil, impart.HTTPError{http.StatusNotFound, "User not found"}
 	case err != nil:
 		return nil, err
 	}
+	u.AlsoKnownAs = strings.Fields(aliases)
+	if feedTypes != "" {
+		u.FeedTypes = strings.Split(feedTypes, ",")
+	}
 
 	return &u, nil
 }
 
-func (app *app) getFollowers(id int64, page int) (*[]string, error) {
-	limitStr := ""
-	if page > 0 {
-		pagePosts := 10
-		start := page*pagePosts - pagePosts
-		limitStr = fmt.Sprintf(" LIMIT %d, %d", start, pagePosts)
+// getDeletedUser returns when the local user with the given username deleted
+// their account.
+func (app *app) getDeletedUser(username string) (time.Time, error) {
+	var deleted time.Time
+	err := app.db.QueryRow("SELECT deleted FROM users WHERE actor_id = ? AND username = ? AND deleted IS NOT NULL", username, username).Scan(&deleted)
+	switch {
+	case err == sql.ErrNoRows:
+		return deleted, impart.HTTPError{http.StatusNotFound, "User not found"}
+	case err != nil:
+		logError("Couldn't get deleted user: %v", err)
+		return deleted, err
 	}
+	return deleted, nil
+}
 
-	rows, err := app.db.Query(`SELECT actor_id
-		FROM follows
-		LEFT JOIN users
-			ON follower = id
-		WHERE followee = ?`+limitStr, id)
+// deleteUser removes everything belonging to the given local user. Their row
+// in users is kept, blanked, so the username can't be taken by anyone else
+// and their actor can answer with a Tombstone.
+func (app *app) deleteUser(userID int64) error {
+	t, err := app.db.Begin()
 	if err != nil {
-		logError("Failed selecting followers: %v", err)
-		return nil, impart.HTTPError{http.StatusInternalServerError, "Couldn't retrieve followers."}
+		logError("Unable to start transaction: %v", err)
+		return err
 	}
-	defer rows.Close()
 
-	users := []string{}
-	for rows.Next() {
-		u := ""
-		err = rows.Scan(&u)
+	stmts := []string{
+		"DELETE dp FROM digestposts dp INNER JOIN digests d ON dp.digest_id = d.id WHERE d.user_id = ?",
+		"DELETE FROM digests WHERE user_id = ?",
+		"DELETE FROM readposts WHERE user_id = ?",
+		"DELETE FROM savedposts WHERE user_id = ?",
+		"DELETE FROM follows WHERE follower = ? OR followee = ?",
+		"DELETE FROM sessions WHERE user_id = ?",
+		"DELETE FROM accesstokens WHERE user_id = ?",
+		"DELETE FROM oauthcodes WHERE user_id = ?",
+		"DELETE FROM recoverycodes WHERE user_id = ?",
+		"DELETE FROM userkeys WHERE user_id = ?",
+		`UPDATE users SET password = NULL, name = '', summary = '', avatar = NULL, avatar_type = NULL, totp_secret = NULL, totp_step = NULL, feed_token = NULL,
+			email = NULL, digest = NULL, digest_sent = NULL, also_known_as = NULL, moved_to = NULL, deleted = NOW()
+			WHERE id = ?`,
+	}
+	for _, stmt := range stmts {
+		args := []interface{}{userID}
+		if strings.Count(stmt, "?") == 2 {
+			args = append(args, userID)
+		}
+		_, err = t.Exec(stmt, args...)
 		if err != nil {
-			logError("Failed scanning row in getFollowers: %v", err)
-			break
+			t.Rollback()
+			logError("Couldn't delete user %d: %v", userID, err)
+			return err
 		}
+	}
 
-		users = append(users, u)
+	err = t.Commit()
+	if err != nil {
+		t.Rollback()
+		logError("Rolling back after Commit(): %v\n", err)
+		return err
 	}
-	err = rows.Err()
+	return nil
+}
+
+// updateReadingSettings saves the types of posts the user wants in their
+// feed, and whether they want posts with content warnings expanded. With no
+// types given, they get every type.
+func (app *app) updateReadingSettings(userID int64, types []string, expandWarnings bool) error {
+	_, err := app.db.Exec("UPDATE users SET feed_types = NULLIF(?, ''), expand_warnings = ? WHERE id = ?", strings.Join(types, ","), expandWarnings, userID)
 	if err != nil {
-		logError("Error after Next() on rows in getFollowers: %v", err)
+		logError("Couldn't update reading settings: %v", err)
 	}
+	return err
+}
 
-	return &users, nil
+// updateAliases saves the actor IRIs of the user's other accounts.
+func (app *app) updateAliases(userID int64, aliases []string) error {
+	_, err := app.db.Exec("UPDATE users SET also_known_as = NULLIF(?, '') WHERE id = ?", strings.Join(aliases, " "), userID)
+	if err != nil {
+		logError("Couldn't update aliases: %v", err)
+	}
+	return err
 }
 
-func (app *app) getFollowing(id int64, page int) (*[]string, error) {
-	limitStr := ""
-	if page > 0 {
-		pagePosts := 10
-		start := page*pagePosts - pagePosts
-		limitStr = fmt.Sprintf(" LIMIT %d, %d", start, pagePosts)
+// setMovedTo records that the given local or remote user moved to the
+// account with the given actor IRI.
+func (app *app) setMovedTo(userID int64, actorIRI string) error {
+	_, err := app.db.Exec("UPDATE users SET moved_to = NULLIF(?, '') WHERE id = ?", actorIRI, userID)
+	if err != nil {
+		logError("Couldn't update moved_to: %v", err)
 	}
+	return err
+}
 
-	rows, err := app.db.Query(`SELECT actor_id
+// getLocalFollowers returns the usernames of the local users who follow the
+// given remote user.
+func (app *app) getLocalFollowers(remoteUserID int64) ([]string, error) {
+	rows, err := app.db.Query(`SELECT username
 		FROM follows
-		LEFT JOIN users
-			ON followee = id
-		WHERE follower = ?`+limitStr, id)
+		INNER JOIN users
+			ON follower = id
+		WHERE followee = ? AND password IS NOT NULL`, remoteUserID)
 	if err != nil {
-		logError("Failed selecting following: %v", err)
-		return nil, impart.HTTPError{http.StatusInternalServerError, "Couldn't retrieve following."}
+		logError("Failed selecting local followers: %v", err)
+		return nil, err
 	}
 	defer rows.Close()
 
 	users := []string{}
 	for rows.Next() {
-		u := ""
-		err = rows.Scan(&u)
+		var username string
+		err = rows.Scan(&username)
 		if err != nil {
-			logError("Failed scanning row in getFollowing: %v", err)
+			logError("Failed scanning row in getLocalFollowers: %v", err)
 			break
 		}
-
-		users = append(users, u)
+		users = append(users, username)
 	}
 	err = rows.Err()
 	if err != nil {
-		logError("Error after Next() on rows in getFollowing: %v", err)
-	}
-
-	return &users, nil
-}
-
-func (app *app) getUsersCount() (uint64, error) {
-	var c uint64
-	err := app.db.QueryRow("SELECT COUNT(*) FROM users WHERE password IS NOT NULL").Scan(&c)
-	if err != nil {
-		logError("Couldn't get users count: %v", err)
-		return 0, err
+		logError("Error after Next() on rows in getLocalFollowers: %v", err)
 	}
 
-	return c, nil
-}
-
-func (app *app) getActor(id string) (*User, error) {
-	return app.getUserBy("actor_id = ?", id)
+	return users, nil
 }
 
-func (app *app) getUserBy(condition string, value interface{}) (*User, error) {
-	u := User{}
-
-	stmt := `SELECT id, actor_id, u.username, type, name, summary, created, url, following_iri, followers_iri, inbox_iri, outbox_iri, shared_inbox_iri, avatar, avatar_type, host
-		FROM users u
-			INNER JOIN foundusers
-			USING (actor_id)
-		WHERE ` + condition
-	err := app.db.QueryRow(stmt, value).Scan(&u.ID, &u.BaseObject.ID, &u.PreferredUsername, &u.Type, &u.Name, &u.Summary, &u.Created, &u.URL, &u.Following, &u.Followers, &u.Inbox, &u.Outbox, &u.Endpoints.SharedInbox, &u.Icon.URL, &u.Icon.Type, &u.Host)
+// getFeedTokenUser returns the local user whose private feeds the given token
+// unlocks.
+func (app *app) getFeedTokenUser(token string) (*LocalUser, error) {
+	var username string
+	err := app.db.QueryRow("SELECT username FROM users WHERE feed_token = ? AND password IS NOT NULL", token).Scan(&username)
 	switch {
 	case err == sql.ErrNoRows:
-		return nil, impart.HTTPError{http.StatusNotFound, "User not found"}
+		return nil, impart.HTTPError{http.StatusNotFound, "Feed not found."}
 	case err != nil:
+		logError("Couldn't get feed token user: %v", err)
 		return nil, err
 	}
-
-	return &u, nil
+	return app.getLocalUser(username)
 }
 
-func (app *app) createPost(p *Post) error {
-	_, err := app.db.Exec("INSERT INTO posts (owner_id, activity_id, type, published, url, name, content) VALUES ((SELECT id FROM users WHERE actor_id = ?), ?, ?, ?, ?, ?, ?)", p.actorID, p.ActivityID, p.Type, p.Published, p.URL, p.Name, p.Content)
+func (app *app) setFeedToken(userID int64, token string) error {
+	_, err := app.db.Exec("UPDATE users SET feed_token = NULLIF(?, '') WHERE id = ?", token, userID)
+	if err != nil {
+		logError("Couldn't set feed token: %v", err)
+	}
 	return err
 }
 
-func (app *app) updatePost(p *Post) error {
-	_, err := app.db.Exec("UPDATE posts SET url = ?, name = ?, content = ? WHERE activity_id = ?", p.URL, p.Name, p.Content, p.ActivityID)
+func (app *app) updateDigestSettings(userID int64, email, digest string) error {
+	_, err := app.db.Exec("UPDATE users SET email = NULLIF(?, ''), digest = NULLIF(?, '') WHERE id = ?", email, digest, userID)
+	if err != nil {
+		logError("Couldn't update digest settings: %v", err)
+	}
 	return err
 }
 
-func (app *app) deletePost(postID string) error {
-	_, err := app.db.Exec("DELETE FROM posts WHERE activity_id = ?", postID)
+// getDueDigestUsers returns the usernames of everyone whose next digest is due.
+func (app *app) getDueDigestUsers() ([]string, error) {
+	rows, err := app.db.Query(`SELECT username FROM users
+		WHERE password IS NOT NULL AND email IS NOT NULL AND (
+			(digest = ? AND (digest_sent IS NULL OR digest_sent <= DATE_SUB(NOW(), INTERVAL 1 DAY))) OR
+			(digest = ? AND (digest_sent IS NULL OR digest_sent <= DATE_SUB(NOW(), INTERVAL 1 WEEK))))`, digestDaily, digestWeekly)
+	if err != nil {
+		logError("Failed selecting digest users: %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := []string{}
+	for rows.Next() {
+		var username string
+		err = rows.Scan(&username)
+		if err != nil {
+			logError("Failed scanning row in getDueDigestUsers: %v", err)
+			break
+		}
+		users = append(users, username)
+	}
+	err = rows.Err()
+	if err != nil {
+		logError("Error after Next() on rows in getDueDigestUsers: %v", err)
+	}
+
+	return users, nil
+}
+
+// setDigestSent marks the user's digest as handled, even if it had nothing
+// new to send.
+func (app *app) setDigestSent(userID int64) error {
+	_, err := app.db.Exec("UPDATE users SET digest_sent = NOW() WHERE id = ?", userID)
 	return err
 }
 
-func (app *app) getUserFeed(id int64, page int) (*[]Post, error) {
-	pagePosts := 10
-	start := page*pagePosts - pagePosts
-	if page == 0 {
-		start = 0
-		pagePosts = 100
+// recordDigest saves which posts were emailed in a digest, so they aren't
+// sent again.
+func (app *app) recordDigest(userID int64, frequency, recipient, subject string, posts []Post) error {
+	t, err := app.db.Begin()
+	if err != nil {
+		logError("Unable to start transaction: %v", err)
+		return err
 	}
 
-	limitStr := ""
-	if page > 0 {
-		limitStr = fmt.Sprintf(" LIMIT %d, %d", start, pagePosts)
+	res, err := t.Exec("INSERT INTO digests (user_id, frequency, recipient, subject, posts, sent) VALUES (?, ?, ?, ?, ?, NOW())", userID, frequency, recipient, subject, len(posts))
+	if err != nil {
+		t.Rollback()
+		logError("Couldn't record digest: %v", err)
+		return err
 	}
-	rows, err := app.db.Query(`SELECT p.id, owner_id, activity_id, p.type, published, p.url, p.name, content, f.host, u.username, u.name, u.url
-		FROM posts p
-		INNER JOIN users u
-			ON owner_id = u.id
-		LEFT JOIN foundusers f
-			USING(actor_id)
-		WHERE owner_id 
-			IN (SELECT followee FROM follows WHERE follower = ?)
-		ORDER BY published DESC `+limitStr, id)
+	digestID, err := res.LastInsertId()
 	if err != nil {
-		logError("Failed selecting from posts: %v", err)
-		return nil, impart.HTTPError{http.StatusInternalServerError, "Couldn't retrieve user feed."}
+		t.Rollback()
+		logError("No lastinsertid for digest, rolling back: %v", err)
+		return err
+	}
+	for _, p := range posts {
+		_, err = t.Exec("INSERT INTO digestposts (digest_id, post_id) VALUES (?, ?)", digestID, p.ID)
+		if err != nil {
+			t.Rollback()
+			logError("Couldn't record digest post: %v", err)
+			return err
+		}
+	}
+	_, err = t.Exec("UPDATE users SET digest_sent = NOW() WHERE id = ?", userID)
+	if err != nil {
+		t.Rollback()
+		return err
+	}
+
+	err = t.Commit()
+	if err != nil {
+		t.Rollback()
+		logError("Rolling back after Commit(): %v\n", err)
+		return err
+	}
+	return nil
+}
+
+// getDigests returns the most recent digests sent to the given user.
+func (app *app) getDigests(userID int64) (*[]Digest, error) {
+	rows, err := app.db.Query("SELECT frequency, recipient, subject, posts, sent FROM digests WHERE user_id = ? ORDER BY sent DESC LIMIT 10", userID)
+	if err != nil {
+		logError("Failed selecting digests: %v", err)
+		return nil, impart.HTTPError{http.StatusInternalServerError, "Couldn't retrieve digests."}
 	}
 	defer rows.Close()
 
-	// TODO: extract this common row scanning logic for queries using `postCols`
-	posts := []Post{}
+	digests := []Digest{}
 	for rows.Next() {
-		p := Post{
-			Owner:    &User{},
-			IsInFeed: true,
-		}
-		err = rows.Scan(&p.ID, &p.OwnerID, &p.ActivityID, &p.Type, &p.Published, &p.URL, &p.Name, &p.Content, &p.Owner.Host, &p.Owner.PreferredUsername, &p.Owner.Name, &p.Owner.URL)
+		d := Digest{}
+		err = rows.Scan(&d.Frequency, &d.Recipient, &d.Subject, &d.Posts, &d.Sent)
 		if err != nil {
-			logError("Failed scanning row: %v", err)
+			logError("Failed scanning row in getDigests: %v", err)
 			break
 		}
-
-		posts = append(posts, p)
+		digests = append(digests, d)
 	}
 	err = rows.Err()
 	if err != nil {
-		logError("Error after Next() on rows: %v", err)
+		logError("Error after Next() on rows in getDigests: %v", err)
 	}
 
-	return &posts, nil
+	return &digests, nil
 }
 
-func (app *app) getPost(id int64) (*Post, error) {
-	p := Post{
-		Owner:    &User{},
-		IsInFeed: false,
+func (app *app) updateLocalUser(u *LocalUser) error {
+	_, err := app.db.Exec("UPDATE users SET name = ?, summary = ?, avatar = NULLIF(?, ''), avatar_type = NULLIF(?, '') WHERE id = ?", u.Name, u.Summary, u.Avatar, u.AvatarType, u.ID)
+	if err != nil {
+		logError("Couldn't update user %d: %v", u.ID, err)
+		return impart.HTTPError{http.StatusInternalServerError, "Couldn't update profile."}
 	}
-	stmt := `SELECT p.id, owner_id, activity_id, p.type, published, p.url, p.name, content, f.host, u.username, u.name, u.url
-		FROM posts p
-		INNER JOIN users u
-			ON owner_id = u.id
-		LEFT JOIN foundusers f
-			USING(actor_id)
-		WHERE p.id = ?`
-	err := app.db.QueryRow(stmt, id).Scan(&p.ID, &p.OwnerID, &p.ActivityID, &p.Type, &p.Published, &p.URL, &p.Name, &p.Content, &p.Owner.Host, &p.Owner.PreferredUsername, &p.Owner.Name, &p.Owner.URL)
-	switch {
-	case err == sql.ErrNoRows:
-		return nil, impart.HTTPError{http.StatusNotFound, "Post not found"}
-	case err != nil:
-		return nil, err
+	return nil
+}
+
+func (app *app) updatePassword(userID int64, hashedPass []byte) error {
+	_, err := app.db.Exec("UPDATE users SET password = ? WHERE id = ? AND password IS NOT NULL", hashedPass, userID)
+	if err != nil {
+		logError("Couldn't update password for user %d: %v", userID, err)
+		return impart.HTTPError{http.StatusInternalServerError, "Couldn't update password."}
 	}
-	return &p, err
+	return nil
 }
 
-func (app *app) getActorKey(id string) ([]byte, error) {
-	k := []byte{}
+// enableTwoFactor saves the given TOTP secret for the user and replaces any
+// recovery codes they had with the given hashes.
+func (app *app) enableTwoFactor(userID int64, secret string, codeHashes []string) error {
+	t, err := app.db.Begin()
+	if err != nil {
+		logError("Unable to start transaction: %v", err)
+		return err
+	}
 
-	stmt := "SELECT public_key FROM userkeys WHERE id = ?"
-	err := app.db.QueryRow(stmt, id).Scan(&k)
+	_, err = t.Exec("UPDATE users SET totp_secret = ?, totp_step = NULL WHERE id = ?", secret, userID)
+	if err != nil {
+		t.Rollback()
+		return err
+	}
+	_, err = t.Exec("DELETE FROM recoverycodes WHERE user_id = ?", userID)
+	if err != nil {
+		t.Rollback()
+		return err
+	}
+	for _, h := range codeHashes {
+		_, err = t.Exec("INSERT INTO recoverycodes (user_id, code_hash) VALUES (?, ?)", userID, h)
+		if err != nil {
+			t.Rollback()
+			return err
+		}
+	}
+
+	err = t.Commit()
+	if err != nil {
+		t.Rollback()
+		logError("Rolling back after Commit(): %v\n", err)
+		return err
+	}
+	return nil
+}
+
+func (app *app) disableTwoFactor(userID int64) error {
+	_, err := app.db.Exec("UPDATE users SET totp_secret = NULL, totp_step = NULL WHERE id = ?", userID)
+	if err != nil {
+		return err
+	}
+	_, err = app.db.Exec("DELETE FROM recoverycodes WHERE user_id = ?", userID)
+	return err
+}
+
+// useTOTPStep saves the time step of a TOTP code the user logged in with,
+// returning false if they already used that step or a later one.
+func (app *app) useTOTPStep(userID, step int64) (bool, error) {
+	res, err := app.db.Exec("UPDATE users SET totp_step = ? WHERE id = ? AND (totp_step IS NULL OR totp_step < ?)", step, userID, step)
+	if err != nil {
+		logError("Couldn't save TOTP step: %v", err)
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n == 1, nil
+}
+
+// useRecoveryCode deletes the given recovery code hash for the user, returning
+// whether it existed.
+func (app *app) useRecoveryCode(userID int64, codeHash string) (bool, error) {
+	res, err := app.db.Exec("DELETE FROM recoverycodes WHERE user_id = ? AND code_hash = ?", userID, codeHash)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+func (app *app) createSession(userID int64, token, userAgent string) error {
+	if len(userAgent) > 255 {
+		userAgent = userAgent[:255]
+	}
+	_, err := app.db.Exec("INSERT INTO sessions (token, user_id, user_agent, created, last_seen) VALUES (?, ?, ?, NOW(), NOW())", token, userID, userAgent)
+	if err != nil {
+		logError("Couldn't create session: %v", err)
+		return impart.HTTPError{http.StatusInternalServerError, "Couldn't start session."}
+	}
+	return nil
+}
+
+// isSessionValid returns whether the given session token belongs to the given
+// user and hasn't expired or been revoked. It also records the session as
+// recently used.
+func (app *app) isSessionValid(token string, userID int64) bool {
+	var id int64
+	err := app.db.QueryRow("SELECT id FROM sessions WHERE token = ? AND user_id = ? AND created > DATE_SUB(NOW(), INTERVAL ? SECOND)", token, userID, sessionLength).Scan(&id)
+	switch {
+	case err == sql.ErrNoRows:
+		return false
+	case err != nil:
+		logError("Couldn't check session: %v", err)
+		return false
+	}
+
+	_, err = app.db.Exec("UPDATE sessions SET last_seen = NOW() WHERE id = ? AND last_seen < DATE_SUB(NOW(), INTERVAL 5 MINUTE)", id)
+	if err != nil {
+		logError("Couldn't update session last_seen: %v", err)
+	}
+	return true
+}
+
+func (app *app) getUserSessions(userID int64, currentToken string) (*[]Session, error) {
+	rows, err := app.db.Query("SELECT id, token, IFNULL(user_agent, ''), created, last_seen FROM sessions WHERE user_id = ? ORDER BY last_seen DESC", userID)
+	if err != nil {
+		logError("Failed selecting sessions: %v", err)
+		return nil, impart.HTTPError{http.StatusInternalServerError, "Couldn't retrieve sessions."}
+	}
+	defer rows.Close()
+
+	sessions := []Session{}
+	for rows.Next() {
+		s := Session{}
+		var token string
+		err = rows.Scan(&s.ID, &token, &s.UserAgent, &s.Created, &s.LastSeen)
+		if err != nil {
+			logError("Failed scanning row in getUserSessions: %v", err)
+			break
+		}
+		s.IsCurrent = token == currentToken
+
+		sessions = append(sessions, s)
+	}
+	err = rows.Err()
+	if err != nil {
+		logError("Error after Next() on rows in getUserSessions: %v", err)
+	}
+
+	return &sessions, nil
+}
+
+func (app *app) deleteSession(userID, id int64) error {
+	_, err := app.db.Exec("DELETE FROM sessions WHERE id = ? AND user_id = ?", id, userID)
+	return err
+}
+
+func (app *app) deleteSessionByToken(token string) error {
+	_, err := app.db.Exec("DELETE FROM sessions WHERE token = ?", token)
+	return err
+}
+
+// deleteUserSessions logs the given user out everywhere except for the
+// session with the given token, which may be empty.
+func (app *app) deleteUserSessions(userID int64, exceptToken string) error {
+	_, err := app.db.Exec("DELETE FROM sessions WHERE user_id = ? AND token != ?", userID, exceptToken)
+	return err
+}
+
+func (app *app) getFollowers(id int64, page int) (*[]string, error) {
+	limitStr := ""
+	if page > 0 {
+		pagePosts := 10
+		start := page*pagePosts - pagePosts
+		limitStr = fmt.Sprintf(" LIMIT %d, %d", start, pagePosts)
+	}
+
+	rows, err := app.db.Query(`SELECT actor_id
+		FROM follows
+		LEFT JOIN users
+			ON follower = id
+		WHERE followee = ?`+limitStr, id)
+	if err != nil {
+		logError("Failed selecting followers: %v", err)
+		return nil, impart.HTTPError{http.StatusInternalServerError, "Couldn't retrieve followers."}
+	}
+	defer rows.Close()
+
+	users := []string{}
+	for rows.Next() {
+		u := ""
+		err = rows.Scan(&u)
+		if err != nil {
+			logError("Failed scanning row in getFollowers: %v", err)
+			break
+		}
+
+		users = append(users, u)
+	}
+	err = rows.Err()
+	if err != nil {
+		logError("Error after Next() on rows in getFollowers: %v", err)
+	}
+
+	return &users, nil
+}
+
+func (app *app) getFollowing(id int64, page int) (*[]string, error) {
+	limitStr := ""
+	if page > 0 {
+		pagePosts := 10
+		start := page*pagePosts - pagePosts
+		limitStr = fmt.Sprintf(" LIMIT %d, %d", start, pagePosts)
+	}
+
+	rows, err := app.db.Query(`SELECT actor_id
+		FROM follows
+		LEFT JOIN users
+			ON followee = id
+		WHERE follower = ? AND IFNULL(type, '') != '`+feedUserType+`'`+limitStr, id)
+	if err != nil {
+		logError("Failed selecting following: %v", err)
+		return nil, impart.HTTPError{http.StatusInternalServerError, "Couldn't retrieve following."}
+	}
+	defer rows.Close()
+
+	users := []string{}
+	for rows.Next() {
+		u := ""
+		err = rows.Scan(&u)
+		if err != nil {
+			logError("Failed scanning row in getFollowing: %v", err)
+			break
+		}
+
+		users = append(users, u)
+	}
+	err = rows.Err()
+	if err != nil {
+		logError("Error after Next() on rows in getFollowing: %v", err)
+	}
+
+	return &users, nil
+}
+
+// getKnownInboxes returns the inboxes of everyone the given local user
+// follows or is followed by, preferring each server's shared inbox.
+func (app *app) getKnownInboxes(id int64) ([]string, error) {
+	rows, err := app.db.Query(`SELECT DISTINCT IFNULL(NULLIF(shared_inbox_iri, ''), inbox_iri)
+		FROM follows
+		INNER JOIN users
+			ON id = IF(followee = ?, follower, followee)
+		WHERE (follower = ? OR followee = ?) AND inbox_iri IS NOT NULL`, id, id, id)
+	if err != nil {
+		logError("Failed selecting known inboxes: %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	inboxes := []string{}
+	for rows.Next() {
+		var inbox string
+		err = rows.Scan(&inbox)
+		if err != nil {
+			logError("Failed scanning row in getKnownInboxes: %v", err)
+			break
+		}
+
+		inboxes = append(inboxes, inbox)
+	}
+	err = rows.Err()
+	if err != nil {
+		logError("Error after Next() on rows in getKnownInboxes: %v", err)
+	}
+
+	return inboxes, nil
+}
+
+// getFollowerInboxes returns the inboxes that activities from the given local
+// user should be delivered to, preferring each server's shared inbox so it
+// only receives one copy.
+func (app *app) getFollowerInboxes(id int64) ([]string, error) {
+	rows, err := app.db.Query(`SELECT DISTINCT IFNULL(NULLIF(shared_inbox_iri, ''), inbox_iri)
+		FROM follows
+		INNER JOIN users
+			ON follower = id
+		WHERE followee = ? AND inbox_iri IS NOT NULL`, id)
+	if err != nil {
+		logError("Failed selecting follower inboxes: %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	inboxes := []string{}
+	for rows.Next() {
+		var inbox string
+		err = rows.Scan(&inbox)
+		if err != nil {
+			logError("Failed scanning row in getFollowerInboxes: %v", err)
+			break
+		}
+
+		inboxes = append(inboxes, inbox)
+	}
+	err = rows.Err()
+	if err != nil {
+		logError("Error after Next() on rows in getFollowerInboxes: %v", err)
+	}
+
+	return inboxes, nil
+}
+
+func (app *app) getFollowersCount(id int64) (uint64, error) {
+	var c uint64
+	err := app.db.QueryRow("SELECT COUNT(*) FROM follows WHERE followee = ?", id).Scan(&c)
+	if err != nil {
+		logError("Couldn't get followers count: %v", err)
+		return 0, err
+	}
+
+	return c, nil
+}
+
+func (app *app) getFollowingCount(id int64) (uint64, error) {
+	var c uint64
+	err := app.db.QueryRow("SELECT COUNT(*) FROM follows WHERE follower = ?", id).Scan(&c)
+	if err != nil {
+		logError("Couldn't get following count: %v", err)
+		return 0, err
+	}
+
+	return c, nil
+}
+
+// getFollowingUsers returns the remote users the given local user follows.
+func (app *app) getFollowingUsers(id int64) (*[]User, error) {
+	rows, err := app.db.Query(`SELECT u.id, actor_id, u.username, IFNULL(u.type, ''), IFNULL(u.name, ''), IFNULL(u.url, ''), IFNULL(host, '')
+		FROM follows
+		INNER JOIN users u
+			ON followee = u.id
+		LEFT JOIN foundusers
+			USING(actor_id)
+		WHERE follower = ?
+		ORDER BY follows.created`, id)
+	if err != nil {
+		logError("Failed selecting following users: %v", err)
+		return nil, impart.HTTPError{http.StatusInternalServerError, "Couldn't retrieve following."}
+	}
+	defer rows.Close()
+
+	users := []User{}
+	for rows.Next() {
+		u := User{}
+		err = rows.Scan(&u.ID, &u.BaseObject.ID, &u.PreferredUsername, &u.Type, &u.Name, &u.URL, &u.Host)
+		if err != nil {
+			logError("Failed scanning row in getFollowingUsers: %v", err)
+			break
+		}
+
+		users = append(users, u)
+	}
+	err = rows.Err()
+	if err != nil {
+		logError("Error after Next() on rows in getFollowingUsers: %v", err)
+	}
+
+	return &users, nil
+}
+
+func (app *app) addFollow(follower, followee int64) error {
+	_, err := app.db.Exec("INSERT IGNORE INTO follows (follower, followee, created) VALUES (?, ?, NOW())", follower, followee)
+	if err != nil {
+		logError("Couldn't add follow: %v", err)
+	}
+	return err
+}
+
+func (app *app) isFollowing(follower, followee int64) (bool, error) {
+	var c int
+	err := app.db.QueryRow("SELECT COUNT(*) FROM follows WHERE follower = ? AND followee = ?", follower, followee).Scan(&c)
+	if err != nil {
+		logError("Couldn't check follow: %v", err)
+		return false, err
+	}
+	return c > 0, nil
+}
+
+func (app *app) removeFollow(follower, followee int64) error {
+	_, err := app.db.Exec("DELETE FROM follows WHERE follower = ? AND followee = ?", follower, followee)
+	return err
+}
+
+func (app *app) createAccessToken(userID int64, name, scope, tokenHash string) error {
+	_, err := app.db.Exec("INSERT INTO accesstokens (user_id, name, token_hash, scope, created) VALUES (?, ?, ?, ?, NOW())", userID, name, tokenHash, scope)
+	if err != nil {
+		logError("Couldn't create access token: %v", err)
+		return impart.HTTPError{http.StatusInternalServerError, "Couldn't create access token."}
+	}
+	return nil
+}
+
+// getAccessTokenUser returns the local user that owns the token with the given
+// hash, along with its scope.
+func (app *app) getAccessTokenUser(tokenHash string) (*LocalUser, string, error) {
+	u := LocalUser{}
+	var tokenID int64
+	var scope string
+	err := app.db.QueryRow(`SELECT t.id, scope, u.id, username
+		FROM accesstokens t
+		INNER JOIN users u
+			ON user_id = u.id
+		WHERE token_hash = ? AND (expires IS NULL OR expires > NOW())`, tokenHash).Scan(&tokenID, &scope, &u.ID, &u.PreferredUsername)
+	switch {
+	case err == sql.ErrNoRows:
+		return nil, "", impart.HTTPError{http.StatusUnauthorized, "Invalid access token."}
+	case err != nil:
+		logError("Couldn't get access token: %v", err)
+		return nil, "", err
+	}
+
+	_, err = app.db.Exec("UPDATE accesstokens SET last_used = NOW() WHERE id = ?", tokenID)
+	if err != nil {
+		logError("Couldn't update token last_used: %v", err)
+	}
+	return &u, scope, nil
+}
+
+func (app *app) getAccessTokens(userID int64) (*[]AccessToken, error) {
+	rows, err := app.db.Query("SELECT id, name, scope, created, last_used FROM accesstokens WHERE user_id = ? ORDER BY created DESC", userID)
+	if err != nil {
+		logError("Failed selecting access tokens: %v", err)
+		return nil, impart.HTTPError{http.StatusInternalServerError, "Couldn't retrieve access tokens."}
+	}
+	defer rows.Close()
+
+	tokens := []AccessToken{}
+	for rows.Next() {
+		t := AccessToken{}
+		var lastUsed mysql.NullTime
+		err = rows.Scan(&t.ID, &t.Name, &t.Scope, &t.Created, &lastUsed)
+		if err != nil {
+			logError("Failed scanning row in getAccessTokens: %v", err)
+			break
+		}
+		if lastUsed.Valid {
+			t.LastUsed = &lastUsed.Time
+		}
+
+		tokens = append(tokens, t)
+	}
+	err = rows.Err()
+	if err != nil {
+		logError("Error after Next() on rows in getAccessTokens: %v", err)
+	}
+
+	return &tokens, nil
+}
+
+func (app *app) deleteAccessToken(userID, id int64) error {
+	_, err := app.db.Exec("DELETE FROM accesstokens WHERE id = ? AND user_id = ?", id, userID)
+	return err
+}
+
+func (app *app) createOAuthClient(c *OAuthClient, secretHash string) error {
+	_, err := app.db.Exec("INSERT INTO oauthclients (id, secret_hash, name, website, redirect_uris, long_lived_tokens, created) VALUES (?, ?, ?, NULLIF(?, ''), ?, ?, NOW())", c.ID, secretHash, c.Name, c.Website, strings.Join(c.RedirectURIs, "\n"), c.longLived)
+	if err != nil {
+		logError("Couldn't create OAuth client: %v", err)
+		return impart.HTTPError{http.StatusInternalServerError, "Couldn't register app."}
+	}
+	return nil
+}
+
+func (app *app) getOAuthClient(id string) (*OAuthClient, error) {
+	c := OAuthClient{}
+	var redirectURIs string
+	err := app.db.QueryRow("SELECT id, secret_hash, name, IFNULL(website, ''), redirect_uris, long_lived_tokens FROM oauthclients WHERE id = ?", id).Scan(&c.ID, &c.secretHash, &c.Name, &c.Website, &redirectURIs, &c.longLived)
+	switch {
+	case err == sql.ErrNoRows:
+		return nil, impart.HTTPError{http.StatusNotFound, "App not found."}
+	case err != nil:
+		logError("Couldn't get OAuth client: %v", err)
+		return nil, err
+	}
+	c.RedirectURIs = strings.Split(redirectURIs, "\n")
+	return &c, nil
+}
+
+func (app *app) createOAuthCode(codeHash string, c *oauthCode) error {
+	_, err := app.db.Exec("INSERT INTO oauthcodes (code_hash, client_id, user_id, redirect_uri, scope, code_challenge, code_challenge_method, expires) VALUES (?, ?, ?, ?, ?, NULLIF(?, ''), NULLIF(?, ''), DATE_ADD(NOW(), INTERVAL ? SECOND))", codeHash, c.clientID, c.userID, c.redirectURI, c.scope, c.challenge, c.challengeMethod, int(oauthCodeLifetime.Seconds()))
+	if err != nil {
+		logError("Couldn't create OAuth code: %v", err)
+		return impart.HTTPError{http.StatusInternalServerError, "Couldn't authorize app."}
+	}
+	return nil
+}
+
+// useOAuthCode returns the unexpired authorization code with the given hash,
+// deleting it so it can only be exchanged once.
+func (app *app) useOAuthCode(codeHash string) (*oauthCode, error) {
+	t, err := app.db.Begin()
+	if err != nil {
+		logError("Unable to start transaction: %v", err)
+		return nil, err
+	}
+
+	c := oauthCode{}
+	var expired bool
+	err = t.QueryRow("SELECT client_id, user_id, redirect_uri, scope, IFNULL(code_challenge, ''), IFNULL(code_challenge_method, ''), expires < NOW() FROM oauthcodes WHERE code_hash = ? FOR UPDATE", codeHash).Scan(&c.clientID, &c.userID, &c.redirectURI, &c.scope, &c.challenge, &c.challengeMethod, &expired)
+	if err != nil {
+		t.Rollback()
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	_, err = t.Exec("DELETE FROM oauthcodes WHERE code_hash = ?", codeHash)
+	if err != nil {
+		t.Rollback()
+		return nil, err
+	}
+
+	err = t.Commit()
+	if err != nil {
+		t.Rollback()
+		logError("Rolling back after Commit(): %v\n", err)
+		return nil, err
+	}
+	if expired {
+		return nil, nil
+	}
+	return &c, nil
+}
+
+func (app *app) createOAuthToken(userID int64, c *OAuthClient, scope, tokenHash, refreshHash string) error {
+	_, err := app.db.Exec("INSERT INTO accesstokens (user_id, name, token_hash, scope, client_id, refresh_hash, created, expires) VALUES (?, ?, ?, ?, ?, ?, NOW(), IF(? = 0, NULL, DATE_ADD(NOW(), INTERVAL ? SECOND)))", userID, c.Name, tokenHash, scope, c.ID, refreshHash, c.tokenLifetime(), c.tokenLifetime())
+	if err != nil {
+		logError("Couldn't create OAuth token: %v", err)
+		return err
+	}
+	return nil
+}
+
+// useRefreshToken deletes the token that the given refresh token belongs to,
+// returning the token's user and scope so a new one can be issued.
+func (app *app) useRefreshToken(refreshHash, clientID string) (int64, string, error) {
+	var id, userID int64
+	var scope string
+	err := app.db.QueryRow("SELECT id, user_id, scope FROM accesstokens WHERE refresh_hash = ? AND client_id = ?", refreshHash, clientID).Scan(&id, &userID, &scope)
+	switch {
+	case err == sql.ErrNoRows:
+		return 0, "", nil
+	case err != nil:
+		return 0, "", err
+	}
+
+	res, err := app.db.Exec("DELETE FROM accesstokens WHERE id = ?", id)
+	if err != nil {
+		return 0, "", err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		// Someone else just used this refresh token
+		return 0, "", nil
+	}
+	return userID, scope, nil
+}
+
+// revokeOAuthToken deletes the given client's token that has the given access
+// or refresh token hash.
+func (app *app) revokeOAuthToken(hash, clientID string) error {
+	_, err := app.db.Exec("DELETE FROM accesstokens WHERE (token_hash = ? OR refresh_hash = ?) AND client_id = ?", hash, hash, clientID)
+	return err
+}
+
+func (app *app) getUsersCount() (uint64, error) {
+	var c uint64
+	err := app.db.QueryRow("SELECT COUNT(*) FROM users WHERE password IS NOT NULL").Scan(&c)
+	if err != nil {
+		logError("Couldn't get users count: %v", err)
+		return 0, err
+	}
+
+	return c, nil
+}
+
+func (app *app) getActor(id string) (*User, error) {
+	return app.getUserBy("actor_id = ?", id)
+}
+
+func (app *app) getUserByID(id int64) (*User, error) {
+	return app.getUserBy("id = ?", id)
+}
+
+func (app *app) getActorByHandle(username, host string) (*User, error) {
+	return app.getUserBy("foundusers.username = ? AND host = ?", username, host)
+}
+
+func (app *app) getUserBy(condition string, values ...interface{}) (*User, error) {
+	u := User{}
+
+	stmt := `SELECT id, actor_id, u.username, IFNULL(type, ''), name, summary, created, IFNULL(url, ''), IFNULL(following_iri, ''), IFNULL(followers_iri, ''), IFNULL(inbox_iri, ''), IFNULL(outbox_iri, ''), IFNULL(shared_inbox_iri, ''), IFNULL(avatar, ''), IFNULL(avatar_type, ''), IFNULL(host, '')
+		FROM users u
+			LEFT JOIN foundusers
+			USING (actor_id)
+		WHERE password IS NULL AND ` + condition
+	err := app.db.QueryRow(stmt, values...).Scan(&u.ID, &u.BaseObject.ID, &u.PreferredUsername, &u.Type, &u.Name, &u.Summary, &u.Created, &u.URL, &u.Following, &u.Followers, &u.Inbox, &u.Outbox, &u.Endpoints.SharedInbox, &u.Icon.URL, &u.Icon.Type, &u.Host)
+	switch {
+	case err == sql.ErrNoRows:
+		return nil, impart.HTTPError{http.StatusNotFound, "User not found"}
+	case err != nil:
+		return nil, err
+	}
+
+	return &u, nil
+}
+
+// createFeed saves a newly subscribed feed, along with the user its posts
+// belong to.
+func (app *app) createFeed(f *Feed) (int64, error) {
+	t, err := app.db.Begin()
+	if err != nil {
+		logError("Unable to start transaction: %v", err)
+		return 0, err
+	}
+
+	res, err := t.Exec("INSERT INTO users (actor_id, username, type, name, summary, created, url) VALUES (?, ?, ?, ?, ?, NOW(), ?)", f.URL, f.username(), feedUserType, f.Title, f.Description, f.SiteURL)
+	if err != nil {
+		t.Rollback()
+		logError("Couldn't add feed user: %v", err)
+		return 0, err
+	}
+	userID, err := res.LastInsertId()
+	if err != nil {
+		t.Rollback()
+		logError("No lastinsertid for feed, rolling back: %v", err)
+		return 0, err
+	}
+
+	_, err = t.Exec("INSERT INTO feeds (user_id, url, etag, last_modified, last_fetched) VALUES (?, ?, NULLIF(?, ''), NULLIF(?, ''), NOW())", userID, f.URL, f.etag, f.lastModified)
+	if err != nil {
+		t.Rollback()
+		logError("Couldn't add feed: %v", err)
+		return 0, err
+	}
+
+	err = t.Commit()
+	if err != nil {
+		t.Rollback()
+		logError("Rolling back after Commit(): %v\n", err)
+		return 0, err
+	}
+
+	f.UserID = userID
+	return userID, nil
+}
+
+// getFollowedFeeds returns every feed that someone follows.
+func (app *app) getFollowedFeeds() (*[]Feed, error) {
+	rows, err := app.db.Query(`SELECT user_id, f.url, IFNULL(etag, ''), IFNULL(last_modified, ''), u.name, u.summary, IFNULL(u.url, '')
+		FROM feeds f
+		INNER JOIN users u
+			ON user_id = u.id
+		WHERE user_id IN (SELECT followee FROM follows)`)
+	if err != nil {
+		logError("Failed selecting feeds: %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	feeds := []Feed{}
+	for rows.Next() {
+		f := Feed{}
+		err = rows.Scan(&f.UserID, &f.URL, &f.etag, &f.lastModified, &f.Title, &f.Description, &f.SiteURL)
+		if err != nil {
+			logError("Failed scanning row in getFollowedFeeds: %v", err)
+			break
+		}
+		feeds = append(feeds, f)
+	}
+	err = rows.Err()
+	if err != nil {
+		logError("Error after Next() on rows in getFollowedFeeds: %v", err)
+	}
+
+	return &feeds, nil
+}
+
+// updateFeed saves the details and cache validators from fetching a feed.
+func (app *app) updateFeed(f *Feed) error {
+	_, err := app.db.Exec("UPDATE feeds f INNER JOIN users u ON user_id = u.id SET etag = NULLIF(?, ''), last_modified = NULLIF(?, ''), last_fetched = NOW(), u.name = ?, u.summary = ?, u.url = ? WHERE user_id = ?", f.etag, f.lastModified, f.Title, f.Description, f.SiteURL, f.UserID)
+	if err != nil {
+		logError("Couldn't update feed: %v", err)
+	}
+	return err
+}
+
+// nullTime returns the given time for a nullable column, with the zero time
+// as NULL.
+func nullTime(t time.Time) interface{} {
+	if t.IsZero() {
+		return nil
+	}
+	return t
+}
+
+// createPost saves a new post along with its media and poll options. If
+// there's already a post with its activity ID, the MySQL duplicate key error
+// is returned.
+func (app *app) createPost(p *Post) error {
+	t, err := app.db.Begin()
+	if err != nil {
+		logError("Unable to start transaction: %v", err)
+		return err
+	}
+
+	res, err := t.Exec("INSERT INTO posts (owner_id, activity_id, type, published, url, name, content, summary, sensitive, start_time, end_time, location, multiple) VALUES ((SELECT id FROM users WHERE actor_id = ?), ?, ?, ?, ?, ?, ?, NULLIF(?, ''), ?, ?, ?, NULLIF(?, ''), ?)",
+		p.actorID, p.ActivityID, p.Type, p.Published, p.URL, p.Name, p.Content, p.Warning, p.Sensitive, nullTime(p.Start), nullTime(p.End), p.Location, p.Multiple)
+	if err != nil {
+		t.Rollback()
+		return err
+	}
+	postID, err := res.LastInsertId()
+	if err != nil {
+		t.Rollback()
+		return err
+	}
+	err = savePostExtras(t, postID, p)
+	if err != nil {
+		t.Rollback()
+		return err
+	}
+
+	err = t.Commit()
+	if err != nil {
+		t.Rollback()
+		logError("Rolling back after Commit(): %v\n", err)
+		return err
+	}
+	return nil
+}
+
+// savePostExtras replaces the media and poll options of the given post.
+func savePostExtras(t *sql.Tx, postID int64, p *Post) error {
+	_, err := t.Exec("DELETE FROM attachments WHERE post_id = ?", postID)
+	if err != nil {
+		logError("Couldn't delete attachments: %v", err)
+		return err
+	}
+	for i, a := range p.Media {
+		_, err = t.Exec("INSERT INTO attachments (post_id, position, url, media_type, name, width, height, blurhash) VALUES (?, ?, ?, ?, NULLIF(?, ''), NULLIF(?, 0), NULLIF(?, 0), NULLIF(?, ''))",
+			postID, i, a.URL, a.MediaType, a.Name, a.Width, a.Height, a.Blurhash)
+		if err != nil {
+			logError("Couldn't add attachment: %v", err)
+			return err
+		}
+	}
+
+	_, err = t.Exec("DELETE FROM polloptions WHERE post_id = ?", postID)
+	if err != nil {
+		logError("Couldn't delete poll options: %v", err)
+		return err
+	}
+	for i, o := range p.Options {
+		_, err = t.Exec("INSERT INTO polloptions (post_id, position, name, votes) VALUES (?, ?, ?, ?)", postID, i, o.Name, o.Votes)
+		if err != nil {
+			logError("Couldn't add poll option: %v", err)
+			return err
+		}
+	}
+	return nil
+}
+
+// getPostID returns the ID of the post with the given activity ID.
+func (app *app) getPostID(activityID string) (int64, error) {
+	var id int64
+	err := app.db.QueryRow("SELECT id FROM posts WHERE activity_id = ?", activityID).Scan(&id)
+	return id, err
+}
+
+// renamePost changes the activity ID of the given actor's post with the old
+// ID, if they have one.
+func (app *app) renamePost(actorID, oldID, newID string) error {
+	_, err := app.db.Exec("UPDATE IGNORE posts p INNER JOIN users u ON owner_id = u.id SET activity_id = ? WHERE activity_id = ? AND actor_id = ?", newID, oldID, actorID)
+	if err != nil {
+		logError("Couldn't rename post %s: %v", oldID, err)
+	}
+	return err
+}
+
+// updatePost saves changes to a post, if it belongs to the post's actor.
+func (app *app) updatePost(p *Post) error {
+	t, err := app.db.Begin()
+	if err != nil {
+		logError("Unable to start transaction: %v", err)
+		return err
+	}
+
+	var postID int64
+	err = t.QueryRow("SELECT p.id FROM posts p INNER JOIN users u ON owner_id = u.id WHERE activity_id = ? AND actor_id = ?", p.ActivityID, p.actorID).Scan(&postID)
+	if err != nil {
+		t.Rollback()
+		if err == sql.ErrNoRows {
+			return nil
+		}
+		return err
+	}
+	_, err = t.Exec("UPDATE posts SET url = ?, name = ?, content = ?, summary = NULLIF(?, ''), sensitive = ?, start_time = ?, end_time = ?, location = NULLIF(?, ''), multiple = ? WHERE id = ?",
+		p.URL, p.Name, p.Content, p.Warning, p.Sensitive, nullTime(p.Start), nullTime(p.End), p.Location, p.Multiple, postID)
+	if err != nil {
+		t.Rollback()
+		return err
+	}
+	err = savePostExtras(t, postID, p)
+	if err != nil {
+		t.Rollback()
+		return err
+	}
+
+	err = t.Commit()
+	if err != nil {
+		t.Rollback()
+		logError("Rolling back after Commit(): %v\n", err)
+		return err
+	}
+	return nil
+}
+
+// loadPostMedia adds the media and poll options to each of the given posts.
+func (app *app) loadPostMedia(posts *[]Post) *[]Post {
+	if len(*posts) == 0 {
+		return posts
+	}
+	ids := make([]interface{}, len(*posts))
+	byID := map[int64]*Post{}
+	for i := range *posts {
+		p := &(*posts)[i]
+		ids[i] = p.ID
+		byID[p.ID] = p
+	}
+	in := "(?" + strings.Repeat(", ?", len(ids)-1) + ")"
+
+	rows, err := app.db.Query("SELECT post_id, url, media_type, IFNULL(name, ''), IFNULL(width, 0), IFNULL(height, 0), IFNULL(blurhash, '') FROM attachments WHERE post_id IN "+in+" ORDER BY post_id, position", ids...)
+	if err != nil {
+		logError("Failed selecting attachments: %v", err)
+		return posts
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var postID int64
+		a := Attachment{}
+		err = rows.Scan(&postID, &a.URL, &a.MediaType, &a.Name, &a.Width, &a.Height, &a.Blurhash)
+		if err != nil {
+			logError("Failed scanning row in loadPostMedia: %v", err)
+			break
+		}
+		byID[postID].Media = append(byID[postID].Media, a)
+	}
+	err = rows.Err()
+	if err != nil {
+		logError("Error after Next() on rows in loadPostMedia: %v", err)
+	}
+
+	rows, err = app.db.Query("SELECT post_id, name, votes FROM polloptions WHERE post_id IN "+in+" ORDER BY post_id, position", ids...)
+	if err != nil {
+		logError("Failed selecting poll options: %v", err)
+		return posts
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var postID int64
+		o := PollOption{}
+		err = rows.Scan(&postID, &o.Name, &o.Votes)
+		if err != nil {
+			logError("Failed scanning row in loadPostMedia: %v", err)
+			break
+		}
+		byID[postID].Options = append(byID[postID].Options, o)
+	}
+	err = rows.Err()
+	if err != nil {
+		logError("Error after Next() on rows in loadPostMedia: %v", err)
+	}
+
+	for _, p := range byID {
+		if total := p.TotalVotes(); total > 0 {
+			for i := range p.Options {
+				p.Options[i].Percent = p.Options[i].Votes * 100 / total
+			}
+		}
+	}
+	return posts
+}
+
+// deletePost removes the given user's post with the given activity ID. Copies
+// that readers saved are kept, but marked deleted.
+func (app *app) deletePost(activityID string, ownerID int64) error {
+	_, err := app.db.Exec("UPDATE posts SET deleted = NOW() WHERE activity_id = ? AND owner_id = ? AND deleted IS NULL", activityID, ownerID)
+	if err != nil {
+		logError("Couldn't mark post deleted: %v", err)
+		return err
+	}
+	_, err = app.db.Exec(`DELETE p, a, o, rp, dp FROM posts p
+		LEFT JOIN savedposts sp
+			ON sp.post_id = p.id
+		LEFT JOIN attachments a
+			ON a.post_id = p.id
+		LEFT JOIN polloptions o
+			ON o.post_id = p.id
+		LEFT JOIN readposts rp
+			ON rp.post_id = p.id
+		LEFT JOIN digestposts dp
+			ON dp.post_id = p.id
+		WHERE activity_id = ? AND owner_id = ? AND sp.post_id IS NULL`, activityID, ownerID)
+	if err != nil {
+		logError("Couldn't delete post: %v", err)
+	}
+	return err
+}
+
+// markPostDeleted records that the post with the given activity ID no longer
+// exists on its server.
+func (app *app) markPostDeleted(activityID string) error {
+	_, err := app.db.Exec("UPDATE posts SET deleted = NOW() WHERE activity_id = ? AND deleted IS NULL", activityID)
+	if err != nil {
+		logError("Couldn't mark post deleted: %v", err)
+	}
+	return err
+}
+
+// deleteRemoteUser removes the follows and posts of a remote user whose
+// account was deleted. Posts that readers saved are kept, but marked deleted.
+func (app *app) deleteRemoteUser(userID int64) error {
+	t, err := app.db.Begin()
+	if err != nil {
+		logError("Unable to start transaction: %v", err)
+		return err
+	}
+
+	stmts := []string{
+		"DELETE FROM follows WHERE follower = ? OR followee = ?",
+		"UPDATE posts SET deleted = NOW() WHERE owner_id = ? AND deleted IS NULL",
+		`DELETE p, a, o, rp, dp FROM posts p
+			LEFT JOIN savedposts sp
+				ON sp.post_id = p.id
+			LEFT JOIN attachments a
+				ON a.post_id = p.id
+			LEFT JOIN polloptions o
+				ON o.post_id = p.id
+			LEFT JOIN readposts rp
+				ON rp.post_id = p.id
+			LEFT JOIN digestposts dp
+				ON dp.post_id = p.id
+			WHERE owner_id = ? AND sp.post_id IS NULL`,
+		"UPDATE users SET deleted = NOW() WHERE id = ? AND password IS NULL",
+	}
+	for _, stmt := range stmts {
+		args := []interface{}{userID}
+		if strings.Count(stmt, "?") == 2 {
+			args = append(args, userID)
+		}
+		_, err = t.Exec(stmt, args...)
+		if err != nil {
+			t.Rollback()
+			logError("Couldn't delete remote user %d: %v", userID, err)
+			return err
+		}
+	}
+
+	err = t.Commit()
+	if err != nil {
+		t.Rollback()
+		logError("Rolling back after Commit(): %v\n", err)
+		return err
+	}
+	return nil
+}
+
+// postCols are the columns selected for each post in queries that use
+// postJoins, in the order scanPost expects.
+const postCols = `p.id, owner_id, activity_id, p.type, published, p.url, IFNULL(p.name, ''), IFNULL(content, ''), IFNULL(p.summary, ''), sensitive, IFNULL(f.host, ''), u.username, u.name, u.url, u.actor_id, rp.post_id IS NOT NULL, sp.post_id IS NOT NULL, p.deleted IS NOT NULL, start_time, end_time, IFNULL(location, ''), multiple`
+
+// postJoins selects from posts along with their owners and whether a given
+// user has read or saved them. It takes that user's ID as its first two
+// parameters.
+const postJoins = `FROM posts p
+		INNER JOIN users u
+			ON owner_id = u.id
+		LEFT JOIN foundusers f
+			USING(actor_id)
+		LEFT JOIN readposts rp
+			ON rp.post_id = p.id AND rp.user_id = ?
+		LEFT JOIN savedposts sp
+			ON sp.post_id = p.id AND sp.user_id = ?`
+
+// postTypeFilter limits posts to the types a user wants in their feed. It
+// takes that user's ID as its parameter.
+const postTypeFilter = `(SELECT IFNULL(FIND_IN_SET(p.type, feed_types), 1) FROM users WHERE id = ?) > 0`
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanPost(row rowScanner, p *Post) error {
+	var start, end mysql.NullTime
+	err := row.Scan(&p.ID, &p.OwnerID, &p.ActivityID, &p.Type, &p.Published, &p.URL, &p.Name, &p.Content, &p.Warning, &p.Sensitive, &p.Owner.Host, &p.Owner.PreferredUsername, &p.Owner.Name, &p.Owner.URL, &p.Owner.BaseObject.ID, &p.IsRead, &p.IsSaved, &p.Deleted, &start, &end, &p.Location, &p.Multiple)
+	p.Start, p.End = start.Time, end.Time
+	return err
+}
+
+func scanPosts(rows *sql.Rows) *[]Post {
+	posts := []Post{}
+	for rows.Next() {
+		p := Post{
+			Owner:    &User{},
+			IsInFeed: true,
+		}
+		err := scanPost(rows, &p)
+		if err != nil {
+			logError("Failed scanning row: %v", err)
+			break
+		}
+
+		posts = append(posts, p)
+	}
+	err := rows.Err()
+	if err != nil {
+		logError("Error after Next() on rows: %v", err)
+	}
+
+	return &posts
+}
+
+func pageLimit(page int) string {
+	if page < 1 {
+		return ""
+	}
+	pagePosts := 10
+	start := page*pagePosts - pagePosts
+	return fmt.Sprintf(" LIMIT %d, %d", start, pagePosts)
+}
+
+func (app *app) getUserFeed(id int64, page int) (*[]Post, error) {
+	limitStr := pageLimit(page)
+	if page == 0 {
+		limitStr = " LIMIT 0, 100"
+	}
+	rows, err := app.db.Query(`SELECT `+postCols+`
+		`+postJoins+`
+		WHERE owner_id 
+			IN (SELECT followee FROM follows WHERE follower = ?)
+			AND `+postTypeFilter+`
+		ORDER BY published DESC `+limitStr, id, id, id, id)
+	if err != nil {
+		logError("Failed selecting from posts: %v", err)
+		return nil, impart.HTTPError{http.StatusInternalServerError, "Couldn't retrieve user feed."}
+	}
+	defer rows.Close()
+
+	return app.loadPostMedia(scanPosts(rows)), nil
+}
+
+// getSavedPosts returns the posts the given user saved, most recently saved
+// first.
+func (app *app) getSavedPosts(id int64, page int) (*[]Post, error) {
+	rows, err := app.db.Query(`SELECT `+postCols+`
+		`+postJoins+`
+		WHERE sp.post_id IS NOT NULL
+		ORDER BY sp.created DESC `+pageLimit(page), id, id)
+	if err != nil {
+		logError("Failed selecting saved posts: %v", err)
+		return nil, impart.HTTPError{http.StatusInternalServerError, "Couldn't retrieve saved posts."}
+	}
+	defer rows.Close()
+
+	return app.loadPostMedia(scanPosts(rows)), nil
+}
+
+// getPost returns the post with the given ID, along with whether the given
+// user has read or saved it.
+func (app *app) getPost(id, userID int64) (*Post, error) {
+	p := Post{
+		Owner:    &User{},
+		IsInFeed: false,
+	}
+	stmt := `SELECT ` + postCols + `
+		` + postJoins + `
+		WHERE p.id = ?`
+	err := scanPost(app.db.QueryRow(stmt, userID, userID, id), &p)
+	switch {
+	case err == sql.ErrNoRows:
+		return nil, impart.HTTPError{http.StatusNotFound, "Post not found"}
+	case err != nil:
+		return nil, err
+	}
+	posts := app.loadPostMedia(&[]Post{p})
+	return &(*posts)[0], nil
+}
+
+// getTimeline returns up to limit posts for the given user, newest first.
+// If ownerID is set, it only includes that user's posts; otherwise it includes
+// posts from everyone the user follows. Non-zero maxID and sinceID only return
+// posts older or newer than those posts, for clients that page by ID.
+func (app *app) getTimeline(userID, ownerID, maxID, sinceID int64, limit int) (*[]Post, error) {
+	args := []interface{}{userID, userID}
+	where := "owner_id IN (SELECT followee FROM follows WHERE follower = ?) AND " + postTypeFilter
+	if ownerID != 0 {
+		where = "owner_id = ?"
+		args = append(args, ownerID)
+	} else {
+		args = append(args, userID, userID)
+	}
+	if maxID != 0 {
+		where += " AND (published, p.id) < (SELECT published, id FROM posts WHERE id = ?)"
+		args = append(args, maxID)
+	}
+	if sinceID != 0 {
+		where += " AND (published, p.id) > (SELECT published, id FROM posts WHERE id = ?)"
+		args = append(args, sinceID)
+	}
+	args = append(args, limit)
+
+	rows, err := app.db.Query(`SELECT `+postCols+`
+		`+postJoins+`
+		WHERE `+where+`
+		ORDER BY published DESC, p.id DESC LIMIT ?`, args...)
+	if err != nil {
+		logError("Failed selecting timeline: %v", err)
+		return nil, impart.HTTPError{http.StatusInternalServerError, "Couldn't retrieve timeline."}
+	}
+	defer rows.Close()
+
+	return app.loadPostMedia(scanPosts(rows)), nil
+}
+
+// getLibraryPosts returns every post in the given user's library: posts by
+// everyone they follow, and any others they've read or saved. They're ordered
+// oldest first.
+func (app *app) getLibraryPosts(userID int64) (*[]Post, error) {
+	rows, err := app.db.Query(`SELECT `+postCols+`
+		`+postJoins+`
+		WHERE owner_id IN (SELECT followee FROM follows WHERE follower = ?)
+			OR rp.post_id IS NOT NULL OR sp.post_id IS NOT NULL
+		ORDER BY published, p.id`, userID, userID, userID)
+	if err != nil {
+		logError("Failed selecting library posts: %v", err)
+		return nil, impart.HTTPError{http.StatusInternalServerError, "Couldn't retrieve posts."}
+	}
+	defer rows.Close()
+
+	return app.loadPostMedia(scanPosts(rows)), nil
+}
+
+// getExportPosts returns up to maxExportPosts posts for the given user to
+// take with them, oldest first. With saved set, it returns their saved posts,
+// in the order they were saved; otherwise posts from everyone they follow.
+// Non-zero ownerID, from and to narrow that down to one author, or posts
+// published within the given time range.
+func (app *app) getExportPosts(userID int64, saved bool, ownerID int64, from, to time.Time) (*[]Post, error) {
+	args := []interface{}{userID, userID}
+	where := "owner_id IN (SELECT followee FROM follows WHERE follower = ?)"
+	order := "published"
+	if saved {
+		where = "sp.post_id IS NOT NULL"
+		order = "sp.created"
+	} else {
+		args = append(args, userID)
+	}
+	if ownerID != 0 {
+		where += " AND owner_id = ?"
+		args = append(args, ownerID)
+	}
+	if !from.IsZero() {
+		where += " AND published >= ?"
+		args = append(args, from)
+	}
+	if !to.IsZero() {
+		where += " AND published < ?"
+		args = append(args, to)
+	}
+	args = append(args, maxExportPosts)
+
+	rows, err := app.db.Query(`SELECT `+postCols+`
+		`+postJoins+`
+		WHERE `+where+`
+		ORDER BY `+order+`, p.id LIMIT ?`, args...)
+	if err != nil {
+		logError("Failed selecting export posts: %v", err)
+		return nil, impart.HTTPError{http.StatusInternalServerError, "Couldn't retrieve posts."}
+	}
+	defer rows.Close()
+
+	return app.loadPostMedia(scanPosts(rows)), nil
+}
+
+// getDigestPosts returns the unread posts in the given user's feed from the
+// last given number of days that haven't been in one of their digests yet.
+func (app *app) getDigestPosts(userID int64, days int) (*[]Post, error) {
+	rows, err := app.db.Query(`SELECT `+postCols+`
+		`+postJoins+`
+		WHERE owner_id IN (SELECT followee FROM follows WHERE follower = ?)
+			AND rp.post_id IS NULL
+			AND published > DATE_SUB(NOW(), INTERVAL ? DAY)
+			AND p.id NOT IN (SELECT post_id FROM digestposts INNER JOIN digests ON digest_id = id WHERE user_id = ?)
+			AND `+postTypeFilter+`
+		ORDER BY published DESC LIMIT ?`, userID, userID, userID, days, userID, userID, maxDigestPosts)
+	if err != nil {
+		logError("Failed selecting digest posts: %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	return app.loadPostMedia(scanPosts(rows)), nil
+}
+
+func (app *app) setPostRead(userID, postID int64, read bool) error {
+	var err error
+	if read {
+		_, err = app.db.Exec("INSERT IGNORE INTO readposts (user_id, post_id, created) VALUES (?, ?, NOW())", userID, postID)
+	} else {
+		_, err = app.db.Exec("DELETE FROM readposts WHERE user_id = ? AND post_id = ?", userID, postID)
+	}
+	if err != nil {
+		logError("Couldn't update read state: %v", err)
+		return impart.HTTPError{http.StatusInternalServerError, "Couldn't update read state."}
+	}
+	return nil
+}
+
+func (app *app) setPostSaved(userID, postID int64, saved bool) error {
+	var err error
+	if saved {
+		_, err = app.db.Exec("INSERT IGNORE INTO savedposts (user_id, post_id, created) VALUES (?, ?, NOW())", userID, postID)
+		if err == nil {
+			go pinPostMedia(app, postID)
+		}
+	} else {
+		_, err = app.db.Exec("DELETE FROM savedposts WHERE user_id = ? AND post_id = ?", userID, postID)
+	}
+	if err != nil {
+		logError("Couldn't update saved state: %v", err)
+		return impart.HTTPError{http.StatusInternalServerError, "Couldn't update saved state."}
+	}
+	return nil
+}
+
+// getKeyOwner returns the actor IRI of the user with the given public key.
+func (app *app) getKeyOwner(keyID string) (string, error) {
+	var actorID string
+	err := app.db.QueryRow("SELECT actor_id FROM userkeys k INNER JOIN users u ON k.user_id = u.id WHERE k.id = ?", keyID).Scan(&actorID)
+	return actorID, err
+}
+
+func (app *app) getActorKey(id string) ([]byte, error) {
+	k := []byte{}
+
+	stmt := "SELECT public_key FROM userkeys WHERE id = ?"
+	err := app.db.QueryRow(stmt, id).Scan(&k)
 	switch {
 	case err == sql.ErrNoRows:
 		return nil, impart.HTTPError{http.StatusNotFound, "Key not found"}
@@ -372,3 +1800,96 @@ func (app *app) getActorKey(id string) ([]byte, error) {
 
 	return k, nil
 }
+
+// getCachedMedia returns the media proxy's record of the image with the given
+// ID, or sql.ErrNoRows if it isn't cached.
+func (app *app) getCachedMedia(id string) (*cachedMedia, error) {
+	m := &cachedMedia{ID: id}
+	err := app.db.QueryRow("SELECT url, media_type, size, fetched FROM cachedmedia WHERE id = ?", id).Scan(&m.URL, &m.MediaType, &m.Size, &m.Fetched)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			logError("Couldn't get cached media: %v", err)
+		}
+		return nil, err
+	}
+	return m, nil
+}
+
+func (app *app) addCachedMedia(m *cachedMedia) error {
+	_, err := app.db.Exec("INSERT INTO cachedmedia (id, url, media_type, size, fetched, last_used) VALUES (?, ?, ?, ?, NOW(), NOW()) ON DUPLICATE KEY UPDATE media_type = ?, size = ?, fetched = NOW(), last_used = NOW()",
+		m.ID, m.URL, m.MediaType, m.Size, m.MediaType, m.Size)
+	if err != nil {
+		logError("Couldn't add cached media: %v", err)
+	}
+	return err
+}
+
+// touchCachedMedia records that a cached image was just used, at most once
+// every mediaTouchInterval.
+func (app *app) touchCachedMedia(id string) {
+	_, err := app.db.Exec("UPDATE cachedmedia SET last_used = NOW() WHERE id = ? AND last_used < NOW() - INTERVAL ? SECOND", id, int(mediaTouchInterval.Seconds()))
+	if err != nil {
+		logError("Couldn't touch cached media: %v", err)
+	}
+}
+
+// getMediaCacheSize returns the total size in bytes of every cached image.
+func (app *app) getMediaCacheSize() (int64, error) {
+	var size int64
+	err := app.db.QueryRow("SELECT IFNULL(SUM(size), 0) FROM cachedmedia").Scan(&size)
+	if err != nil {
+		logError("Couldn't get media cache size: %v", err)
+	}
+	return size, err
+}
+
+// getEvictableMedia returns up to limit of the least recently used cached
+// images that aren't in anyone's saved posts.
+func (app *app) getEvictableMedia(limit int) ([]cachedMedia, error) {
+	rows, err := app.db.Query(`SELECT id, size FROM cachedmedia c
+		WHERE NOT EXISTS (SELECT 1 FROM pinnedmedia pm INNER JOIN savedposts sp ON pm.post_id = sp.post_id WHERE pm.media_id = c.id)
+		ORDER BY last_used LIMIT ?`, limit)
+	if err != nil {
+		logError("Failed selecting evictable media: %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	media := []cachedMedia{}
+	for rows.Next() {
+		m := cachedMedia{}
+		err = rows.Scan(&m.ID, &m.Size)
+		if err != nil {
+			logError("Failed scanning row in getEvictableMedia: %v", err)
+			break
+		}
+		media = append(media, m)
+	}
+	err = rows.Err()
+	if err != nil {
+		logError("Error after Next() on rows in getEvictableMedia: %v", err)
+	}
+	return media, nil
+}
+
+func (app *app) deleteCachedMedia(id string) error {
+	_, err := app.db.Exec("DELETE FROM cachedmedia WHERE id = ?", id)
+	if err != nil {
+		logError("Couldn't delete cached media: %v", err)
+		return err
+	}
+	_, err = app.db.Exec("DELETE FROM pinnedmedia WHERE media_id = ?", id)
+	if err != nil {
+		logError("Couldn't unpin deleted media: %v", err)
+	}
+	return err
+}
+
+// pinMedia keeps a cached image from being evicted while the given post is
+// saved.
+func (app *app) pinMedia(postID int64, mediaID string) {
+	_, err := app.db.Exec("INSERT IGNORE INTO pinnedmedia (post_id, media_id) VALUES (?, ?)", postID, mediaID)
+	if err != nil {
+		logError("Couldn't pin media: %v", err)
+	}
+}
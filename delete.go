@@ -0,0 +1,211 @@
+package readas
+
+import (
+	"github.com/writeas/impart"
+	"github.com/writeas/web-core/activitystreams"
+	"github.com/writeas/web-core/auth"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	// postCheckInterval is how long to wait before checking whether the same
+	// post was deleted again.
+	postCheckInterval = time.Hour
+	maxPostChecks     = 4
+)
+
+// postChecks records when each post was last checked for deletion, so that
+// viewing it over and over doesn't keep fetching it from its server.
+var postChecks = struct {
+	sync.Mutex
+	checked map[string]time.Time
+	running int
+}{checked: map[string]time.Time{}}
+
+// tombstone is what a deleted user's actor IRI returns.
+type tombstone struct {
+	activitystreams.BaseObject
+	FormerType string    `json:"formerType"`
+	Deleted    time.Time `json:"deleted"`
+}
+
+// handleDeleteAccount deletes the logged-in user's account, after checking
+// their password, and tells every server that knows about them.
+func handleDeleteAccount(app *app, w http.ResponseWriter, r *http.Request) error {
+	cu := getUserSession(app, r)
+	if cu == nil || getTokenAuth(r) != nil {
+		return impart.HTTPError{http.StatusUnauthorized, "Not logged in."}
+	}
+	u, err := app.getLocalUser(cu.PreferredUsername)
+	if err != nil {
+		return err
+	}
+
+	if r.FormValue("username") != u.PreferredUsername {
+		return impart.HTTPError{http.StatusBadRequest, "Enter your username to confirm."}
+	}
+	if !auth.Authenticated(u.HashedPass, []byte(r.FormValue("password"))) {
+		return impart.HTTPError{http.StatusBadRequest, "Incorrect password."}
+	}
+
+	// Find everyone to tell before the follows that lead to them are gone
+	inboxes, err := app.getKnownInboxes(u.ID)
+	if err != nil {
+		return impart.HTTPError{http.StatusInternalServerError, "Couldn't delete account."}
+	}
+	err = app.deleteUser(u.ID)
+	if err != nil {
+		return impart.HTTPError{http.StatusInternalServerError, "Couldn't delete account."}
+	}
+	logInfo("Deleted user %s", u.PreferredUsername)
+	if u.Avatar != "" {
+		err = os.Remove(filepath.Join(app.cfg.MediaDir, "avatars", u.Avatar))
+		if err != nil {
+			logError("Couldn't remove avatar of deleted user: %v", err)
+		}
+	}
+	// The keys are gone from the database, but the Delete is signed with the
+	// copy we still have here.
+	go sendAccountDelete(app, u, inboxes)
+
+	session, err := app.sStore.Get(r, "u")
+	if err == nil {
+		session.Options.MaxAge = -1
+		err = session.Save(r, w)
+		if err != nil {
+			logError("Couldn't clear cookie of deleted user: %v", err)
+		}
+	}
+	return impart.HTTPError{http.StatusFound, "/"}
+}
+
+// sendAccountDelete sends a Delete{Person} for the given user to the given
+// inboxes.
+func sendAccountDelete(app *app, u *LocalUser, inboxes []string) {
+	p := u.AsPerson(app).Person
+	actor := u.AccountRoot(app)
+	del := &objectActivity{
+		BaseObject: activitystreams.BaseObject{
+			Context: []interface{}{
+				activitystreams.Namespace,
+			},
+			Type: "Delete",
+			ID:   actor + "#delete",
+		},
+		Actor:     actor,
+		Published: time.Now().UTC(),
+		To:        []string{activitystreams.PublicNS},
+		Object:    actor,
+	}
+	for _, inbox := range inboxes {
+		err := makeActivityPost(p, inbox, del)
+		if err != nil {
+			logError("Unable to deliver Delete to %s: %v", inbox, err)
+		}
+	}
+}
+
+// renderDeletedUser responds with a Tombstone if the given username belonged
+// to a user who deleted their account, and otherwise returns err.
+func renderDeletedUser(app *app, w http.ResponseWriter, username string, err error) error {
+	deleted, dErr := app.getDeletedUser(username)
+	if dErr != nil {
+		return err
+	}
+	t := &tombstone{
+		BaseObject: activitystreams.BaseObject{
+			Context: []interface{}{
+				activitystreams.Namespace,
+			},
+			Type: "Tombstone",
+			ID:   (&LocalUser{PreferredUsername: username}).AccountRoot(app),
+		},
+		FormerType: "Person",
+		Deleted:    deleted.UTC(),
+	}
+	return impart.RenderActivityJSON(w, t, http.StatusGone)
+}
+
+// objectID returns the ID of an activity's object, whether it's given as an
+// IRI or embedded, like a Tombstone.
+func objectID(m map[string]interface{}) string {
+	switch o := m["object"].(type) {
+	case string:
+		return o
+	case map[string]interface{}:
+		id, _ := o["id"].(string)
+		return id
+	}
+	return ""
+}
+
+// handleDeleteActivity removes a remote post, or a remote user and their
+// posts when the object is the actor itself. Only the actor's own posts can
+// be deleted, and only by them.
+func handleDeleteActivity(app *app, r *http.Request, m map[string]interface{}) error {
+	actor, _ := m["actor"].(string)
+	object := objectID(m)
+	if actor == "" || object == "" {
+		return impart.HTTPError{http.StatusBadRequest, "Invalid Delete."}
+	}
+	if owner, err := app.getKeyOwner(signatureKeyID(r)); err != nil || owner != actor {
+		return impart.HTTPError{http.StatusForbidden, "Delete must be signed by the actor."}
+	}
+
+	remoteUser, err := app.getActor(actor)
+	if err != nil {
+		// We don't know them, so there's nothing of theirs to delete
+		return nil
+	}
+	if object == actor {
+		logInfo("Deleting remote user %s", actor)
+		return app.deleteRemoteUser(remoteUser.ID)
+	}
+	return app.deletePost(object, remoteUser.ID)
+}
+
+// startPostCheck returns whether the given post should be checked for
+// deletion now. It's checked at most once per postCheckInterval, with no more
+// than maxPostChecks checks running at once.
+func startPostCheck(activityID string) bool {
+	postChecks.Lock()
+	defer postChecks.Unlock()
+	if postChecks.running >= maxPostChecks {
+		return false
+	}
+	now := time.Now()
+	if t, ok := postChecks.checked[activityID]; ok && now.Sub(t) < postCheckInterval {
+		return false
+	}
+	for id, t := range postChecks.checked {
+		if now.Sub(t) >= postCheckInterval {
+			delete(postChecks.checked, id)
+		}
+	}
+	postChecks.checked[activityID] = now
+	postChecks.running++
+	return true
+}
+
+// checkPostDeleted fetches the given post from its server, and marks it
+// deleted if it's gone.
+func checkPostDeleted(app *app, activityID string) {
+	if !startPostCheck(activityID) {
+		return
+	}
+	defer func() {
+		postChecks.Lock()
+		postChecks.running--
+		postChecks.Unlock()
+	}()
+
+	_, err := resolveIRI(activityID)
+	if err == errGone {
+		logInfo("Post %s was deleted", activityID)
+		app.markPostDeleted(activityID)
+	}
+}
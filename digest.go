@@ -0,0 +1,351 @@
+package readas
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/writeas/impart"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	digestDaily  = "daily"
+	digestWeekly = "weekly"
+
+	maxDigestPosts      = 30
+	digestCheckInterval = time.Hour
+
+	// maxDigestAttempts is how many times we try to send a digest before
+	// giving up on it until the next one is due.
+	maxDigestAttempts = 5
+)
+
+// Digest is a record of an email digest sent to a user.
+type Digest struct {
+	Frequency string
+	Recipient string
+	Subject   string
+	Posts     int
+	Sent      time.Time
+}
+
+// digestEmail is what the digest email templates are rendered with.
+type digestEmail struct {
+	InstanceName   string
+	Host           string
+	User           *LocalUser
+	Posts          []Post
+	Frequency      string
+	UnsubscribeURL string
+}
+
+func digestDays(frequency string) int {
+	if frequency == digestDaily {
+		return 1
+	}
+	return 7
+}
+
+// unsubscribeToken returns the token that lets the given user turn off their
+// digest from an email, without logging in.
+func unsubscribeToken(app *app, username string) string {
+	mac := hmac.New(sha256.New, app.keys.cookieAuthKey)
+	mac.Write([]byte("unsubscribe:" + username))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func unsubscribeURL(app *app, u *LocalUser) string {
+	return app.cfg.Host + "/digest/unsubscribe?" + url.Values{
+		"u": {u.PreferredUsername},
+		"t": {unsubscribeToken(app, u.PreferredUsername)},
+	}.Encode()
+}
+
+// writePart adds a quoted-printable part with the given content type to a
+// multipart message.
+func writePart(mw *multipart.Writer, contentType string, body []byte) error {
+	h := textproto.MIMEHeader{}
+	h.Set("Content-Type", contentType+"; charset=utf-8")
+	h.Set("Content-Transfer-Encoding", "quoted-printable")
+	pw, err := mw.CreatePart(h)
+	if err != nil {
+		return err
+	}
+	qw := quotedprintable.NewWriter(pw)
+	_, err = qw.Write(body)
+	if err != nil {
+		return err
+	}
+	return qw.Close()
+}
+
+// composeDigest renders a digest of the given posts as a multipart email with
+// both HTML and plain text versions.
+func composeDigest(app *app, u *LocalUser, from, subject string, posts []Post) ([]byte, error) {
+	e := digestEmail{
+		InstanceName:   app.cfg.Name,
+		Host:           app.cfg.Host,
+		User:           u,
+		Posts:          posts,
+		Frequency:      u.Digest,
+		UnsubscribeURL: unsubscribeURL(app, u),
+	}
+	var htmlBody, textBody bytes.Buffer
+	err := digestHTMLTemplate.Execute(&htmlBody, e)
+	if err != nil {
+		return nil, err
+	}
+	err = digestTextTemplate.Execute(&textBody, e)
+	if err != nil {
+		return nil, err
+	}
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	err = writePart(mw, "text/plain", textBody.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	err = writePart(mw, "text/html", htmlBody.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	err = mw.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := generateToken()
+	if err != nil {
+		return nil, err
+	}
+	host := app.cfg.Host[strings.LastIndexByte(app.cfg.Host, '/')+1:]
+	var msg bytes.Buffer
+	headers := [][2]string{
+		{"From", from},
+		{"To", u.Email},
+		{"Subject", mime.QEncoding.Encode("utf-8", subject)},
+		{"Date", time.Now().Format(time.RFC1123Z)},
+		{"Message-ID", "<" + id[:32] + "@" + host + ">"},
+		{"MIME-Version", "1.0"},
+		{"Content-Type", "multipart/alternative; boundary=" + mw.Boundary()},
+		{"List-Unsubscribe", "<" + e.UnsubscribeURL + ">"},
+		{"List-Unsubscribe-Post", "List-Unsubscribe=One-Click"},
+	}
+	for _, h := range headers {
+		msg.WriteString(h[0] + ": " + h[1] + "\r\n")
+	}
+	msg.WriteString("\r\n")
+	msg.Write(body.Bytes())
+	return msg.Bytes(), nil
+}
+
+// sendEmail delivers a message through the configured SMTP server.
+func sendEmail(app *app, to string, msg []byte) error {
+	from, err := mail.ParseAddress(app.cfg.EmailFrom)
+	if err != nil {
+		return fmt.Errorf("invalid email_from: %v", err)
+	}
+	var auth smtp.Auth
+	if app.cfg.SMTPUser != "" {
+		auth = smtp.PlainAuth("", app.cfg.SMTPUser, app.cfg.SMTPPassword, app.cfg.SMTPHost)
+	}
+	port := app.cfg.SMTPPort
+	if port == 0 {
+		port = 25
+	}
+	return smtp.SendMail(fmt.Sprintf("%s:%d", app.cfg.SMTPHost, port), auth, from.Address, []string{to}, msg)
+}
+
+// sendDigest emails the user their unread posts since their last digest,
+// returning how many were sent.
+func sendDigest(app *app, u *LocalUser) (int, error) {
+	frequency := u.Digest
+	if frequency == "" {
+		frequency = digestWeekly
+	}
+	posts, err := app.getDigestPosts(u.ID, digestDays(frequency))
+	if err != nil {
+		return 0, err
+	}
+	if len(*posts) == 0 {
+		return 0, app.setDigestSent(u.ID)
+	}
+
+	subject := fmt.Sprintf("%d new posts to read on %s", len(*posts), app.cfg.Name)
+	if len(*posts) == 1 {
+		subject = "1 new post to read on " + app.cfg.Name
+	}
+	msg, err := composeDigest(app, u, app.cfg.EmailFrom, subject, *posts)
+	if err != nil {
+		return 0, err
+	}
+	err = sendEmail(app, u.Email, msg)
+	if err != nil {
+		return 0, err
+	}
+	logInfo("Sent %s digest of %d posts to %s", frequency, len(*posts), u.PreferredUsername)
+
+	return len(*posts), app.recordDigest(u.ID, frequency, u.Email, subject, *posts)
+}
+
+// digestFailure is how many times in a row a user's digest failed to send,
+// and when to try it again.
+type digestFailure struct {
+	attempts int
+	retry    time.Time
+}
+
+// sendDigests sends everyone's digests as they come due, for as long as the
+// server runs. Digests that fail are retried less and less often, and skipped
+// after maxDigestAttempts.
+func sendDigests(app *app) {
+	if app.cfg.SMTPHost == "" {
+		return
+	}
+	failures := map[string]*digestFailure{}
+	for {
+		usernames, err := app.getDueDigestUsers()
+		if err == nil {
+			for _, username := range usernames {
+				f := failures[username]
+				if f != nil && time.Now().Before(f.retry) {
+					continue
+				}
+				u, err := app.getLocalUser(username)
+				if err != nil {
+					continue
+				}
+				_, err = sendDigest(app, u)
+				if err == nil {
+					delete(failures, username)
+					continue
+				}
+				logError("Couldn't send digest to %s: %v", username, err)
+				if f == nil {
+					f = &digestFailure{}
+					failures[username] = f
+				}
+				f.attempts++
+				if f.attempts >= maxDigestAttempts {
+					logError("Giving up on digest to %s until the next one is due", username)
+					delete(failures, username)
+					app.setDigestSent(u.ID)
+					continue
+				}
+				f.retry = time.Now().Add(digestCheckInterval << uint(f.attempts))
+			}
+		}
+		time.Sleep(digestCheckInterval)
+	}
+}
+
+// handleUpdateDigest saves the user's email address and digest schedule, and
+// sends a digest right away if they asked for one.
+func handleUpdateDigest(app *app, w http.ResponseWriter, r *http.Request) error {
+	cu := getUserSession(app, r)
+	if cu == nil || getTokenAuth(r) != nil {
+		return impart.HTTPError{http.StatusUnauthorized, "Not logged in."}
+	}
+	if app.cfg.SMTPHost == "" {
+		return impart.HTTPError{http.StatusBadRequest, "Email isn't set up on this instance."}
+	}
+	u, err := app.getLocalUser(cu.PreferredUsername)
+	if err != nil {
+		return err
+	}
+
+	email := strings.TrimSpace(r.FormValue("email"))
+	if email != "" {
+		addr, err := mail.ParseAddress(email)
+		if err != nil || addr.Address != email || len(email) > 255 {
+			return impart.HTTPError{http.StatusBadRequest, "Enter a valid email address."}
+		}
+	}
+	digest := r.FormValue("digest")
+	if digest != "" && digest != digestDaily && digest != digestWeekly {
+		return impart.HTTPError{http.StatusBadRequest, "Digests can be sent daily or weekly."}
+	}
+	if digest != "" && email == "" {
+		return impart.HTTPError{http.StatusBadRequest, "Enter an email address to send digests to."}
+	}
+	err = app.updateDigestSettings(u.ID, email, digest)
+	if err != nil {
+		return impart.HTTPError{http.StatusInternalServerError, "Couldn't save digest settings."}
+	}
+
+	if r.FormValue("send_now") == "" {
+		addSessionFlash(app, w, r, "Digest settings saved.")
+		return impart.HTTPError{http.StatusFound, "/settings"}
+	}
+	if email == "" {
+		return impart.HTTPError{http.StatusBadRequest, "Enter an email address to send a digest to."}
+	}
+	u.Email, u.Digest = email, digest
+	n, err := sendDigest(app, u)
+	if err != nil {
+		logError("Couldn't send digest: %v", err)
+		return impart.HTTPError{http.StatusInternalServerError, "Couldn't send digest. Please try again later."}
+	}
+	if n == 0 {
+		addSessionFlash(app, w, r, "Nothing new to send. You've read everything.")
+	} else {
+		addSessionFlash(app, w, r, fmt.Sprintf("Sent a digest of %d posts to %s.", n, email))
+	}
+	return impart.HTTPError{http.StatusFound, "/settings"}
+}
+
+// getUnsubscribeUser returns the user an unsubscribe link is for.
+func getUnsubscribeUser(app *app, r *http.Request) (*LocalUser, error) {
+	username := r.FormValue("u")
+	if !hmac.Equal([]byte(r.FormValue("t")), []byte(unsubscribeToken(app, username))) {
+		return nil, impart.HTTPError{http.StatusNotFound, "This unsubscribe link isn't valid."}
+	}
+	return app.getLocalUser(username)
+}
+
+// handleUnsubscribe turns off a user's digest from the link in a digest
+// email. GET requests only ask for confirmation, so link scanners don't
+// unsubscribe people; email clients' one-click unsubscribe POSTs.
+func handleUnsubscribe(app *app, w http.ResponseWriter, r *http.Request) error {
+	u, err := getUnsubscribeUser(app, r)
+	if err != nil {
+		return err
+	}
+
+	done := false
+	if r.Method == "POST" {
+		err = app.updateDigestSettings(u.ID, u.Email, "")
+		if err != nil {
+			return impart.HTTPError{http.StatusInternalServerError, "Couldn't unsubscribe. Please try again."}
+		}
+		done = true
+	}
+
+	p := struct {
+		User         *LocalUser
+		Version      string
+		InstanceName string
+		CSRFToken    string
+		Action       string
+		Done         bool
+	}{
+		Version:      softwareVersion,
+		InstanceName: app.cfg.Name,
+		CSRFToken:    csrfToken(app, r),
+		Action:       r.URL.RequestURI(),
+		Done:         done,
+	}
+	return renderTemplate(w, "unsubscribe", p)
+}
@@ -0,0 +1,453 @@
+package readas
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"github.com/writeas/impart"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Posts can be exported as an EPUB 3 book, for reading on e-readers. Books
+// are written out as they're put together, one chapter and image at a time,
+// so they're never held in memory whole.
+
+const (
+	maxExportPosts   = 500
+	maxEPUBImages    = 500
+	maxEPUBImageSize = 5 << 20
+	// maxEPUBImagesSize is how much of a book can be images. Images past it
+	// are left out.
+	maxEPUBImagesSize = 100 << 20
+
+	exportDateFormat = "2006-01-02"
+)
+
+// epubImageTypes are the image formats e-readers are required to support, and
+// the extensions they're saved with.
+var epubImageTypes = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+	"image/gif":  ".gif",
+	"image/webp": ".webp",
+}
+
+// epubDroppedElements can't be shown on an e-reader, so they're left out of
+// chapters.
+var epubDroppedElements = map[atom.Atom]bool{
+	atom.Iframe: true,
+	atom.Video:  true,
+	atom.Audio:  true,
+	atom.Object: true,
+	atom.Embed:  true,
+	atom.Script: true,
+	atom.Style:  true,
+	atom.Form:   true,
+}
+
+// exportSelection is the posts someone wants in an export.
+type exportSelection struct {
+	Saved  bool
+	Author *User
+	From   time.Time
+	// To is the end of the range, exclusive.
+	To time.Time
+}
+
+// parseExportDates reads an inclusive range of dates, either of which may be
+// empty.
+func (s *exportSelection) parseExportDates(from, to string) error {
+	var err error
+	if from != "" {
+		s.From, err = time.Parse(exportDateFormat, from)
+		if err != nil {
+			return err
+		}
+	}
+	if to != "" {
+		s.To, err = time.Parse(exportDateFormat, to)
+		if err != nil {
+			return err
+		}
+		s.To = s.To.AddDate(0, 0, 1)
+	}
+	return nil
+}
+
+func (s *exportSelection) title() string {
+	t := "Posts"
+	if s.Saved {
+		t = "Saved posts"
+	}
+	if s.Author != nil {
+		t += " by " + s.Author.Name
+	}
+	const d = "January 2, 2006"
+	if !s.From.IsZero() && !s.To.IsZero() {
+		t += fmt.Sprintf(", %s to %s", s.From.Format(d), s.To.AddDate(0, 0, -1).Format(d))
+	} else if !s.From.IsZero() {
+		t += ", since " + s.From.Format(d)
+	} else if !s.To.IsZero() {
+		t += ", until " + s.To.AddDate(0, 0, -1).Format(d)
+	}
+	return t
+}
+
+type epubChapter struct {
+	Order     int
+	File      string
+	Title     string
+	Author    string
+	URL       string
+	Published time.Time
+	Body      template.HTML
+}
+
+type epubImage struct {
+	File      string
+	MediaType string
+}
+
+// epub is a book being written out from posts.
+type epub struct {
+	ID       string
+	Title    string
+	Creators []string
+	Modified string
+	// Chapters and Images are what's been written so far, for the book's
+	// table of contents and manifest. Chapters don't keep their bodies.
+	Chapters []epubChapter
+	Images   []*epubImage
+
+	z *zip.Writer
+	// images holds each image fetched so far by its original URL, or nil
+	// if it couldn't be, so each is only fetched once.
+	images     map[string]*epubImage
+	creators   map[string]bool
+	imagesSize int
+	// err is set when an image couldn't be written, which leaves the book
+	// unfinishable.
+	err error
+}
+
+// newEPUB starts writing a book to w.
+func newEPUB(title string, w io.Writer) (*epub, error) {
+	id, err := generateToken()
+	if err != nil {
+		return nil, err
+	}
+	b := &epub{
+		// A random (version 4) UUID
+		ID:       fmt.Sprintf("%s-%s-4%s-a%s-%s", id[:8], id[8:12], id[13:16], id[17:20], id[20:32]),
+		Title:    title,
+		Modified: time.Now().UTC().Format("2006-01-02T15:04:05Z"),
+		z:        zip.NewWriter(w),
+		images:   map[string]*epubImage{},
+		creators: map[string]bool{},
+	}
+
+	// The mimetype file must come first, uncompressed
+	f, err := b.z.CreateHeader(&zip.FileHeader{Name: "mimetype", Method: zip.Store})
+	if err != nil {
+		return nil, err
+	}
+	_, err = io.WriteString(f, "application/epub+zip")
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// addPost writes the post to the book as a chapter, along with its images.
+func (b *epub) addPost(p *Post) error {
+	if !b.creators[p.Owner.Name] {
+		b.creators[p.Owner.Name] = true
+		b.Creators = append(b.Creators, p.Owner.Name)
+	}
+
+	body := &html.Node{Type: html.ElementNode, Data: "body", DataAtom: atom.Body}
+	nodes, err := html.ParseFragment(strings.NewReader(string(p.OriginalContent())), body)
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	for _, n := range nodes {
+		b.prepareNode(n)
+		if b.err != nil {
+			return b.err
+		}
+		err = html.Render(&buf, n)
+		if err != nil {
+			return err
+		}
+	}
+
+	title := p.Name
+	if title == "" {
+		title = p.DisplayTitle()
+	}
+	order := len(b.Chapters) + 1
+	c := epubChapter{
+		Order:     order,
+		File:      "post" + strconv.Itoa(order) + ".xhtml",
+		Title:     title,
+		Author:    p.Owner.Name,
+		URL:       p.URL,
+		Published: p.Published,
+		Body:      template.HTML(buf.String()),
+	}
+	f, err := b.z.Create("OEBPS/" + c.File)
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(f, xml.Header)
+	if err != nil {
+		return err
+	}
+	err = epubTemplates.ExecuteTemplate(f, "chapter.xhtml", struct {
+		Book    *epub
+		Chapter *epubChapter
+	}{b, &c})
+	if err != nil {
+		return err
+	}
+	c.Body = ""
+	b.Chapters = append(b.Chapters, c)
+	return nil
+}
+
+// prepareNode makes a post's HTML work inside a book: it drops elements
+// e-readers can't show, and swaps remote images for copies in the book.
+func (b *epub) prepareNode(n *html.Node) {
+	for c := n.FirstChild; c != nil; {
+		next := c.NextSibling
+		if c.Type == html.ElementNode && epubDroppedElements[c.DataAtom] {
+			n.RemoveChild(c)
+		} else {
+			b.prepareNode(c)
+		}
+		c = next
+	}
+	if n.Type != html.ElementNode || n.DataAtom != atom.Img {
+		return
+	}
+
+	attrs := n.Attr[:0]
+	var img *epubImage
+	alt := ""
+	for _, a := range n.Attr {
+		switch a.Key {
+		case "src":
+			img = b.image(a.Val)
+			if img != nil {
+				a.Val = img.File
+			}
+		case "alt":
+			alt = a.Val
+		case "srcset", "sizes", "loading":
+			continue
+		}
+		attrs = append(attrs, a)
+	}
+	n.Attr = attrs
+	if img == nil {
+		// Show the image's description instead of a broken image
+		n.Type = html.TextNode
+		n.Data = alt
+		n.DataAtom = 0
+		n.Attr = nil
+	}
+}
+
+// image returns the book's copy of the image at the given URL, fetching it
+// into the book the first time it's used.
+func (b *epub) image(src string) *epubImage {
+	if img, ok := b.images[src]; ok {
+		return img
+	}
+	if b.err != nil || len(b.Images) >= maxEPUBImages || b.imagesSize >= maxEPUBImagesSize {
+		return nil
+	}
+	data, mediaType, err := fetchEPUBImage(src)
+	if err == nil && b.imagesSize+len(data) > maxEPUBImagesSize {
+		err = fmt.Errorf("book has too many images")
+	}
+	if err != nil {
+		logInfo("Leaving image %s out of EPUB: %v", src, err)
+		b.images[src] = nil
+		return nil
+	}
+
+	img := &epubImage{
+		File:      "images/" + strconv.Itoa(len(b.Images)+1) + epubImageTypes[mediaType],
+		MediaType: mediaType,
+	}
+	// Images are already compressed
+	f, err := b.z.CreateHeader(&zip.FileHeader{Name: "OEBPS/" + img.File, Method: zip.Store})
+	if err == nil {
+		_, err = f.Write(data)
+	}
+	if err != nil {
+		b.err = err
+		return nil
+	}
+	b.imagesSize += len(data)
+	b.Images = append(b.Images, img)
+	b.images[src] = img
+	return img
+}
+
+// fetchEPUBImage downloads an image for a book, through the same client as
+// the media proxy, so it can't reach our own network.
+func fetchEPUBImage(src string) ([]byte, string, error) {
+	u, err := url.Parse(src)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, "", fmt.Errorf("unsupported image URL")
+	}
+	req, err := http.NewRequest("GET", src, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	req.Header.Set("User-Agent", userAgent)
+	proxyFetches <- struct{}{}
+	defer func() { <-proxyFetches }()
+	resp, err := proxyClient.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("status %d", resp.StatusCode)
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxEPUBImageSize+1))
+	if err != nil {
+		return nil, "", err
+	}
+	if len(data) > maxEPUBImageSize {
+		return nil, "", fmt.Errorf("image too large")
+	}
+	mediaType := http.DetectContentType(data)
+	if _, ok := epubImageTypes[mediaType]; !ok {
+		return nil, "", fmt.Errorf("unsupported image type %s", mediaType)
+	}
+	return data, mediaType, nil
+}
+
+// close finishes the book by writing its table of contents and manifest.
+func (b *epub) close() error {
+	files := []struct {
+		name string
+		tmpl string
+		data interface{}
+	}{
+		{"META-INF/container.xml", "container.xml", b},
+		{"OEBPS/package.opf", "package.opf", b},
+		{"OEBPS/nav.xhtml", "nav.xhtml", b},
+		{"OEBPS/toc.ncx", "toc.ncx", b},
+	}
+	for _, file := range files {
+		f, err := b.z.Create(file.name)
+		if err != nil {
+			return err
+		}
+		_, err = io.WriteString(f, xml.Header)
+		if err != nil {
+			return err
+		}
+		err = epubTemplates.ExecuteTemplate(f, file.tmpl, file.data)
+		if err != nil {
+			return err
+		}
+	}
+
+	return b.z.Close()
+}
+
+// exportEPUB writes the selected posts for the given user to w.
+func exportEPUB(app *app, u *LocalUser, sel *exportSelection, w io.Writer) (int, error) {
+	var ownerID int64
+	if sel.Author != nil {
+		ownerID = sel.Author.ID
+	}
+	posts, err := app.getExportPosts(u.ID, sel.Saved, ownerID, sel.From, sel.To)
+	if err != nil {
+		return 0, err
+	}
+	if len(*posts) == 0 {
+		return 0, impart.HTTPError{http.StatusNotFound, "There aren't any posts to export."}
+	}
+
+	b, err := newEPUB(sel.title(), w)
+	if err != nil {
+		return 0, err
+	}
+	for i := range *posts {
+		err = b.addPost(&(*posts)[i])
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(*posts), b.close()
+}
+
+// findFollowedUser returns the user with the given handle, feed URL or ID
+// that the given user follows.
+func findFollowedUser(app *app, userID int64, handle string) (*User, error) {
+	users, err := app.getFollowingUsers(userID)
+	if err != nil {
+		return nil, err
+	}
+	handle = strings.TrimPrefix(handle, "@")
+	for i, u := range *users {
+		if strconv.FormatInt(u.ID, 10) == handle || u.PreferredUsername+"@"+u.Host == handle ||
+			(u.Type == feedUserType && u.PreferredUsername == handle) || u.URL == handle {
+			return &(*users)[i], nil
+		}
+	}
+	return nil, impart.HTTPError{http.StatusNotFound, "You don't follow " + handle + "."}
+}
+
+// handleExportEPUB downloads the selected posts as an EPUB book.
+func handleExportEPUB(app *app, w http.ResponseWriter, r *http.Request) error {
+	cu := getUserSession(app, r)
+	if cu == nil {
+		return impart.HTTPError{http.StatusUnauthorized, "Not logged in."}
+	}
+	u, err := app.getLocalUser(cu.PreferredUsername)
+	if err != nil {
+		return err
+	}
+
+	sel := &exportSelection{Saved: r.FormValue("saved") != ""}
+	err = sel.parseExportDates(r.FormValue("from"), r.FormValue("to"))
+	if err != nil {
+		return impart.HTTPError{http.StatusBadRequest, "Dates should look like 2006-01-02."}
+	}
+	if author := r.FormValue("author"); author != "" {
+		sel.Author, err = findFollowedUser(app, u.ID, author)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Stream the book as it's written
+	w.Header().Set("Content-Type", "application/epub+zip")
+	w.Header().Set("Content-Disposition", `attachment; filename="readas-`+time.Now().Format(exportDateFormat)+`.epub"`)
+	_, err = exportEPUB(app, u, sel, w)
+	if err != nil {
+		logError("Couldn't export EPUB for %s: %v", u.PreferredUsername, err)
+	}
+	return err
+}
@@ -5,7 +5,8 @@ import (
 	"crypto/sha256"
 	"encoding/base64"
 	"encoding/json"
-	"github.com/writeas/activity/streams"
+	"errors"
+	"fmt"
 	"github.com/writeas/go-webfinger"
 	"github.com/writeas/httpsig"
 	"github.com/writeas/impart"
@@ -15,6 +16,13 @@ import (
 	"net/http"
 	"net/http/httputil"
 	"strings"
+	"time"
+)
+
+const (
+	actorMaxAge          = 24 * time.Hour
+	actorRefreshInterval = time.Hour
+	maxActorRefreshes    = 100
 )
 
 var (
@@ -104,6 +112,17 @@ func makeActivityPost(p *activitystreams.Person, url string, m interface{}) erro
 	return nil
 }
 
+// errGone is returned when a fetched object was deleted, either with a 410
+// response or by being replaced with a Tombstone.
+var errGone = errors.New("object was deleted")
+
+func isTombstone(b []byte) bool {
+	var o struct {
+		Type string `json:"type"`
+	}
+	return json.Unmarshal(b, &o) == nil && o.Type == "Tombstone"
+}
+
 func resolveIRI(url string) ([]byte, error) {
 	logInfo("GET %s", url)
 
@@ -132,6 +151,9 @@ func resolveIRI(url string) ([]byte, error) {
 	}
 	logInfo("Status  : %s", resp.Status)
 	logInfo("Response: %s", body)
+	if resp.StatusCode == http.StatusGone || isTombstone(body) {
+		return nil, errGone
+	}
 
 	return body, nil
 }
@@ -207,13 +229,16 @@ func fetchActor(app *app, actorIRI string) (*activitystreams.Person, *User, erro
 				// Fetch remote actor
 				logInfo("Not found; fetching actor %s remotely", actorIRI)
 				actorResp, err := resolveIRI(actorIRI)
+				if err == errGone {
+					return nil, nil, impart.HTTPError{http.StatusGone, "Actor was deleted."}
+				}
 				if err != nil {
 					logError("Unable to get actor! %v", err)
 					return nil, nil, impart.HTTPError{http.StatusInternalServerError, "Couldn't fetch actor."}
 				}
-				if err := json.Unmarshal(actorResp, &actor); err != nil {
-					// FIXME: Hubzilla has an object for the Actor's url: cannot unmarshal object into Go struct field Person.url of type string
-					logError("Unable to unmarshal actor! %v", err)
+				actor, err = parseActor(actorResp)
+				if err != nil {
+					logError("Unable to parse actor! %v", err)
 					return nil, nil, impart.HTTPError{http.StatusInternalServerError, "Couldn't parse actor."}
 				}
 			} else {
@@ -229,60 +254,130 @@ func fetchActor(app *app, actorIRI string) (*activitystreams.Person, *User, erro
 	return actor, remoteUser, nil
 }
 
+// refreshActor fetches the given remote user again and saves any changes to
+// their profile, inboxes or key. Users whose actor is gone are deleted.
+func refreshActor(app *app, u *User) error {
+	b, err := resolveIRI(u.BaseObject.ID)
+	if err == errGone {
+		logInfo("Actor %s was deleted", u.BaseObject.ID)
+		return app.deleteRemoteUser(u.ID)
+	}
+	if err != nil {
+		return err
+	}
+	actor, err := parseActor(b)
+	if err != nil {
+		return err
+	}
+	if actor.ID != u.BaseObject.ID {
+		return fmt.Errorf("fetched actor %s, not %s", actor.ID, u.BaseObject.ID)
+	}
+	return app.updateUser(u.ID, actor)
+}
+
+// refreshActors refetches remote users whose copy is older than
+// actorMaxAge, for as long as the server runs.
+func refreshActors(app *app) {
+	for {
+		users, err := app.getStaleActors(actorMaxAge, maxActorRefreshes)
+		if err == nil {
+			for i := range *users {
+				u := &(*users)[i]
+				err = refreshActor(app, u)
+				if err != nil {
+					logError("Couldn't refresh actor %s: %v", u.BaseObject.ID, err)
+					// Don't try again until it's stale again
+					app.setUserFetched(u.ID)
+				}
+			}
+		}
+		time.Sleep(actorRefreshInterval)
+	}
+}
+
+// isActorType returns whether the given object type is one of the
+// ActivityStreams actor types.
+func isActorType(t interface{}) bool {
+	switch t {
+	case "Person", "Service", "Application", "Group", "Organization":
+		return true
+	}
+	return false
+}
+
+// handleUpdateActor refreshes a remote user when they send an Update of
+// their own actor.
+func handleUpdateActor(app *app, r *http.Request, m map[string]interface{}) error {
+	actor, _ := m["actor"].(string)
+	if actor == "" || objectID(m) != actor {
+		return impart.HTTPError{http.StatusBadRequest, "Invalid Update."}
+	}
+	if owner, err := app.getKeyOwner(signatureKeyID(r)); err != nil || owner != actor {
+		return impart.HTTPError{http.StatusForbidden, "Update must be signed by the actor."}
+	}
+
+	remoteUser, err := app.getActor(actor)
+	if err != nil {
+		// We don't know them, so there's nothing to update
+		return nil
+	}
+	go func() {
+		err := refreshActor(app, remoteUser)
+		if err != nil {
+			logError("Couldn't refresh actor %s: %v", actor, err)
+		}
+	}()
+	return nil
+}
+
 // TODO: rename this to something better; it doesn't just fetch, but also adds posts
-func fetchActorOutbox(app *app, outbox string) error {
+func fetchActorOutbox(app *app, owner, outbox string) error {
 	logInfo("Fetching actor outbox: " + outbox)
 	outRes, err := resolveIRI(outbox)
 	if err != nil {
 		logError("Unable to get outbox! %v", err)
 		return impart.HTTPError{http.StatusInternalServerError, "Couldn't fetch outbox."}
 	}
-	coll := &activitystreams.OrderedCollection{}
+	var coll map[string]interface{}
 	if err := json.Unmarshal(outRes, &coll); err != nil {
 		logError("Unable to unmarshal outbox! %v", err)
 		return impart.HTTPError{http.StatusInternalServerError, "Couldn't parse outbox."}
 	}
-	if coll.First == "" {
-		// Not the OrderedCollection we were expecting, so quit now and don't fetch any posts
-		// TODO: parse the OrderedCollection `items` property and import those posts
-		return nil
-	}
-
-	logInfo("Fetching actor outbox page: " + coll.First)
-	outPageRes, err := resolveIRI(coll.First)
-	if err != nil {
-		logError("Unable to get outbox page! %v", err)
-		return impart.HTTPError{http.StatusInternalServerError, "Couldn't fetch outbox page."}
-	}
+	// The first page can be embedded in the collection, or linked from it
+	collPageMap, ok := coll["first"].(map[string]interface{})
+	if !ok {
+		first := jsonID(coll["first"])
+		if first == "" {
+			// Not the OrderedCollection we were expecting, so quit now and don't fetch any posts
+			// TODO: parse the OrderedCollection `items` property and import those posts
+			return nil
+		}
 
-	var collPageMap map[string]interface{}
-	if err := json.Unmarshal(outPageRes, &collPageMap); err != nil {
-		return err
+		logInfo("Fetching actor outbox page: " + first)
+		outPageRes, err := resolveIRI(first)
+		if err != nil {
+			logError("Unable to get outbox page! %v", err)
+			return impart.HTTPError{http.StatusInternalServerError, "Couldn't fetch outbox page."}
+		}
+		if err := json.Unmarshal(outPageRes, &collPageMap); err != nil {
+			return err
+		}
 	}
-	res := &streams.Resolver{
-		OrderedCollectionPageCallback: func(p *streams.OrderedCollectionPage) error {
-			itemsLen := p.LenOrderedItems()
-			logInfo("Ordered items: %d", itemsLen)
-			if itemsLen > 0 {
-				// Add posts in reverse order they're listed, since they're in reverse-chronological order
-				for i := itemsLen - 1; i >= 0; i-- {
-					_, err = p.ResolveOrderedItems(&streams.Resolver{
-						CreateCallback: func(f *streams.Create) error {
-							// Create post in database
-							return handleCreateCallback(app, f)
-						},
-					}, i)
-					if err != nil {
-						logError("Unable to resolve item: %v", err)
-					}
-				}
-			}
-			return nil
-		},
+	items, ok := collPageMap["orderedItems"].([]interface{})
+	if !ok {
+		items, _ = collPageMap["items"].([]interface{})
 	}
-	if err := res.Deserialize(collPageMap); err != nil {
-		logError("Unable to resolve OrderedCollectionPage: %v", err)
-		return err
+	logInfo("Ordered items: %d", len(items))
+	// Add posts in reverse order they're listed, since they're in reverse-chronological order
+	for i := len(items) - 1; i >= 0; i-- {
+		item, ok := items[i].(map[string]interface{})
+		if !ok || item["type"] != "Create" {
+			continue
+		}
+		err = saveActivityObject(app, owner, item)
+		if err != nil {
+			logError("Unable to save item: %v", err)
+		}
 	}
 
 	return nil
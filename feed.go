@@ -0,0 +1,308 @@
+package readas
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/go-sql-driver/mysql"
+	"github.com/mmcdole/gofeed"
+	"github.com/writeas/impart"
+	"golang.org/x/net/html"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	// feedUserType is the user type of the synthetic users that own the posts
+	// from RSS, Atom and JSON feeds.
+	feedUserType = "Feed"
+
+	feedPollInterval = 30 * time.Minute
+	feedFetchTimeout = 30 * time.Second
+	maxFeedSize      = 10 << 20
+)
+
+var feedTypes = []string{"application/rss+xml", "application/atom+xml", "application/feed+json", "application/json"}
+
+var errNoFeed = errors.New("no feed found")
+
+// feedClient fetches feeds people subscribe to, which can be at any address,
+// so it only connects to public ones.
+var feedClient = &http.Client{
+	Timeout:   feedFetchTimeout,
+	Transport: publicTransport,
+}
+
+// Feed is an RSS, Atom or JSON feed someone subscribed to, for following
+// writers who aren't on the fediverse.
+type Feed struct {
+	UserID      int64
+	URL         string
+	Title       string
+	Description string
+	SiteURL     string
+
+	etag         string
+	lastModified string
+}
+
+// username is the name of the feed's user, which is the site's domain.
+func (f *Feed) username() string {
+	u, err := url.Parse(f.SiteURL)
+	if err != nil || u.Host == "" {
+		u, _ = url.Parse(f.URL)
+	}
+	return truncate(strings.TrimPrefix(u.Host, "www."), 60)
+}
+
+// truncate shortens s to at most n characters, to fit a database column.
+func truncate(s string, n int) string {
+	r := []rune(s)
+	if len(r) <= n {
+		return s
+	}
+	return string(r[:n])
+}
+
+// isFeedURL returns whether someone entered a web address to follow, rather
+// than a fediverse handle.
+func isFeedURL(s string) bool {
+	return strings.HasPrefix(s, "http://") || strings.HasPrefix(s, "https://")
+}
+
+func feedRequest(u string) (*http.Request, error) {
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", userAgent)
+	return req, nil
+}
+
+// discoverFeed returns the URL of the feed for the given page. If the page
+// itself isn't HTML, it's assumed to be the feed.
+func discoverFeed(pageURL string) (string, error) {
+	req, err := feedRequest(pageURL)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Accept", "text/html, "+strings.Join(feedTypes, ", ")+";q=0.9, */*;q=0.8")
+	resp, err := feedClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("got status %d", resp.StatusCode)
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if mediaType != "text/html" && mediaType != "application/xhtml+xml" {
+		return resp.Request.URL.String(), nil
+	}
+
+	href := findFeedLink(io.LimitReader(resp.Body, maxFeedSize))
+	if href == "" {
+		return "", errNoFeed
+	}
+	u, err := resp.Request.URL.Parse(href)
+	if err != nil {
+		return "", err
+	}
+	return u.String(), nil
+}
+
+// findFeedLink returns the first <link rel="alternate"> in an HTML page that
+// points to a feed.
+func findFeedLink(r io.Reader) string {
+	z := html.NewTokenizer(r)
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			return ""
+		case html.StartTagToken, html.SelfClosingTagToken:
+			t := z.Token()
+			if t.Data == "body" {
+				return ""
+			}
+			if t.Data != "link" {
+				continue
+			}
+			var rel, typ, href string
+			for _, a := range t.Attr {
+				switch a.Key {
+				case "rel":
+					rel = strings.ToLower(a.Val)
+				case "type":
+					typ = strings.ToLower(a.Val)
+				case "href":
+					href = a.Val
+				}
+			}
+			if href == "" || !strings.Contains(" "+rel+" ", " alternate ") {
+				continue
+			}
+			for _, ft := range feedTypes {
+				if typ == ft {
+					return href
+				}
+			}
+		}
+	}
+}
+
+// fetchFeed fetches and parses the given feed, sending the validators from the
+// last fetch so unchanged feeds aren't downloaded again. It returns nil if the
+// feed hasn't changed.
+func fetchFeed(f *Feed) (*gofeed.Feed, error) {
+	req, err := feedRequest(f.URL)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", strings.Join(feedTypes, ", ")+", application/xml;q=0.9, */*;q=0.8")
+	if f.etag != "" {
+		req.Header.Set("If-None-Match", f.etag)
+	}
+	if f.lastModified != "" {
+		req.Header.Set("If-Modified-Since", f.lastModified)
+	}
+	resp, err := feedClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotModified {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("got status %d", resp.StatusCode)
+	}
+
+	feed, err := gofeed.NewParser().Parse(io.LimitReader(resp.Body, maxFeedSize))
+	if err != nil {
+		return nil, err
+	}
+	f.etag = resp.Header.Get("ETag")
+	f.lastModified = resp.Header.Get("Last-Modified")
+	f.Title = feed.Title
+	f.Description = feed.Description
+	f.SiteURL = feed.Link
+	if f.Title == "" {
+		f.Title = f.username()
+	}
+	f.Title = truncate(f.Title, 100)
+	f.Description = truncate(f.Description, 255)
+	return feed, nil
+}
+
+// feedItemID returns the ID a feed item's post is stored under. Items' GUIDs
+// are only unique within their feed, so they're hashed along with the feed's
+// URL. This also keeps feeds from claiming the IDs of fediverse posts.
+func feedItemID(feedURL, guid string) string {
+	sum := sha256.Sum256([]byte(feedURL + "\n" + guid))
+	return "urn:readas:feed:" + hex.EncodeToString(sum[:])
+}
+
+// saveFeedItems stores the feed's entries as posts owned by the feed's user,
+// updating any we already have.
+func saveFeedItems(app *app, f *Feed, feed *gofeed.Feed) {
+	for _, item := range feed.Items {
+		guid := item.GUID
+		if guid == "" {
+			guid = item.Link
+		}
+		if guid == "" || len(item.Link) > 255 {
+			continue
+		}
+		p := &Post{
+			actorID:    f.URL,
+			ActivityID: feedItemID(f.URL, guid),
+			Type:       "Article",
+			URL:        item.Link,
+			Name:       truncate(item.Title, 255),
+			Content:    item.Content,
+		}
+		if p.Content == "" {
+			p.Content = item.Description
+		}
+		switch {
+		case item.PublishedParsed != nil:
+			p.Published = item.PublishedParsed.UTC()
+		case item.UpdatedParsed != nil:
+			p.Published = item.UpdatedParsed.UTC()
+		default:
+			p.Published = time.Now().UTC()
+		}
+
+		err := app.createPost(p)
+		if err != nil {
+			if mysqlErr, ok := err.(*mysql.MySQLError); ok && mysqlErr.Number == mySQLErrDuplicateKey {
+				err = app.updatePost(p)
+			}
+			if err != nil {
+				logError("Couldn't save feed item %s: %v", p.ActivityID, err)
+			}
+		}
+	}
+}
+
+// subscribeFeed returns the user for the feed at the given URL, or the feed
+// the page links to, saving it and its posts if it's new.
+func subscribeFeed(app *app, pageURL string) (*User, error) {
+	feedURL, err := discoverFeed(pageURL)
+	if err != nil {
+		logInfo("Feed discovery failed for %s: %v", pageURL, err)
+		return nil, impart.HTTPError{http.StatusBadRequest, "Couldn't find a feed at that address."}
+	}
+	if len(feedURL) > 255 {
+		return nil, impart.HTTPError{http.StatusBadRequest, "That feed's address is too long."}
+	}
+
+	u, err := app.getActor(feedURL)
+	if err == nil {
+		return u, nil
+	}
+
+	f := &Feed{URL: feedURL}
+	feed, err := fetchFeed(f)
+	if err != nil || feed == nil {
+		logInfo("Feed fetch failed for %s: %v", feedURL, err)
+		return nil, impart.HTTPError{http.StatusBadRequest, "Couldn't read the feed at that address."}
+	}
+	_, err = app.createFeed(f)
+	if err != nil {
+		return nil, err
+	}
+	saveFeedItems(app, f, feed)
+
+	return app.getActor(feedURL)
+}
+
+// pollFeeds fetches every followed feed periodically, for as long as the
+// server runs.
+func pollFeeds(app *app) {
+	for {
+		feeds, err := app.getFollowedFeeds()
+		if err == nil {
+			for i := range *feeds {
+				f := &(*feeds)[i]
+				feed, err := fetchFeed(f)
+				if err != nil {
+					logError("Couldn't fetch feed %s: %v", f.URL, err)
+					continue
+				}
+				if feed != nil {
+					saveFeedItems(app, f, feed)
+				}
+				app.updateFeed(f)
+			}
+		}
+		time.Sleep(feedPollInterval)
+	}
+}
@@ -4,11 +4,17 @@ import (
 	"github.com/writeas/impart"
 	"log"
 	"net/http"
+	"net/url"
 	"runtime/debug"
 	"strings"
 	"time"
 )
 
+// maxRequestSize is the most any request body can be. Checking a form's CSRF
+// token reads the whole body before the handler runs, so this limit has to
+// be set first. Handlers that take uploads check their own, smaller limits.
+const maxRequestSize = 3 << 20
+
 type handlerFunc func(app *app, w http.ResponseWriter, r *http.Request) error
 
 func (app *app) handler(h handlerFunc) http.HandlerFunc {
@@ -26,6 +32,22 @@ func (app *app) handler(h handlerFunc) http.HandlerFunc {
 				logInfo("\"%s %s\" %d %s \"%s\" \"%s\"", r.Method, r.RequestURI, status, time.Since(start), r.UserAgent(), r.Host)
 			}()
 
+			if strings.HasPrefix(r.Header.Get("Authorization"), "Bearer ") {
+				var err error
+				r, err = authenticateToken(app, r)
+				if err != nil {
+					if err, ok := err.(impart.HTTPError); ok {
+						status = err.Status
+					}
+					return err
+				}
+			}
+			r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
+			if !verifyCSRF(app, r) {
+				status = http.StatusForbidden
+				return impart.HTTPError{http.StatusForbidden, "Invalid form token. Please reload the page and try again."}
+			}
+
 			err := h(app, w, r)
 			if err == nil {
 				status = http.StatusOK
@@ -54,11 +76,14 @@ func handleError(w http.ResponseWriter, r *http.Request, err error) {
 		if err.Status >= 300 && err.Status < 400 {
 			impart.WriteRedirect(w, err)
 			return
+		} else if isMastodonAPI(r) {
+			writeMastodonError(w, err.Status, err.Message)
+			return
 		} else if err.Status == http.StatusUnauthorized {
 			if isAPI {
 				impart.WriteError(w, err)
 			} else {
-				impart.WriteRedirect(w, impart.HTTPError{http.StatusFound, "/login?to=" + r.URL.Path})
+				impart.WriteRedirect(w, impart.HTTPError{http.StatusFound, "/login?to=" + url.QueryEscape(r.URL.RequestURI())})
 			}
 			return
 		}
@@ -67,5 +92,9 @@ func handleError(w http.ResponseWriter, r *http.Request, err error) {
 	}
 	log.Printf("Error: %v", err)
 
+	if isMastodonAPI(r) {
+		writeMastodonError(w, http.StatusInternalServerError, "We encountered an error we couldn't handle.")
+		return
+	}
 	impart.WriteError(w, impart.HTTPError{http.StatusInternalServerError, "We encountered an error we couldn't handle."})
 }
@@ -0,0 +1,252 @@
+package readas
+
+import (
+	"github.com/writeas/impart"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// importInterval is how long to wait between follows during an import, so
+	// we don't flood other servers with webfinger and follow requests.
+	importInterval = 2 * time.Second
+
+	maxImportSize    = 2 << 20
+	maxImportEntries = 2000
+)
+
+const (
+	importPending   = "Pending"
+	importFollowed  = "Followed"
+	importFollowing = "Already following"
+	importFailed    = "Failed"
+)
+
+// importEntry is someone to follow from an imported file, along with what
+// happened when we tried.
+type importEntry struct {
+	// Target is a fediverse handle or a feed URL.
+	Target string
+	Title  string
+	Status string
+	Error  string
+}
+
+// importJob is a list of follows being imported in the background.
+type importJob struct {
+	sync.Mutex
+	Source   string
+	Started  time.Time
+	Entries  []importEntry
+	Done     int
+	Finished bool
+}
+
+// imports holds each user's most recent import, so they can check on its
+// progress.
+var imports = struct {
+	sync.Mutex
+	jobs map[int64]*importJob
+}{jobs: map[int64]*importJob{}}
+
+func getImport(userID int64) *importJob {
+	imports.Lock()
+	defer imports.Unlock()
+	return imports.jobs[userID]
+}
+
+// snapshot returns a copy of the job that's safe to render while the import
+// carries on.
+func (j *importJob) snapshot() *importJob {
+	j.Lock()
+	defer j.Unlock()
+	return &importJob{
+		Source:   j.Source,
+		Started:  j.Started,
+		Entries:  append([]importEntry{}, j.Entries...),
+		Done:     j.Done,
+		Finished: j.Finished,
+	}
+}
+
+func (j *importJob) finish(i int, status string, err error) {
+	j.Lock()
+	defer j.Unlock()
+	j.Entries[i].Status = status
+	if err != nil {
+		j.Entries[i].Error = err.Error()
+		if hErr, ok := err.(impart.HTTPError); ok {
+			j.Entries[i].Error = hErr.Message
+		}
+	}
+	j.Done++
+}
+
+// startImport follows everyone in entries in the background, unless the user
+// already has an import running.
+func startImport(app *app, u *LocalUser, source string, entries []importEntry) error {
+	imports.Lock()
+	defer imports.Unlock()
+	if j, ok := imports.jobs[u.ID]; ok {
+		j.Lock()
+		running := !j.Finished
+		j.Unlock()
+		if running {
+			return impart.HTTPError{http.StatusConflict, "An import is already running. Please wait for it to finish."}
+		}
+	}
+
+	for i := range entries {
+		entries[i].Status = importPending
+	}
+	j := &importJob{
+		Source:  source,
+		Started: time.Now(),
+		Entries: entries,
+	}
+	imports.jobs[u.ID] = j
+	go runImport(app, u, j)
+	return nil
+}
+
+func runImport(app *app, u *LocalUser, j *importJob) {
+	logInfo("Importing %d follows for %s from %s", len(j.Entries), u.PreferredUsername, j.Source)
+	for i, e := range j.Entries {
+		if i > 0 {
+			time.Sleep(importInterval)
+		}
+		status, err := importFollow(app, u, e.Target)
+		if err != nil {
+			logInfo("Import of %s failed: %v", e.Target, err)
+		}
+		j.finish(i, status, err)
+	}
+
+	j.Lock()
+	j.Finished = true
+	j.Unlock()
+	logInfo("Finished import for %s", u.PreferredUsername)
+}
+
+// importFollow follows the given handle or feed, returning the entry's
+// status.
+func importFollow(app *app, u *LocalUser, target string) (string, error) {
+	var remoteUser *User
+	var err error
+	if isFeedURL(target) {
+		// Accounts we never looked up by handle are exported by their actor
+		// IRI, so check for one before taking it for a feed
+		remoteUser, err = app.getActor(target)
+		if err != nil {
+			remoteUser, err = subscribeFeed(app, target)
+		}
+	} else {
+		remoteUser, err = findUser(app, target)
+	}
+	if err != nil {
+		return importFailed, err
+	}
+
+	following, err := app.isFollowing(u.ID, remoteUser.ID)
+	if err != nil {
+		return importFailed, err
+	}
+	if following {
+		return importFollowing, nil
+	}
+	err = followUser(app, u, remoteUser)
+	if err != nil {
+		return importFailed, err
+	}
+	return importFollowed, nil
+}
+
+func handleViewImport(app *app, w http.ResponseWriter, r *http.Request) error {
+	cu := getUserSession(app, r)
+	if cu == nil {
+		return impart.HTTPError{http.StatusUnauthorized, "Not logged in."}
+	}
+	u, err := app.getLocalUser(cu.PreferredUsername)
+	if err != nil {
+		return err
+	}
+
+	p := struct {
+		User         *LocalUser
+		Version      string
+		InstanceName string
+		CSRFToken    string
+		Flashes      []string
+		Import       *importJob
+		Following    *[]User
+	}{
+		User:         u,
+		Version:      softwareVersion,
+		InstanceName: app.cfg.Name,
+		CSRFToken:    csrfToken(app, r),
+		Flashes:      getSessionFlashes(app, w, r),
+	}
+	if j := getImport(u.ID); j != nil {
+		p.Import = j.snapshot()
+	}
+	p.Following, err = app.getFollowingUsers(u.ID)
+	if err != nil {
+		return err
+	}
+
+	return renderTemplate(w, "import", p)
+}
+
+// handleImport starts following everyone in an uploaded OPML file or
+// Mastodon following list.
+func handleImport(app *app, w http.ResponseWriter, r *http.Request) error {
+	cu := getUserSession(app, r)
+	if cu == nil || getTokenAuth(r) != nil {
+		return impart.HTTPError{http.StatusUnauthorized, "Not logged in."}
+	}
+	u, err := app.getLocalUser(cu.PreferredUsername)
+	if err != nil {
+		return err
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxImportSize)
+	f, fh, err := r.FormFile("file")
+	if err != nil {
+		return impart.HTTPError{http.StatusBadRequest, "Choose a file to import, up to 2 MB."}
+	}
+	defer f.Close()
+	// The form may have been read before the limit above, to check its CSRF
+	// token
+	if fh.Size > maxImportSize {
+		return impart.HTTPError{http.StatusBadRequest, "Choose a file to import, up to 2 MB."}
+	}
+
+	var entries []importEntry
+	switch strings.ToLower(filepath.Ext(fh.Filename)) {
+	case ".opml", ".xml":
+		entries, err = parseOPML(f)
+	case ".csv", ".txt":
+		entries, err = parseFollowingCSV(f)
+	default:
+		return impart.HTTPError{http.StatusBadRequest, "Unsupported file. Import an OPML or CSV file."}
+	}
+	if err != nil {
+		logInfo("Couldn't parse import: %v", err)
+		return impart.HTTPError{http.StatusBadRequest, "Couldn't read that file."}
+	}
+	if len(entries) == 0 {
+		return impart.HTTPError{http.StatusBadRequest, "There's no one to follow in that file."}
+	}
+	if len(entries) > maxImportEntries {
+		return impart.HTTPError{http.StatusBadRequest, "That file has too many entries to import at once."}
+	}
+
+	err = startImport(app, u, fh.Filename, entries)
+	if err != nil {
+		return err
+	}
+	return impart.HTTPError{http.StatusFound, "/settings/import"}
+}
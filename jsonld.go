@@ -0,0 +1,388 @@
+package readas
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/writeas/web-core/activitystreams"
+	"html"
+	"strings"
+	"time"
+)
+
+// Servers other than Mastodon use more of JSON-LD's flexibility than
+// activitystreams.Person can unmarshal: any property can be an array, links
+// can be Link objects instead of IRIs, and natural language values can come
+// as maps. These helpers reduce each of those shapes to the single string we
+// store.
+
+const (
+	maxIRILen     = 255
+	maxWarningLen = 500
+	maxAltLen     = 1500
+)
+
+// jsonID returns the IRI a property refers to, whether it's given as an IRI,
+// an object with an id or href, or an array of those.
+func jsonID(v interface{}) string {
+	switch o := v.(type) {
+	case string:
+		return o
+	case map[string]interface{}:
+		if id, ok := o["id"].(string); ok {
+			return id
+		}
+		if href, ok := o["href"].(string); ok {
+			return href
+		}
+	case []interface{}:
+		for _, item := range o {
+			if id := jsonID(item); id != "" {
+				return id
+			}
+		}
+	}
+	return ""
+}
+
+// jsonURL returns the best URL from a `url` property, preferring a link to
+// an HTML page when several are given.
+func jsonURL(v interface{}) string {
+	items, ok := v.([]interface{})
+	if !ok {
+		return linkHref(v)
+	}
+	for _, item := range items {
+		if l, ok := item.(map[string]interface{}); ok && l["mediaType"] == "text/html" {
+			return linkHref(l)
+		}
+	}
+	return jsonID(items)
+}
+
+// linkHref returns the target of a Link, or the IRI given in its place.
+func linkHref(v interface{}) string {
+	if l, ok := v.(map[string]interface{}); ok {
+		if href, ok := l["href"].(string); ok {
+			return href
+		}
+		// Some servers nest the href in the Link's own url
+		if u, ok := l["url"]; ok {
+			return jsonURL(u)
+		}
+	}
+	return jsonID(v)
+}
+
+// jsonString returns the string value of a property that may be an array.
+func jsonString(v interface{}) string {
+	switch o := v.(type) {
+	case string:
+		return o
+	case []interface{}:
+		for _, item := range o {
+			if s, ok := item.(string); ok {
+				return s
+			}
+		}
+	}
+	return ""
+}
+
+// jsonLangString returns the given natural language property, falling back
+// to its map form, like nameMap, and preferring English there.
+func jsonLangString(m map[string]interface{}, key string) string {
+	if s := jsonString(m[key]); s != "" {
+		return s
+	}
+	langs, ok := m[key+"Map"].(map[string]interface{})
+	if !ok {
+		return ""
+	}
+	for _, lang := range []string{"en", "und"} {
+		if s, ok := langs[lang].(string); ok {
+			return s
+		}
+	}
+	for _, v := range langs {
+		if s, ok := v.(string); ok {
+			return s
+		}
+	}
+	return ""
+}
+
+// jsonType returns an object's type, or the first of its types that's in
+// want, if any are.
+func jsonType(v interface{}, want func(interface{}) bool) string {
+	types, ok := v.([]interface{})
+	if !ok {
+		s, _ := v.(string)
+		return s
+	}
+	for _, t := range types {
+		if want(t) {
+			return t.(string)
+		}
+	}
+	return jsonString(types)
+}
+
+// jsonImage returns the first image in an `icon` or `image` property, which
+// may be an Image, a Link, an IRI, or an array of any of them.
+func jsonImage(v interface{}) activitystreams.Image {
+	if items, ok := v.([]interface{}); ok {
+		for _, item := range items {
+			if img := jsonImage(item); img.URL != "" {
+				return img
+			}
+		}
+		return activitystreams.Image{}
+	}
+	img := activitystreams.Image{
+		Type: "Image",
+		URL:  linkHref(v),
+	}
+	if img.URL == "" {
+		return activitystreams.Image{}
+	}
+	if o, ok := v.(map[string]interface{}); ok {
+		img.MediaType, _ = o["mediaType"].(string)
+	}
+	return img
+}
+
+// jsonPublicKey returns the actor's key, picking the one it owns when it
+// lists several.
+func jsonPublicKey(v interface{}, owner string) activitystreams.PublicKey {
+	if items, ok := v.([]interface{}); ok {
+		var k activitystreams.PublicKey
+		for _, item := range items {
+			k = jsonPublicKey(item, owner)
+			if k.Owner == owner {
+				return k
+			}
+		}
+		return k
+	}
+	o, _ := v.(map[string]interface{})
+	k := activitystreams.PublicKey{}
+	k.ID, _ = o["id"].(string)
+	k.Owner = jsonID(o["owner"])
+	k.PublicKeyPEM, _ = o["publicKeyPem"].(string)
+	return k
+}
+
+// shortIRI drops IRIs too long to store, which would otherwise be cut off
+// and point somewhere else.
+func shortIRI(iri string) string {
+	if len(iri) > maxIRILen {
+		return ""
+	}
+	return iri
+}
+
+// parseActor reads an actor document from any server into a Person, with each
+// property reduced to what we store.
+func parseActor(b []byte) (*activitystreams.Person, error) {
+	var m map[string]interface{}
+	err := json.Unmarshal(b, &m)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &activitystreams.Person{}
+	p.ID = jsonID(m["id"])
+	if p.ID == "" || len(p.ID) > maxIRILen {
+		return nil, fmt.Errorf("actor has no valid id")
+	}
+	p.Type = jsonType(m["type"], isActorType)
+	if !isActorType(p.Type) {
+		return nil, fmt.Errorf("%s isn't an actor, but a %s", p.ID, p.Type)
+	}
+	p.PreferredUsername = truncate(jsonString(m["preferredUsername"]), 60)
+	p.Name = truncate(strings.TrimSpace(jsonLangString(m, "name")), maxNameLen)
+	if p.Name == "" {
+		p.Name = p.PreferredUsername
+	}
+	p.Summary = truncate(jsonLangString(m, "summary"), maxSummaryLen)
+	p.URL = shortIRI(jsonURL(m["url"]))
+	if p.URL == "" {
+		p.URL = p.ID
+	}
+	p.Icon = jsonImage(m["icon"])
+	p.Icon.URL = shortIRI(p.Icon.URL)
+	p.Inbox = shortIRI(jsonID(m["inbox"]))
+	p.Outbox = shortIRI(jsonID(m["outbox"]))
+	p.Following = shortIRI(jsonID(m["following"]))
+	p.Followers = shortIRI(jsonID(m["followers"]))
+	if endpoints, ok := m["endpoints"].(map[string]interface{}); ok {
+		p.Endpoints.SharedInbox = shortIRI(jsonID(endpoints["sharedInbox"]))
+	}
+	p.PublicKey = jsonPublicKey(m["publicKey"], p.ID)
+	if p.PublicKey.Owner != "" && p.PublicKey.Owner != p.ID {
+		// Only trust keys the actor claims as their own
+		p.PublicKey = activitystreams.PublicKey{}
+	}
+	return p, nil
+}
+
+// jsonTime returns the time in a date property, or the zero time.
+func jsonTime(v interface{}) time.Time {
+	t, _ := time.Parse(time.RFC3339, jsonString(v))
+	return t
+}
+
+// jsonMedia returns the media files among the links in a `url` property. A
+// bare IRI is taken to be the object's file when the object itself has a
+// mediaType, like Documents and Images often do.
+func jsonMedia(v interface{}, mediaType string) []Attachment {
+	media := []Attachment{}
+	items, ok := v.([]interface{})
+	if !ok {
+		items = []interface{}{v}
+	}
+	for _, item := range items {
+		a := Attachment{URL: linkHref(item), MediaType: mediaType}
+		if l, ok := item.(map[string]interface{}); ok {
+			if t, ok := l["mediaType"].(string); ok {
+				a.MediaType = t
+			}
+		}
+		if a.URL == "" || len(a.URL) > maxIRILen || !(a.IsImage() || a.IsVideo() || a.IsAudio()) {
+			continue
+		}
+		media = append(media, a)
+	}
+	return media
+}
+
+// jsonInt returns the number in a property, or 0.
+func jsonInt(v interface{}) int {
+	n, _ := v.(float64)
+	return int(n)
+}
+
+// jsonAttachments returns the media files in an `attachment` property, with
+// their alt text, sizes and blurhashes.
+func jsonAttachments(v interface{}) []Attachment {
+	media := []Attachment{}
+	items, ok := v.([]interface{})
+	if !ok {
+		items = []interface{}{v}
+	}
+	for _, item := range items {
+		o, ok := item.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		mediaType, _ := o["mediaType"].(string)
+		files := jsonMedia(o["url"], mediaType)
+		if _, ok := o["href"]; ok {
+			// A Link rather than a Document
+			files = jsonMedia(o, mediaType)
+		}
+		if len(files) == 0 {
+			continue
+		}
+		a := files[0]
+		a.Name = truncate(strings.TrimSpace(jsonLangString(o, "name")), maxAltLen)
+		a.Width = jsonInt(o["width"])
+		a.Height = jsonInt(o["height"])
+		a.Blurhash = truncate(jsonString(o["blurhash"]), 100)
+		media = append(media, a)
+	}
+	return media
+}
+
+// jsonPollOptions returns the choices of a Question.
+func jsonPollOptions(v interface{}) []PollOption {
+	options := []PollOption{}
+	items, _ := v.([]interface{})
+	for _, item := range items {
+		o, ok := item.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		opt := PollOption{
+			Name: truncate(jsonLangString(o, "name"), 255),
+		}
+		if replies, ok := o["replies"].(map[string]interface{}); ok {
+			if n, ok := replies["totalItems"].(float64); ok {
+				opt.Votes = int(n)
+			}
+		}
+		options = append(options, opt)
+	}
+	return options
+}
+
+// parseObject reads an object from any server into a Post, if it's one of
+// the postTypes. The Post's actorID is the object's attributedTo.
+func parseObject(m map[string]interface{}) (*Post, error) {
+	p := &Post{}
+	p.ActivityID = jsonID(m["id"])
+	if p.ActivityID == "" || len(p.ActivityID) > maxIRILen {
+		return nil, fmt.Errorf("object has no valid id")
+	}
+	p.Type = jsonType(m["type"], isPostType)
+	if !isPostType(p.Type) {
+		return nil, fmt.Errorf("%s is a %s, which we don't show", p.ActivityID, p.Type)
+	}
+	p.actorID = jsonID(m["attributedTo"])
+	p.Published = jsonTime(m["published"])
+	if p.Published.IsZero() {
+		p.Published = time.Now().UTC()
+	}
+	p.Name = truncate(jsonLangString(m, "name"), 255)
+	p.Content = jsonLangString(m, "content")
+	// Warnings are meant to be plain text, but some servers send HTML
+	p.Warning = html.UnescapeString(textPolicy.Sanitize(jsonLangString(m, "summary")))
+	p.Warning = truncate(strings.TrimSpace(p.Warning), maxWarningLen)
+	p.Sensitive, _ = m["sensitive"].(bool)
+	mediaType, _ := m["mediaType"].(string)
+	p.Media = jsonMedia(m["url"], mediaType)
+	for _, a := range jsonAttachments(m["attachment"]) {
+		if !hasMedia(p.Media, a.URL) {
+			p.Media = append(p.Media, a)
+		}
+	}
+	p.URL = shortIRI(jsonURL(m["url"]))
+	if hasMedia(p.Media, p.URL) {
+		// Link to the post, not straight to its file
+		p.URL = ""
+	}
+	if p.URL == "" {
+		p.URL = p.ActivityID
+	}
+
+	switch p.Type {
+	case "Event":
+		p.Start = jsonTime(m["startTime"])
+		p.End = jsonTime(m["endTime"])
+		if loc, ok := m["location"].(map[string]interface{}); ok {
+			p.Location = truncate(jsonLangString(loc, "name"), 255)
+		} else {
+			p.Location = truncate(jsonString(m["location"]), 255)
+		}
+	case "Question":
+		p.Options = jsonPollOptions(m["oneOf"])
+		if len(p.Options) == 0 {
+			p.Options = jsonPollOptions(m["anyOf"])
+			p.Multiple = true
+		}
+		p.End = jsonTime(m["endTime"])
+		if closed := jsonTime(m["closed"]); !closed.IsZero() {
+			p.End = closed
+		}
+	}
+	return p, nil
+}
+
+func hasMedia(media []Attachment, url string) bool {
+	for _, a := range media {
+		if a.URL == url {
+			return true
+		}
+	}
+	return false
+}
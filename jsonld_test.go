@@ -0,0 +1,140 @@
+package readas
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseActor(t *testing.T) {
+	tests := []struct {
+		file        string
+		typ         string
+		username    string
+		url         string
+		icon        string
+		inbox       string
+		sharedInbox string
+		keyOwner    string
+	}{
+		{
+			file:        "friendica.json",
+			typ:         "Organization",
+			username:    "erin",
+			url:         "https://friendica.example/profile/erin",
+			icon:        "https://friendica.example/photo/profile/erin.jpg?ts=1541150045",
+			inbox:       "https://friendica.example/inbox/erin",
+			sharedInbox: "https://friendica.example/inbox",
+			keyOwner:    "https://friendica.example/profile/erin",
+		},
+		{
+			file:        "hubzilla.json",
+			typ:         "Person",
+			username:    "dave",
+			url:         "https://hubzilla.example/profile/dave",
+			icon:        "https://hubzilla.example/photo/profile/l/2",
+			inbox:       "https://hubzilla.example/inbox/dave",
+			sharedInbox: "https://hubzilla.example/inbox",
+			keyOwner:    "https://hubzilla.example/channel/dave",
+		},
+		{
+			file:        "mastodon-instance.json",
+			typ:         "Application",
+			username:    "mastodon.example",
+			url:         "https://mastodon.example/about/more?instance_actor=true",
+			icon:        "",
+			inbox:       "https://mastodon.example/actor/inbox",
+			sharedInbox: "https://mastodon.example/inbox",
+			keyOwner:    "https://mastodon.example/actor",
+		},
+		{
+			file:        "mastodon.json",
+			typ:         "Person",
+			username:    "alice",
+			url:         "https://mastodon.example/@alice",
+			icon:        "https://files.mastodon.example/accounts/avatars/000/000/001/original/alice.jpg",
+			inbox:       "https://mastodon.example/users/alice/inbox",
+			sharedInbox: "https://mastodon.example/inbox",
+			keyOwner:    "https://mastodon.example/users/alice",
+		},
+		{
+			file:        "peertube.json",
+			typ:         "Group",
+			username:    "grace_channel",
+			url:         "https://peertube.example/video-channels/grace_channel",
+			icon:        "https://peertube.example/lazy-static/avatars/48.png",
+			inbox:       "https://peertube.example/video-channels/grace_channel/inbox",
+			sharedInbox: "https://peertube.example/inbox",
+			keyOwner:    "https://peertube.example/video-channels/grace_channel",
+		},
+		{
+			file:        "pleroma.json",
+			typ:         "Service",
+			username:    "bob",
+			url:         "https://pleroma.example/users/bob",
+			icon:        "https://pleroma.example/media/4f0c2b1e/bot.png",
+			inbox:       "https://pleroma.example/users/bob/inbox",
+			sharedInbox: "https://pleroma.example/inbox",
+			keyOwner:    "https://pleroma.example/users/bob",
+		},
+		{
+			file:        "plume.json",
+			typ:         "Group",
+			username:    "gardening",
+			url:         "https://plume.example/~/gardening/",
+			icon:        "https://plume.example/static/media/B3C1E0A2.png",
+			inbox:       "https://plume.example/~/gardening/inbox",
+			sharedInbox: "https://plume.example/inbox",
+			keyOwner:    "https://plume.example/~/gardening/",
+		},
+		{
+			file:        "writefreely.json",
+			typ:         "Person",
+			username:    "frank",
+			url:         "https://writefreely.example/frank/",
+			icon:        "https://writefreely.example/img/wf-sq.png",
+			inbox:       "https://writefreely.example/api/collections/frank/inbox",
+			sharedInbox: "https://writefreely.example/api/inbox",
+			keyOwner:    "https://writefreely.example/api/collections/frank",
+		},
+	}
+
+	// Every fixture should be covered
+	files, err := filepath.Glob(filepath.Join("testdata", "actors", "*.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != len(tests) {
+		t.Errorf("found %d actor fixtures, but %d tests", len(files), len(tests))
+	}
+
+	for _, test := range tests {
+		b, err := ioutil.ReadFile(filepath.Join("testdata", "actors", test.file))
+		if err != nil {
+			t.Errorf("%s: %v", test.file, err)
+			continue
+		}
+		p, err := parseActor(b)
+		if err != nil {
+			t.Errorf("%s: parseActor: %v", test.file, err)
+			continue
+		}
+
+		checks := []struct {
+			field, got, want string
+		}{
+			{"type", p.Type, test.typ},
+			{"preferredUsername", p.PreferredUsername, test.username},
+			{"url", p.URL, test.url},
+			{"icon", p.Icon.URL, test.icon},
+			{"inbox", p.Inbox, test.inbox},
+			{"sharedInbox", p.Endpoints.SharedInbox, test.sharedInbox},
+			{"publicKey owner", p.PublicKey.Owner, test.keyOwner},
+		}
+		for _, c := range checks {
+			if c.got != c.want {
+				t.Errorf("%s: %s = %q, want %q", test.file, c.field, c.got, c.want)
+			}
+		}
+	}
+}
@@ -6,6 +6,7 @@ import (
 
 type keychain struct {
 	cookieAuthKey, cookieKey []byte
+	proxyKey                 []byte
 }
 
 func initKeys(app *app) error {
@@ -22,5 +23,10 @@ func initKeys(app *app) error {
 		return err
 	}
 
+	app.keys.proxyKey, err = ioutil.ReadFile("keys/proxy_auth.aes256")
+	if err != nil {
+		return err
+	}
+
 	return nil
 }
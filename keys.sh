@@ -16,3 +16,10 @@ if [[ ! -e "$(pwd)/keys/cookies_auth.aes256" ]]; then
 else
 	echo "cookies authentication key already exists! rm keys/cookies_auth.aes256 if you understand the consquences."
 fi
+
+# Generate media proxy signing key
+if [[ ! -e "$(pwd)/keys/proxy_auth.aes256" ]]; then
+	dd of=$(pwd)/keys/proxy_auth.aes256 if=/dev/urandom bs=32 count=1
+else
+	echo "media proxy key already exists! rm keys/proxy_auth.aes256 if you understand the consquences."
+fi
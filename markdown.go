@@ -0,0 +1,201 @@
+package readas
+
+import (
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	markdownEscaper = strings.NewReplacer(`\`, `\\`, `*`, `\*`, `_`, `\_`, "`", "\\`", `[`, `\[`, `]`, `\]`, `<`, `\<`)
+	urlEscaper      = strings.NewReplacer(" ", "%20", "(", "%28", ")", "%29")
+	extraLines      = regexp.MustCompile(`\n[ \t]*\n(\s*\n)+`)
+	spaces          = regexp.MustCompile(`\s+`)
+)
+
+// htmlToMarkdown converts a post's HTML into Markdown. Anything Markdown
+// can't express, like tables and embeds, is reduced to its text and links.
+func htmlToMarkdown(content string) (string, error) {
+	body := &html.Node{Type: html.ElementNode, Data: "body", DataAtom: atom.Body}
+	nodes, err := html.ParseFragment(strings.NewReader(content), body)
+	if err != nil {
+		return "", err
+	}
+	var sb strings.Builder
+	for _, n := range nodes {
+		sb.WriteString(markdownNode(n))
+	}
+	return tidyMarkdown(sb.String()) + "\n", nil
+}
+
+func tidyMarkdown(s string) string {
+	return strings.TrimSpace(extraLines.ReplaceAllString(s, "\n\n"))
+}
+
+func markdownChildren(n *html.Node) string {
+	var sb strings.Builder
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		sb.WriteString(markdownNode(c))
+	}
+	return sb.String()
+}
+
+func markdownBlock(s string) string {
+	s = tidyMarkdown(s)
+	if s == "" {
+		return ""
+	}
+	return "\n\n" + s + "\n\n"
+}
+
+// markdownInline wraps the node's contents in the given markers, keeping any
+// surrounding space outside of them.
+func markdownInline(n *html.Node, marker string) string {
+	s := markdownChildren(n)
+	t := strings.TrimSpace(s)
+	if t == "" {
+		return s
+	}
+	i := strings.Index(s, t)
+	return s[:i] + marker + t + marker + s[i+len(t):]
+}
+
+func textContent(n *html.Node) string {
+	if n.Type == html.TextNode {
+		return n.Data
+	}
+	var sb strings.Builder
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		sb.WriteString(textContent(c))
+	}
+	return sb.String()
+}
+
+func nodeAttr(n *html.Node, key string) string {
+	for _, a := range n.Attr {
+		if a.Key == key {
+			return a.Val
+		}
+	}
+	return ""
+}
+
+// prefixLines adds the given prefix to every line of s. The first line can
+// have a different one, like a list item's marker.
+func prefixLines(s, first, rest string) string {
+	lines := strings.Split(s, "\n")
+	for i := range lines {
+		p := rest
+		if i == 0 {
+			p = first
+		}
+		if lines[i] == "" {
+			p = strings.TrimRight(p, " ")
+		}
+		lines[i] = p + lines[i]
+	}
+	return strings.Join(lines, "\n")
+}
+
+func markdownList(n *html.Node) string {
+	var sb strings.Builder
+	i := 1
+	if start, err := strconv.Atoi(nodeAttr(n, "start")); err == nil {
+		i = start
+	}
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		if c.Type != html.ElementNode || c.DataAtom != atom.Li {
+			continue
+		}
+		marker := "- "
+		if n.DataAtom == atom.Ol {
+			marker = strconv.Itoa(i) + ". "
+			i++
+		}
+		item := tidyMarkdown(markdownChildren(c))
+		sb.WriteString(prefixLines(item, marker, strings.Repeat(" ", len(marker))) + "\n")
+	}
+	return "\n\n" + sb.String() + "\n"
+}
+
+func markdownNode(n *html.Node) string {
+	switch n.Type {
+	case html.TextNode:
+		return markdownEscaper.Replace(spaces.ReplaceAllString(n.Data, " "))
+	case html.ElementNode:
+	default:
+		return ""
+	}
+
+	switch n.DataAtom {
+	case atom.H1, atom.H2, atom.H3, atom.H4, atom.H5, atom.H6:
+		level := int(n.Data[1] - '0')
+		return "\n\n" + strings.Repeat("#", level) + " " + spaces.ReplaceAllString(strings.TrimSpace(markdownChildren(n)), " ") + "\n\n"
+	case atom.P, atom.Div, atom.Section, atom.Article, atom.Header, atom.Footer, atom.Figure, atom.Figcaption, atom.Table, atom.Tr, atom.Dl, atom.Dt, atom.Dd, atom.Li:
+		return markdownBlock(markdownChildren(n))
+	case atom.Ul, atom.Ol:
+		return markdownList(n)
+	case atom.Blockquote:
+		s := tidyMarkdown(markdownChildren(n))
+		if s == "" {
+			return ""
+		}
+		return "\n\n" + prefixLines(s, "> ", "> ") + "\n\n"
+	case atom.Pre:
+		code := strings.Trim(textContent(n), "\n")
+		fence := "```"
+		for strings.Contains(code, fence) {
+			fence += "`"
+		}
+		return "\n\n" + fence + "\n" + code + "\n" + fence + "\n\n"
+	case atom.Code:
+		code := textContent(n)
+		fence := "`"
+		for strings.Contains(code, fence) {
+			fence += "`"
+		}
+		if strings.HasPrefix(code, "`") || strings.HasSuffix(code, "`") {
+			code = " " + code + " "
+		}
+		return fence + code + fence
+	case atom.Br:
+		return "\\\n"
+	case atom.Hr:
+		return "\n\n---\n\n"
+	case atom.Strong, atom.B:
+		return markdownInline(n, "**")
+	case atom.Em, atom.I:
+		return markdownInline(n, "_")
+	case atom.Del, atom.S, atom.Strike:
+		return markdownInline(n, "~~")
+	case atom.Td, atom.Th:
+		return markdownChildren(n) + " "
+	case atom.A:
+		text := strings.TrimSpace(markdownChildren(n))
+		href := nodeAttr(n, "href")
+		if href == "" || strings.HasPrefix(href, "#") {
+			return text
+		}
+		if text == "" {
+			text = markdownEscaper.Replace(href)
+		}
+		return "[" + text + "](" + urlEscaper.Replace(href) + ")"
+	case atom.Img:
+		src := nodeAttr(n, "src")
+		if src == "" {
+			return ""
+		}
+		return "![" + markdownEscaper.Replace(nodeAttr(n, "alt")) + "](" + urlEscaper.Replace(src) + ")"
+	case atom.Iframe, atom.Video, atom.Audio:
+		src := nodeAttr(n, "src")
+		if src == "" {
+			return ""
+		}
+		return markdownBlock("[Embedded media](" + urlEscaper.Replace(src) + ")")
+	case atom.Script, atom.Style:
+		return ""
+	}
+	return markdownChildren(n)
+}
@@ -0,0 +1,627 @@
+package readas
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/writeas/impart"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The Mastodon-compatible API lets existing fediverse apps read a Read.as
+// feed. It only covers what those apps need for reading and following.
+
+const (
+	mastodonTimelineLimit    = 20
+	mastodonMaxTimelineLimit = 40
+
+	mastodonVersion = "3.0.0 (compatible; " + serverName + " " + softwareVersion + ")"
+)
+
+type mastodonAccount struct {
+	ID             string        `json:"id"`
+	Username       string        `json:"username"`
+	Acct           string        `json:"acct"`
+	DisplayName    string        `json:"display_name"`
+	Locked         bool          `json:"locked"`
+	Bot            bool          `json:"bot"`
+	CreatedAt      time.Time     `json:"created_at"`
+	Note           string        `json:"note"`
+	URL            string        `json:"url"`
+	Avatar         string        `json:"avatar"`
+	AvatarStatic   string        `json:"avatar_static"`
+	Header         string        `json:"header"`
+	HeaderStatic   string        `json:"header_static"`
+	FollowersCount uint64        `json:"followers_count"`
+	FollowingCount uint64        `json:"following_count"`
+	StatusesCount  uint64        `json:"statuses_count"`
+	Emojis         []interface{} `json:"emojis"`
+	Fields         []interface{} `json:"fields"`
+}
+
+type mastodonStatus struct {
+	ID                 string           `json:"id"`
+	CreatedAt          time.Time        `json:"created_at"`
+	InReplyToID        *string          `json:"in_reply_to_id"`
+	InReplyToAccountID *string          `json:"in_reply_to_account_id"`
+	Sensitive          bool             `json:"sensitive"`
+	SpoilerText        string           `json:"spoiler_text"`
+	Visibility         string           `json:"visibility"`
+	Language           *string          `json:"language"`
+	URI                string           `json:"uri"`
+	URL                string           `json:"url"`
+	RepliesCount       int              `json:"replies_count"`
+	ReblogsCount       int              `json:"reblogs_count"`
+	FavouritesCount    int              `json:"favourites_count"`
+	Favourited         bool             `json:"favourited"`
+	Reblogged          bool             `json:"reblogged"`
+	Muted              bool             `json:"muted"`
+	Bookmarked         bool             `json:"bookmarked"`
+	Content            string           `json:"content"`
+	Reblog             *mastodonStatus  `json:"reblog"`
+	Account            *mastodonAccount `json:"account"`
+	MediaAttachments   []interface{}    `json:"media_attachments"`
+	Mentions           []interface{}    `json:"mentions"`
+	Tags               []interface{}    `json:"tags"`
+	Emojis             []interface{}    `json:"emojis"`
+	Card               interface{}      `json:"card"`
+	Poll               interface{}      `json:"poll"`
+}
+
+type mastodonAttachment struct {
+	ID          string      `json:"id"`
+	Type        string      `json:"type"`
+	URL         string      `json:"url"`
+	PreviewURL  string      `json:"preview_url"`
+	RemoteURL   string      `json:"remote_url"`
+	Description *string     `json:"description"`
+	Blurhash    *string     `json:"blurhash"`
+	Meta        interface{} `json:"meta"`
+}
+
+type mastodonRelationship struct {
+	ID                  string `json:"id"`
+	Following           bool   `json:"following"`
+	ShowingReblogs      bool   `json:"showing_reblogs"`
+	FollowedBy          bool   `json:"followed_by"`
+	Blocking            bool   `json:"blocking"`
+	Muting              bool   `json:"muting"`
+	MutingNotifications bool   `json:"muting_notifications"`
+	Requested           bool   `json:"requested"`
+	DomainBlocking      bool   `json:"domain_blocking"`
+	Endorsed            bool   `json:"endorsed"`
+}
+
+// writeJSON writes v as a bare JSON response, the way Mastodon clients expect
+// it, rather than wrapped like the rest of the API.
+func writeJSON(w http.ResponseWriter, v interface{}) error {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	return json.NewEncoder(w).Encode(v)
+}
+
+// isMastodonAPI returns whether the request is for the Mastodon-compatible
+// API.
+func isMastodonAPI(r *http.Request) bool {
+	return strings.HasPrefix(r.URL.Path, "/api/v1/") || strings.HasPrefix(r.URL.Path, "/api/v2/")
+}
+
+// writeMastodonError writes an error as {"error": "..."}, which is where
+// Mastodon clients look for the message to show.
+func writeMastodonError(w http.ResponseWriter, status int, msg string) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": msg})
+}
+
+// parseJSONForm adds the top-level fields of a JSON request body to the
+// request's form values, since many Mastodon clients send JSON instead of a
+// form.
+func parseJSONForm(r *http.Request) {
+	if !strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		return
+	}
+	r.ParseForm()
+	var body map[string]interface{}
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+		logInfo("Couldn't parse JSON request body: %v", err)
+		return
+	}
+	for k, v := range body {
+		switch v := v.(type) {
+		case string:
+			r.Form.Set(k, v)
+		case float64:
+			r.Form.Set(k, strconv.FormatFloat(v, 'f', -1, 64))
+		case bool:
+			r.Form.Set(k, strconv.FormatBool(v))
+		case []interface{}:
+			for _, item := range v {
+				if s, ok := item.(string); ok {
+					r.Form.Add(k, s)
+				}
+			}
+		}
+	}
+}
+
+func localAccount(app *app, u *LocalUser) (*mastodonAccount, error) {
+	followers, err := app.getFollowersCount(u.ID)
+	if err != nil {
+		return nil, err
+	}
+	following, err := app.getFollowingCount(u.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	a := &mastodonAccount{
+		ID:             strconv.FormatInt(u.ID, 10),
+		Username:       u.PreferredUsername,
+		Acct:           u.PreferredUsername,
+		DisplayName:    u.Name,
+		Note:           u.Summary,
+		URL:            app.cfg.Host + "/" + u.PreferredUsername,
+		Avatar:         u.AvatarURL(app),
+		FollowersCount: followers,
+		FollowingCount: following,
+		Emojis:         []interface{}{},
+		Fields:         []interface{}{},
+	}
+	if a.DisplayName == "" {
+		a.DisplayName = u.PreferredUsername
+	}
+	return a.withDefaults(app), nil
+}
+
+func remoteAccount(app *app, u *User) *mastodonAccount {
+	a := &mastodonAccount{
+		ID:          strconv.FormatInt(u.ID, 10),
+		Username:    u.PreferredUsername,
+		Acct:        u.PreferredUsername,
+		DisplayName: u.Name,
+		CreatedAt:   u.Created,
+		Note:        string(sanitize(u.Summary)),
+		URL:         u.URL,
+		Avatar:      proxyURL(u.Icon.URL),
+		Emojis:      []interface{}{},
+		Fields:      []interface{}{},
+	}
+	if u.Host != "" {
+		a.Acct += "@" + u.Host
+	}
+	if a.DisplayName == "" {
+		a.DisplayName = u.PreferredUsername
+	}
+	return a.withDefaults(app)
+}
+
+// withDefaults fills in the images that apps expect every account to have.
+func (a *mastodonAccount) withDefaults(app *app) *mastodonAccount {
+	if a.Avatar == "" {
+		a.Avatar = app.cfg.Host + "/img/readas.svg"
+	}
+	a.AvatarStatic = a.Avatar
+	a.Header = app.cfg.Host + "/img/readas.svg"
+	a.HeaderStatic = a.Header
+	return a
+}
+
+func postStatus(app *app, p *Post) *mastodonStatus {
+	// Statuses don't have titles, so show it at the top of the content
+	content := string(p.SanitaryContent())
+	if p.Name != "" {
+		content = "<p><strong>" + template.HTMLEscapeString(p.Name) + "</strong></p>" + content
+	}
+
+	media := []interface{}{}
+	for i, a := range p.Media {
+		media = append(media, postAttachment(p, i, a))
+	}
+
+	owner := remoteAccount(app, p.Owner)
+	owner.ID = strconv.FormatInt(p.OwnerID, 10)
+	return &mastodonStatus{
+		ID:               strconv.FormatInt(p.ID, 10),
+		CreatedAt:        p.Published,
+		Sensitive:        p.HasWarning(),
+		SpoilerText:      p.Warning,
+		Visibility:       "public",
+		URI:              p.ActivityID,
+		URL:              p.URL,
+		Bookmarked:       p.IsSaved,
+		Content:          content,
+		Account:          owner,
+		MediaAttachments: media,
+		Mentions:         []interface{}{},
+		Tags:             []interface{}{},
+		Emojis:           []interface{}{},
+	}
+}
+
+// postAttachment returns the ith media file of a post as a Mastodon
+// attachment. Images are served through the media proxy; other files from
+// where they're hosted.
+func postAttachment(p *Post, i int, a Attachment) *mastodonAttachment {
+	ma := &mastodonAttachment{
+		ID:         fmt.Sprintf("%d-%d", p.ID, i),
+		Type:       "unknown",
+		URL:        a.ProxyURL(),
+		PreviewURL: a.ProxyURL(),
+		RemoteURL:  a.URL,
+		Meta:       map[string]interface{}{},
+	}
+	switch {
+	case a.IsImage():
+		ma.Type = "image"
+	case a.IsVideo():
+		ma.Type = "video"
+	case a.IsAudio():
+		ma.Type = "audio"
+	}
+	if a.Name != "" {
+		ma.Description = &a.Name
+	}
+	if a.Blurhash != "" {
+		ma.Blurhash = &a.Blurhash
+	}
+	if a.Width > 0 && a.Height > 0 {
+		ma.Meta = map[string]interface{}{
+			"original": map[string]interface{}{
+				"width":  a.Width,
+				"height": a.Height,
+				"size":   fmt.Sprintf("%dx%d", a.Width, a.Height),
+				"aspect": float64(a.Width) / float64(a.Height),
+			},
+		}
+	}
+	return ma
+}
+
+// writeStatuses writes a page of posts as statuses, along with the Link
+// header apps use to load the next and previous pages.
+func writeStatuses(app *app, w http.ResponseWriter, r *http.Request, posts *[]Post) error {
+	statuses := []*mastodonStatus{}
+	for i := range *posts {
+		statuses = append(statuses, postStatus(app, &(*posts)[i]))
+	}
+
+	if len(statuses) > 0 {
+		base := app.cfg.Host + r.URL.Path + "?"
+		q := url.Values{}
+		if l := r.FormValue("limit"); l != "" {
+			q.Set("limit", l)
+		}
+		q.Set("max_id", statuses[len(statuses)-1].ID)
+		next := base + q.Encode()
+		q.Del("max_id")
+		q.Set("since_id", statuses[0].ID)
+		prev := base + q.Encode()
+		w.Header().Set("Link", fmt.Sprintf(`<%s>; rel="next", <%s>; rel="prev"`, next, prev))
+	}
+	return writeJSON(w, statuses)
+}
+
+// timelineParams reads the paging parameters Mastodon clients send.
+func timelineParams(r *http.Request) (maxID, sinceID int64, limit int) {
+	maxID, _ = strconv.ParseInt(r.FormValue("max_id"), 10, 64)
+	sinceID, _ = strconv.ParseInt(r.FormValue("since_id"), 10, 64)
+	if sinceID == 0 {
+		sinceID, _ = strconv.ParseInt(r.FormValue("min_id"), 10, 64)
+	}
+	limit, err := strconv.Atoi(r.FormValue("limit"))
+	if err != nil || limit < 1 {
+		limit = mastodonTimelineLimit
+	} else if limit > mastodonMaxTimelineLimit {
+		limit = mastodonMaxTimelineLimit
+	}
+	return
+}
+
+func mastodonUser(app *app, r *http.Request) (*LocalUser, error) {
+	cu := getUserSession(app, r)
+	if cu == nil {
+		return nil, impart.HTTPError{http.StatusUnauthorized, "The access token is invalid"}
+	}
+	return app.getLocalUser(cu.PreferredUsername)
+}
+
+// handleMastodonRegisterApp registers an app the way Mastodon does. Its
+// tokens don't expire, since most Mastodon apps don't refresh them.
+func handleMastodonRegisterApp(app *app, w http.ResponseWriter, r *http.Request) error {
+	parseJSONForm(r)
+	redirectURIs := []string{}
+	for _, v := range r.Form["redirect_uris"] {
+		redirectURIs = append(redirectURIs, strings.Fields(v)...)
+	}
+	c, secret, err := registerOAuthClient(app, r.FormValue("client_name"), r.FormValue("website"), redirectURIs, true)
+	if err != nil {
+		return err
+	}
+
+	return writeJSON(w, map[string]interface{}{
+		"id":            c.ID,
+		"name":          c.Name,
+		"website":       c.Website,
+		"redirect_uri":  strings.Join(c.RedirectURIs, "\n"),
+		"client_id":     c.ID,
+		"client_secret": secret,
+		"vapid_key":     "",
+	})
+}
+
+func handleMastodonInstance(app *app, w http.ResponseWriter, r *http.Request) error {
+	users, err := app.getUsersCount()
+	if err != nil {
+		return err
+	}
+	host := app.cfg.Host[strings.LastIndexByte(app.cfg.Host, '/')+1:]
+
+	return writeJSON(w, map[string]interface{}{
+		"uri":               host,
+		"title":             app.cfg.Name,
+		"short_description": "ActivityPub-enabled long-form reader.",
+		"description":       "ActivityPub-enabled long-form reader.",
+		"email":             "",
+		"version":           mastodonVersion,
+		"urls":              map[string]string{},
+		"stats": map[string]uint64{
+			"user_count":   users,
+			"status_count": 0,
+			"domain_count": 0,
+		},
+		"languages":         []string{},
+		"registrations":     false,
+		"approval_required": false,
+		"invites_enabled":   false,
+	})
+}
+
+func handleMastodonVerifyCredentials(app *app, w http.ResponseWriter, r *http.Request) error {
+	u, err := mastodonUser(app, r)
+	if err != nil {
+		return err
+	}
+	a, err := localAccount(app, u)
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, a)
+}
+
+// getMastodonAccount returns the account with the ID in the request's URL,
+// which is either the logged-in user or someone they can follow.
+func getMastodonAccount(app *app, r *http.Request, u *LocalUser) (*mastodonAccount, *User, error) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		return nil, nil, impart.HTTPError{http.StatusNotFound, "Record not found"}
+	}
+	if id == u.ID {
+		a, err := localAccount(app, u)
+		return a, nil, err
+	}
+	remoteUser, err := app.getUserByID(id)
+	if err != nil {
+		return nil, nil, err
+	}
+	return remoteAccount(app, remoteUser), remoteUser, nil
+}
+
+func handleMastodonFetchAccount(app *app, w http.ResponseWriter, r *http.Request) error {
+	u, err := mastodonUser(app, r)
+	if err != nil {
+		return err
+	}
+	a, _, err := getMastodonAccount(app, r, u)
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, a)
+}
+
+// lookupAccount finds the account with the given handle, looking it up via
+// webfinger if we haven't seen it before.
+func lookupAccount(app *app, u *LocalUser, handle string) (*mastodonAccount, error) {
+	handle = strings.TrimPrefix(strings.TrimSpace(handle), "@")
+	if handle == u.PreferredUsername {
+		return localAccount(app, u)
+	}
+	var remoteUser *User
+	var err error
+	if userItems := strings.Split(handle, "@"); len(userItems) == 2 {
+		remoteUser, err = app.getActorByHandle(userItems[0], userItems[1])
+	}
+	if remoteUser == nil {
+		remoteUser, err = findUser(app, handle)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return remoteAccount(app, remoteUser), nil
+}
+
+func handleMastodonLookupAccount(app *app, w http.ResponseWriter, r *http.Request) error {
+	u, err := mastodonUser(app, r)
+	if err != nil {
+		return err
+	}
+	a, err := lookupAccount(app, u, r.FormValue("acct"))
+	if err != nil {
+		return impart.HTTPError{http.StatusNotFound, "Record not found"}
+	}
+	return writeJSON(w, a)
+}
+
+// handleMastodonSearch only finds accounts by their handle, so people can
+// follow them from their app.
+func handleMastodonSearch(app *app, w http.ResponseWriter, r *http.Request) error {
+	u, err := mastodonUser(app, r)
+	if err != nil {
+		return err
+	}
+	accounts := []*mastodonAccount{}
+	q := r.FormValue("q")
+	if strings.Contains(strings.TrimPrefix(q, "@"), "@") && r.FormValue("type") != "statuses" && r.FormValue("type") != "hashtags" {
+		a, err := lookupAccount(app, u, q)
+		if err == nil {
+			accounts = append(accounts, a)
+		}
+	}
+	return writeJSON(w, map[string]interface{}{
+		"accounts": accounts,
+		"statuses": []interface{}{},
+		"hashtags": []interface{}{},
+	})
+}
+
+func relationship(app *app, u *LocalUser, id int64) (*mastodonRelationship, error) {
+	following, err := app.isFollowing(u.ID, id)
+	if err != nil {
+		return nil, err
+	}
+	followedBy, err := app.isFollowing(id, u.ID)
+	if err != nil {
+		return nil, err
+	}
+	return &mastodonRelationship{
+		ID:             strconv.FormatInt(id, 10),
+		Following:      following,
+		ShowingReblogs: following,
+		FollowedBy:     followedBy,
+	}, nil
+}
+
+func handleMastodonRelationships(app *app, w http.ResponseWriter, r *http.Request) error {
+	u, err := mastodonUser(app, r)
+	if err != nil {
+		return err
+	}
+	r.ParseForm()
+	ids := append(r.Form["id[]"], r.Form["id"]...)
+	rels := []*mastodonRelationship{}
+	for _, s := range ids {
+		id, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			continue
+		}
+		rel, err := relationship(app, u, id)
+		if err != nil {
+			return err
+		}
+		rels = append(rels, rel)
+	}
+	return writeJSON(w, rels)
+}
+
+// handleMastodonFollow follows or unfollows an account. Follows aren't
+// confirmed until the account accepts them, so they show as requested.
+func handleMastodonFollow(app *app, w http.ResponseWriter, r *http.Request) error {
+	u, err := mastodonUser(app, r)
+	if err != nil {
+		return err
+	}
+	_, remoteUser, err := getMastodonAccount(app, r, u)
+	if err != nil {
+		return err
+	}
+	if remoteUser == nil {
+		return impart.HTTPError{http.StatusForbidden, "You can't follow yourself"}
+	}
+
+	requested := false
+	if strings.HasSuffix(r.URL.Path, "/unfollow") {
+		err = unfollowUser(app, u, remoteUser)
+	} else {
+		err = followUser(app, u, remoteUser)
+		requested = true
+	}
+	if err != nil {
+		return err
+	}
+
+	rel, err := relationship(app, u, remoteUser.ID)
+	if err != nil {
+		return err
+	}
+	rel.Requested = requested && !rel.Following
+	return writeJSON(w, rel)
+}
+
+func handleMastodonAccountStatuses(app *app, w http.ResponseWriter, r *http.Request) error {
+	u, err := mastodonUser(app, r)
+	if err != nil {
+		return err
+	}
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		return impart.HTTPError{http.StatusNotFound, "Record not found"}
+	}
+
+	maxID, sinceID, limit := timelineParams(r)
+	posts := &[]Post{}
+	if id != u.ID {
+		posts, err = app.getTimeline(u.ID, id, maxID, sinceID, limit)
+		if err != nil {
+			return err
+		}
+	}
+	return writeStatuses(app, w, r, posts)
+}
+
+func handleMastodonHomeTimeline(app *app, w http.ResponseWriter, r *http.Request) error {
+	u, err := mastodonUser(app, r)
+	if err != nil {
+		return err
+	}
+
+	maxID, sinceID, limit := timelineParams(r)
+	posts, err := app.getTimeline(u.ID, 0, maxID, sinceID, limit)
+	if err != nil {
+		return err
+	}
+	return writeStatuses(app, w, r, posts)
+}
+
+func handleMastodonFetchStatus(app *app, w http.ResponseWriter, r *http.Request) error {
+	u, err := mastodonUser(app, r)
+	if err != nil {
+		return err
+	}
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		return impart.HTTPError{http.StatusNotFound, "Record not found"}
+	}
+	p, err := app.getPost(id, u.ID)
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, postStatus(app, p))
+}
+
+// handleMastodonBookmark saves or unsaves a post, which apps show as
+// bookmarks.
+func handleMastodonBookmark(app *app, w http.ResponseWriter, r *http.Request) error {
+	u, err := mastodonUser(app, r)
+	if err != nil {
+		return err
+	}
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		return impart.HTTPError{http.StatusNotFound, "Record not found"}
+	}
+	p, err := app.getPost(id, u.ID)
+	if err != nil {
+		return err
+	}
+	p.IsSaved = !strings.HasSuffix(r.URL.Path, "/unbookmark")
+	err = app.setPostSaved(u.ID, id, p.IsSaved)
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, postStatus(app, p))
+}
@@ -0,0 +1,279 @@
+package readas
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/writeas/impart"
+	"github.com/writeas/web-core/activitystreams"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Accounts move between servers the way Mastodon's do. The new account lists
+// the old one in alsoKnownAs, then the old account sets movedTo and sends a
+// Move to its followers, whose servers check the alias and follow the new
+// account instead.
+
+const maxAliases = 10
+
+// resolveActorIRI returns the actor IRI of the given fediverse handle, or the
+// IRI itself if that's what was given.
+func resolveActorIRI(handle string) (string, error) {
+	handle = strings.TrimPrefix(strings.TrimSpace(handle), "@")
+	if strings.HasPrefix(handle, "https://") {
+		return handle, nil
+	}
+	parts := strings.Split(handle, "@")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", impart.HTTPError{http.StatusBadRequest, "Enter a fediverse handle like user@example.com."}
+	}
+	wfr, err := doWebfinger(parts[1], parts[0])
+	if err != nil {
+		logInfo("Webfinger failed: %v", err)
+		return "", impart.HTTPError{http.StatusBadRequest, "Couldn't find " + handle + "."}
+	}
+	return wfr.ActorIRI, nil
+}
+
+// fetchActorAliases fetches the given actor and returns its alsoKnownAs.
+func fetchActorAliases(actorIRI string) ([]string, error) {
+	b, err := resolveIRI(actorIRI)
+	if err != nil {
+		return nil, err
+	}
+	var actor struct {
+		ID          string      `json:"id"`
+		AlsoKnownAs interface{} `json:"alsoKnownAs"`
+	}
+	err = json.Unmarshal(b, &actor)
+	if err != nil {
+		return nil, err
+	}
+	if actor.ID != actorIRI {
+		return nil, fmt.Errorf("fetched actor %s, not %s", actor.ID, actorIRI)
+	}
+
+	aliases := []string{}
+	switch v := actor.AlsoKnownAs.(type) {
+	case string:
+		aliases = append(aliases, v)
+	case []interface{}:
+		for _, a := range v {
+			if s, ok := a.(string); ok {
+				aliases = append(aliases, s)
+			}
+		}
+	}
+	return aliases, nil
+}
+
+func hasAlias(aliases []string, actorIRI string) bool {
+	for _, a := range aliases {
+		if a == actorIRI {
+			return true
+		}
+	}
+	return false
+}
+
+// handleUpdateAliases saves the other accounts the user has, so they can move
+// from those accounts to this one.
+func handleUpdateAliases(app *app, w http.ResponseWriter, r *http.Request) error {
+	cu := getUserSession(app, r)
+	if cu == nil || getTokenAuth(r) != nil {
+		return impart.HTTPError{http.StatusUnauthorized, "Not logged in."}
+	}
+	u, err := app.getLocalUser(cu.PreferredUsername)
+	if err != nil {
+		return err
+	}
+
+	aliases := []string{}
+	for _, handle := range strings.FieldsFunc(r.FormValue("aliases"), func(r rune) bool {
+		return r == ',' || r == '\n' || r == '\r' || r == ' '
+	}) {
+		iri, err := resolveActorIRI(handle)
+		if err != nil {
+			return err
+		}
+		if iri == u.AccountRoot(app) {
+			return impart.HTTPError{http.StatusBadRequest, "An account can't be an alias of itself."}
+		}
+		if !hasAlias(aliases, iri) {
+			aliases = append(aliases, iri)
+		}
+	}
+	if len(aliases) > maxAliases {
+		return impart.HTTPError{http.StatusBadRequest, "You can have up to " + strconv.Itoa(maxAliases) + " aliases."}
+	}
+
+	err = app.updateAliases(u.ID, aliases)
+	if err != nil {
+		return impart.HTTPError{http.StatusInternalServerError, "Couldn't save aliases."}
+	}
+	u.AlsoKnownAs = aliases
+	go sendProfileUpdate(app, u)
+
+	addSessionFlash(app, w, r, "Aliases saved.")
+	return impart.HTTPError{http.StatusFound, "/settings"}
+}
+
+// handleMoveAccount moves the user's followers to another account, once that
+// account lists this one as an alias.
+func handleMoveAccount(app *app, w http.ResponseWriter, r *http.Request) error {
+	cu := getUserSession(app, r)
+	if cu == nil || getTokenAuth(r) != nil {
+		return impart.HTTPError{http.StatusUnauthorized, "Not logged in."}
+	}
+	u, err := app.getLocalUser(cu.PreferredUsername)
+	if err != nil {
+		return err
+	}
+
+	target, err := resolveActorIRI(r.FormValue("target"))
+	if err != nil {
+		return err
+	}
+	if target == u.AccountRoot(app) {
+		return impart.HTTPError{http.StatusBadRequest, "You can't move to the same account."}
+	}
+	aliases, err := fetchActorAliases(target)
+	if err != nil {
+		logInfo("Couldn't fetch move target %s: %v", target, err)
+		return impart.HTTPError{http.StatusBadRequest, "Couldn't look up the new account."}
+	}
+	if !hasAlias(aliases, u.AccountRoot(app)) {
+		return impart.HTTPError{http.StatusBadRequest, "First add this account as an alias of the new one, then try again."}
+	}
+
+	err = app.setMovedTo(u.ID, target)
+	if err != nil {
+		return impart.HTTPError{http.StatusInternalServerError, "Couldn't move account."}
+	}
+	u.MovedTo = target
+	go sendMove(app, u)
+
+	addSessionFlash(app, w, r, "Your followers are being moved to your new account.")
+	return impart.HTTPError{http.StatusFound, "/settings"}
+}
+
+// sendMove tells the user's followers that they moved to u.MovedTo. The
+// profile update goes first, so servers see movedTo when they check.
+func sendMove(app *app, u *LocalUser) {
+	sendProfileUpdate(app, u)
+
+	actor := u.AccountRoot(app)
+	move := &moveActivity{
+		BaseObject: activitystreams.BaseObject{
+			Context: []interface{}{
+				activitystreams.Namespace,
+			},
+			Type: "Move",
+			ID:   actor + "#moves/" + strconv.FormatInt(time.Now().UnixNano(), 10),
+		},
+		Actor:  actor,
+		Object: actor,
+		Target: u.MovedTo,
+	}
+	postToFollowers(app, u, move)
+}
+
+// signatureKeyID returns the keyId of the request's HTTP signature.
+func signatureKeyID(r *http.Request) string {
+	for _, param := range strings.Split(r.Header.Get("Signature"), ",") {
+		kv := strings.SplitN(strings.TrimSpace(param), "=", 2)
+		if len(kv) == 2 && kv[0] == "keyId" {
+			return strings.Trim(kv[1], `"`)
+		}
+	}
+	return ""
+}
+
+type moveActivity struct {
+	activitystreams.BaseObject
+	Actor  string `json:"actor"`
+	Object string `json:"object"`
+	Target string `json:"target"`
+}
+
+// handleMoveActivity follows a remote account to its new home. The new
+// account must list the old one in alsoKnownAs, so only the owner of both can
+// move followers between them.
+func handleMoveActivity(app *app, r *http.Request, m map[string]interface{}) error {
+	actor, _ := m["actor"].(string)
+	object, _ := m["object"].(string)
+	target, _ := m["target"].(string)
+	if actor == "" || object != actor || target == "" {
+		return impart.HTTPError{http.StatusBadRequest, "Invalid Move."}
+	}
+	if owner, err := app.getKeyOwner(signatureKeyID(r)); err != nil || owner != actor {
+		return impart.HTTPError{http.StatusForbidden, "Move must be signed by the actor."}
+	}
+
+	oldUser, err := app.getActor(actor)
+	if err != nil {
+		// We don't know them, so no one here follows them
+		return nil
+	}
+	aliases, err := fetchActorAliases(target)
+	if err != nil {
+		logError("Couldn't fetch move target %s: %v", target, err)
+		return impart.HTTPError{http.StatusBadRequest, "Couldn't fetch target."}
+	}
+	if !hasAlias(aliases, actor) {
+		logInfo("Ignoring Move from %s to %s, which doesn't list it as an alias", actor, target)
+		return impart.HTTPError{http.StatusBadRequest, "Target isn't an alias of actor."}
+	}
+
+	err = app.setMovedTo(oldUser.ID, target)
+	if err != nil {
+		return err
+	}
+	go moveFollowers(app, oldUser, target)
+	return nil
+}
+
+// moveFollowers makes every local user who follows oldUser follow the actor
+// at target instead.
+func moveFollowers(app *app, oldUser *User, target string) {
+	usernames, err := app.getLocalFollowers(oldUser.ID)
+	if err != nil || len(usernames) == 0 {
+		return
+	}
+
+	fullActor, newUser, err := fetchActor(app, target)
+	if err != nil {
+		logError("Couldn't fetch new actor %s: %v", target, err)
+		return
+	}
+	if newUser == nil {
+		_, err = app.addUser(fullActor)
+		if err != nil {
+			logError("Couldn't save new actor %s: %v", target, err)
+			return
+		}
+		newUser, err = app.getActor(target)
+		if err != nil {
+			return
+		}
+	}
+
+	logInfo("Moving %d followers from %s to %s", len(usernames), oldUser.BaseObject.ID, target)
+	for _, username := range usernames {
+		u, err := app.getLocalUser(username)
+		if err != nil {
+			continue
+		}
+		err = followUser(app, u, newUser)
+		if err != nil {
+			logError("Couldn't follow %s for %s: %v", target, username, err)
+			continue
+		}
+		err = unfollowUser(app, u, oldUser)
+		if err != nil {
+			logError("Couldn't unfollow %s for %s: %v", oldUser.BaseObject.ID, username, err)
+		}
+	}
+}
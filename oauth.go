@@ -0,0 +1,437 @@
+package readas
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/writeas/impart"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	oauthCodeLifetime  = 10 * time.Minute
+	oauthTokenLifetime = 30 * 24 * time.Hour
+
+	// oauthOOB is the redirect URI for apps that can't receive a redirect, so
+	// the user is shown the code to paste into the app instead.
+	oauthOOB = "urn:ietf:wg:oauth:2.0:oob"
+)
+
+// OAuthClient is a third-party app registered to request access to users'
+// accounts.
+type OAuthClient struct {
+	ID           string   `json:"client_id"`
+	Name         string   `json:"name"`
+	Website      string   `json:"website,omitempty"`
+	RedirectURIs []string `json:"redirect_uris"`
+
+	secretHash string
+	// longLived is set for apps registered through the Mastodon API, which
+	// generally don't know how to refresh tokens.
+	longLived bool
+}
+
+// oauthCode is an authorization code waiting to be exchanged for a token.
+type oauthCode struct {
+	clientID        string
+	userID          int64
+	redirectURI     string
+	scope           string
+	challenge       string
+	challengeMethod string
+}
+
+// oauthTokenResponse is a successful response from the token endpoint, as
+// defined by RFC 6749.
+type oauthTokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in,omitempty"`
+	RefreshToken string `json:"refresh_token"`
+	Scope        string `json:"scope"`
+	CreatedAt    int64  `json:"created_at"`
+}
+
+// oauthScope maps the scopes an app requested to the access Read.as grants.
+// Apps that ask to change anything get write access; everyone else can only
+// read.
+func oauthScope(requested string) string {
+	for _, s := range strings.Fields(requested) {
+		if s == scopeWrite || strings.HasPrefix(s, "write:") || s == "follow" {
+			return scopeWrite
+		}
+	}
+	return scopeRead
+}
+
+// tokenLifetime returns how many seconds the app's access tokens last, or 0 if
+// they don't expire.
+func (c *OAuthClient) tokenLifetime() int {
+	if c.longLived {
+		return 0
+	}
+	return int(oauthTokenLifetime.Seconds())
+}
+
+func (c *OAuthClient) hasRedirectURI(uri string) bool {
+	for _, u := range c.RedirectURIs {
+		if u == uri {
+			return true
+		}
+	}
+	return false
+}
+
+// authenticate checks the client secret sent with a token request, returning
+// whether one was sent at all.
+func (c *OAuthClient) authenticate(secret string) (sent, ok bool) {
+	if secret == "" {
+		return false, false
+	}
+	return true, subtle.ConstantTimeCompare([]byte(hashToken(secret)), []byte(c.secretHash)) == 1
+}
+
+// verifyPKCE checks a code verifier against the challenge an authorization
+// code was created with, as defined by RFC 7636.
+func (c *oauthCode) verifyPKCE(verifier string) bool {
+	if c.challenge == "" {
+		return false
+	}
+	switch c.challengeMethod {
+	case "S256":
+		h := sha256.Sum256([]byte(verifier))
+		return subtle.ConstantTimeCompare([]byte(base64.RawURLEncoding.EncodeToString(h[:])), []byte(c.challenge)) == 1
+	case "", "plain":
+		return subtle.ConstantTimeCompare([]byte(verifier), []byte(c.challenge)) == 1
+	}
+	return false
+}
+
+func writeOAuthError(w http.ResponseWriter, status int, code, desc string) error {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	return json.NewEncoder(w).Encode(map[string]string{
+		"error":             code,
+		"error_description": desc,
+	})
+}
+
+// registerOAuthClient validates and saves a new app, returning its secret.
+func registerOAuthClient(app *app, name, website string, redirectURIs []string, longLived bool) (*OAuthClient, string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return nil, "", impart.HTTPError{http.StatusBadRequest, "An app name is required."}
+	}
+	if len(name) > 100 {
+		return nil, "", impart.HTTPError{http.StatusBadRequest, "App name is too long."}
+	}
+	if website != "" {
+		if u, err := url.Parse(website); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return nil, "", impart.HTTPError{http.StatusBadRequest, "Website must be an http or https URL."}
+		}
+	}
+	if len(redirectURIs) == 0 {
+		return nil, "", impart.HTTPError{http.StatusBadRequest, "At least one redirect URI is required."}
+	}
+	for _, uri := range redirectURIs {
+		if uri == oauthOOB {
+			continue
+		}
+		u, err := url.Parse(uri)
+		if err != nil || !u.IsAbs() || u.Fragment != "" {
+			return nil, "", impart.HTTPError{http.StatusBadRequest, "Redirect URIs must be absolute URIs without a fragment."}
+		}
+	}
+
+	id, err := generateToken()
+	if err != nil {
+		return nil, "", err
+	}
+	secret, err := generateToken()
+	if err != nil {
+		return nil, "", err
+	}
+	c := &OAuthClient{
+		ID:           id[:32],
+		Name:         name,
+		Website:      website,
+		RedirectURIs: redirectURIs,
+		longLived:    longLived,
+	}
+	err = app.createOAuthClient(c, hashToken(secret))
+	if err != nil {
+		return nil, "", err
+	}
+	return c, secret, nil
+}
+
+// handleRegisterOAuthClient registers a new app. Apps can register
+// themselves; users still have to approve each one before it gets access.
+func handleRegisterOAuthClient(app *app, w http.ResponseWriter, r *http.Request) error {
+	c, secret, err := registerOAuthClient(app, r.FormValue("client_name"), r.FormValue("website"), strings.Fields(r.FormValue("redirect_uris")), false)
+	if err != nil {
+		return err
+	}
+
+	return impart.WriteSuccess(w, struct {
+		*OAuthClient
+		Secret string `json:"client_secret"`
+	}{c, secret}, http.StatusCreated)
+}
+
+// authorizeRequest is a validated request from an app for access to the
+// logged-in user's account.
+type authorizeRequest struct {
+	client      *OAuthClient
+	redirectURI string
+	scope       string
+	state       string
+	challenge   string
+	method      string
+}
+
+// parseAuthorizeRequest validates an authorization request. Errors about the
+// client or redirect URI are shown to the user, since it isn't safe to redirect
+// back to the app.
+func parseAuthorizeRequest(app *app, r *http.Request) (*authorizeRequest, error) {
+	c, err := app.getOAuthClient(r.FormValue("client_id"))
+	if err != nil {
+		return nil, impart.HTTPError{http.StatusBadRequest, "Unknown app."}
+	}
+	redirectURI := r.FormValue("redirect_uri")
+	if redirectURI == "" && len(c.RedirectURIs) == 1 {
+		redirectURI = c.RedirectURIs[0]
+	}
+	if !c.hasRedirectURI(redirectURI) {
+		return nil, impart.HTTPError{http.StatusBadRequest, "Redirect URI doesn't match the app's registration."}
+	}
+
+	ar := &authorizeRequest{
+		client:      c,
+		redirectURI: redirectURI,
+		scope:       oauthScope(r.FormValue("scope")),
+		state:       r.FormValue("state"),
+		challenge:   r.FormValue("code_challenge"),
+		method:      r.FormValue("code_challenge_method"),
+	}
+	if ar.challenge != "" && ar.method != "" && ar.method != "S256" && ar.method != "plain" {
+		return nil, impart.HTTPError{http.StatusBadRequest, "Unsupported code challenge method."}
+	}
+	return ar, nil
+}
+
+// redirect sends the user back to the app with the given parameters.
+func (ar *authorizeRequest) redirect(params url.Values) error {
+	if ar.redirectURI == oauthOOB {
+		return impart.HTTPError{http.StatusFound, "/"}
+	}
+	if ar.state != "" {
+		params.Set("state", ar.state)
+	}
+	sep := "?"
+	if strings.Contains(ar.redirectURI, "?") {
+		sep = "&"
+	}
+	return impart.HTTPError{http.StatusFound, ar.redirectURI + sep + params.Encode()}
+}
+
+// renderAuthorize shows the consent page for an authorization request, or the
+// code to paste into the app once the user approved it.
+func renderAuthorize(app *app, w http.ResponseWriter, r *http.Request, u *LocalUser, ar *authorizeRequest, code string) error {
+	p := struct {
+		User         *LocalUser
+		Version      string
+		InstanceName string
+		CSRFToken    string
+		Client       *OAuthClient
+		CanWrite     bool
+		Action       template.URL
+		Code         string
+	}{
+		User:         u,
+		Version:      softwareVersion,
+		InstanceName: app.cfg.Name,
+		CSRFToken:    csrfToken(app, r),
+		Client:       ar.client,
+		CanWrite:     ar.scope == scopeWrite,
+		Action:       template.URL("/oauth/authorize?" + r.URL.RawQuery),
+		Code:         code,
+	}
+	// Keep other sites from framing the page to trick people into approving
+	w.Header().Set("X-Frame-Options", "DENY")
+	w.Header().Set("Content-Security-Policy", "frame-ancestors 'none'")
+	return renderTemplate(w, "authorize", p)
+}
+
+func handleViewAuthorize(app *app, w http.ResponseWriter, r *http.Request) error {
+	cu := getUserSession(app, r)
+	if cu == nil {
+		return impart.HTTPError{http.StatusUnauthorized, "Not logged in."}
+	}
+	u, err := app.getLocalUser(cu.PreferredUsername)
+	if err != nil {
+		return err
+	}
+
+	ar, err := parseAuthorizeRequest(app, r)
+	if err != nil {
+		return err
+	}
+	if r.FormValue("response_type") != "code" {
+		return ar.redirect(url.Values{"error": {"unsupported_response_type"}})
+	}
+
+	return renderAuthorize(app, w, r, u, ar, "")
+}
+
+// handleAuthorize handles the user's answer on the consent page, sending them
+// back to the app with an authorization code if they approved it.
+func handleAuthorize(app *app, w http.ResponseWriter, r *http.Request) error {
+	cu := getUserSession(app, r)
+	if cu == nil || getTokenAuth(r) != nil {
+		return impart.HTTPError{http.StatusUnauthorized, "Not logged in."}
+	}
+
+	ar, err := parseAuthorizeRequest(app, r)
+	if err != nil {
+		return err
+	}
+	if r.FormValue("approve") == "" {
+		return ar.redirect(url.Values{"error": {"access_denied"}})
+	}
+
+	code, err := generateToken()
+	if err != nil {
+		return err
+	}
+	err = app.createOAuthCode(hashToken(code), &oauthCode{
+		clientID:        ar.client.ID,
+		userID:          cu.ID,
+		redirectURI:     ar.redirectURI,
+		scope:           ar.scope,
+		challenge:       ar.challenge,
+		challengeMethod: ar.method,
+	})
+	if err != nil {
+		return err
+	}
+
+	if ar.redirectURI == oauthOOB {
+		u, err := app.getLocalUser(cu.PreferredUsername)
+		if err != nil {
+			return err
+		}
+		return renderAuthorize(app, w, r, u, ar, code)
+	}
+	return ar.redirect(url.Values{"code": {code}})
+}
+
+// handleOAuthToken exchanges an authorization code or refresh token for a new
+// access token.
+func handleOAuthToken(app *app, w http.ResponseWriter, r *http.Request) error {
+	parseJSONForm(r)
+	clientID, secret, ok := r.BasicAuth()
+	if !ok {
+		clientID = r.FormValue("client_id")
+		secret = r.FormValue("client_secret")
+	}
+	c, err := app.getOAuthClient(clientID)
+	if err != nil {
+		return writeOAuthError(w, http.StatusUnauthorized, "invalid_client", "Unknown client.")
+	}
+	secretSent, secretOK := c.authenticate(secret)
+	if secretSent && !secretOK {
+		return writeOAuthError(w, http.StatusUnauthorized, "invalid_client", "Incorrect client secret.")
+	}
+
+	var userID int64
+	var scope string
+	switch r.FormValue("grant_type") {
+	case "authorization_code":
+		code, err := app.useOAuthCode(hashToken(r.FormValue("code")))
+		if err != nil {
+			logError("Couldn't get OAuth code: %v", err)
+			return writeOAuthError(w, http.StatusInternalServerError, "server_error", "Couldn't check code.")
+		}
+		if code == nil || code.clientID != c.ID {
+			return writeOAuthError(w, http.StatusBadRequest, "invalid_grant", "Invalid or expired code.")
+		}
+		if r.FormValue("redirect_uri") != "" && r.FormValue("redirect_uri") != code.redirectURI {
+			return writeOAuthError(w, http.StatusBadRequest, "invalid_grant", "Redirect URI doesn't match.")
+		}
+		// Apps that can't keep a secret have to prove they started this flow
+		if code.challenge != "" || !secretSent {
+			if !code.verifyPKCE(r.FormValue("code_verifier")) {
+				return writeOAuthError(w, http.StatusBadRequest, "invalid_grant", "Invalid code verifier.")
+			}
+		}
+		userID, scope = code.userID, code.scope
+	case "refresh_token":
+		userID, scope, err = app.useRefreshToken(hashToken(r.FormValue("refresh_token")), c.ID)
+		if err != nil {
+			logError("Couldn't use refresh token: %v", err)
+			return writeOAuthError(w, http.StatusInternalServerError, "server_error", "Couldn't check refresh token.")
+		}
+		if userID == 0 {
+			return writeOAuthError(w, http.StatusBadRequest, "invalid_grant", "Invalid refresh token.")
+		}
+	default:
+		return writeOAuthError(w, http.StatusBadRequest, "unsupported_grant_type", "Only authorization_code and refresh_token grants are supported.")
+	}
+
+	token, err := generateToken()
+	if err != nil {
+		return err
+	}
+	refresh, err := generateToken()
+	if err != nil {
+		return err
+	}
+	err = app.createOAuthToken(userID, c, scope, hashToken(token), hashToken(refresh))
+	if err != nil {
+		return writeOAuthError(w, http.StatusInternalServerError, "server_error", "Couldn't create token.")
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	return json.NewEncoder(w).Encode(oauthTokenResponse{
+		AccessToken:  token,
+		TokenType:    "Bearer",
+		ExpiresIn:    c.tokenLifetime(),
+		RefreshToken: refresh,
+		Scope:        scope,
+		CreatedAt:    time.Now().Unix(),
+	})
+}
+
+// handleOAuthRevoke revokes an access or refresh token, as defined by RFC
+// 7009.
+func handleOAuthRevoke(app *app, w http.ResponseWriter, r *http.Request) error {
+	clientID, secret, ok := r.BasicAuth()
+	if !ok {
+		clientID = r.FormValue("client_id")
+		secret = r.FormValue("client_secret")
+	}
+	c, err := app.getOAuthClient(clientID)
+	if err != nil {
+		return writeOAuthError(w, http.StatusUnauthorized, "invalid_client", "Unknown client.")
+	}
+	if sent, ok := c.authenticate(secret); sent && !ok {
+		return writeOAuthError(w, http.StatusUnauthorized, "invalid_client", "Incorrect client secret.")
+	}
+
+	err = app.revokeOAuthToken(hashToken(r.FormValue("token")), c.ID)
+	if err != nil {
+		logError("Couldn't revoke OAuth token: %v", err)
+		return writeOAuthError(w, http.StatusServiceUnavailable, "server_error", "Couldn't revoke token.")
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Write([]byte("{}"))
+	return nil
+}
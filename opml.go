@@ -0,0 +1,116 @@
+package readas
+
+import (
+	"encoding/xml"
+	"github.com/writeas/impart"
+	"io"
+	"net/http"
+	"time"
+)
+
+// opmlTypeActivityPub marks outlines for fediverse accounts in exported OPML
+// files, so they can be followed again on import.
+const opmlTypeActivityPub = "activitypub"
+
+type opml struct {
+	XMLName xml.Name      `xml:"opml"`
+	Version string        `xml:"version,attr"`
+	Title   string        `xml:"head>title"`
+	Created string        `xml:"head>dateCreated,omitempty"`
+	Body    []opmlOutline `xml:"body>outline"`
+}
+
+type opmlOutline struct {
+	Text     string        `xml:"text,attr"`
+	Title    string        `xml:"title,attr,omitempty"`
+	Type     string        `xml:"type,attr,omitempty"`
+	XMLURL   string        `xml:"xmlUrl,attr,omitempty"`
+	HTMLURL  string        `xml:"htmlUrl,attr,omitempty"`
+	Handle   string        `xml:"handle,attr,omitempty"`
+	Outlines []opmlOutline `xml:"outline"`
+}
+
+// parseOPML returns everyone to follow in an OPML file, including outlines
+// nested in folders.
+func parseOPML(r io.Reader) ([]importEntry, error) {
+	doc := opml{}
+	d := xml.NewDecoder(r)
+	d.Strict = false
+	err := d.Decode(&doc)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := []importEntry{}
+	var add func(outlines []opmlOutline)
+	add = func(outlines []opmlOutline) {
+		for _, o := range outlines {
+			title := o.Title
+			if title == "" {
+				title = o.Text
+			}
+			switch {
+			case o.Handle != "":
+				entries = append(entries, importEntry{Target: o.Handle, Title: title})
+			case o.XMLURL != "" && o.Type != opmlTypeActivityPub:
+				entries = append(entries, importEntry{Target: o.XMLURL, Title: title})
+			}
+			add(o.Outlines)
+		}
+	}
+	add(doc.Body)
+	return entries, nil
+}
+
+// handleExportOPML downloads everyone the user follows as an OPML file, with
+// fediverse accounts and feeds in separate folders.
+func handleExportOPML(app *app, w http.ResponseWriter, r *http.Request) error {
+	cu := getUserSession(app, r)
+	if cu == nil {
+		return impart.HTTPError{http.StatusUnauthorized, "Not logged in."}
+	}
+
+	users, err := app.getFollowingUsers(cu.ID)
+	if err != nil {
+		return err
+	}
+	fediverse := opmlOutline{Text: "Fediverse"}
+	feeds := opmlOutline{Text: "Feeds"}
+	for _, u := range *users {
+		o := opmlOutline{
+			Text:    u.Name,
+			Title:   u.Name,
+			XMLURL:  u.BaseObject.ID,
+			HTMLURL: u.URL,
+		}
+		if o.Text == "" {
+			o.Text = u.PreferredUsername
+		}
+		if u.Type == feedUserType {
+			o.Type = "rss"
+			feeds.Outlines = append(feeds.Outlines, o)
+			continue
+		}
+		o.Type = opmlTypeActivityPub
+		if u.Host != "" {
+			o.Handle = u.PreferredUsername + "@" + u.Host
+		}
+		fediverse.Outlines = append(fediverse.Outlines, o)
+	}
+
+	doc := opml{
+		Version: "2.0",
+		Title:   cu.PreferredUsername + "'s subscriptions on " + app.cfg.Name,
+		Created: time.Now().UTC().Format(time.RFC1123Z),
+		Body:    []opmlOutline{fediverse, feeds},
+	}
+	w.Header().Set("Content-Type", "text/x-opml; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+cu.PreferredUsername+`-subscriptions.opml"`)
+	_, err = io.WriteString(w, xml.Header)
+	if err != nil {
+		return err
+	}
+	e := xml.NewEncoder(w)
+	e.Indent("", "  ")
+	return e.Encode(doc)
+}
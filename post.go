@@ -1,35 +1,193 @@
 package readas
 
 import (
+	"encoding/json"
+	"fmt"
 	"github.com/gorilla/mux"
-	"github.com/microcosm-cc/bluemonday"
+	"github.com/writeas/impart"
+	"html"
 	"html/template"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 )
 
+// summaryLength is the most characters of a post's text shown in excerpts.
+const summaryLength = 280
+
 type Post struct {
-	ID         int64
-	OwnerID    int64
-	ActivityID string
-	Type       string
-	Published  time.Time
-	URL        string
-	Name       string
-	Content    string
+	ID         int64     `json:"id"`
+	OwnerID    int64     `json:"-"`
+	ActivityID string    `json:"activity_id"`
+	Type       string    `json:"type"`
+	Published  time.Time `json:"published"`
+	URL        string    `json:"url"`
+	Name       string    `json:"name,omitempty"`
+	Content    string    `json:"content"`
+	// Warning is the content warning the post is hidden behind, from its
+	// summary
+	Warning   string `json:"content_warning,omitempty"`
+	Sensitive bool   `json:"sensitive"`
 
 	actorID  string
-	IsInFeed bool
+	IsInFeed bool `json:"-"`
+	IsRead   bool `json:"read"`
+	IsSaved  bool `json:"saved"`
+	Deleted  bool `json:"deleted,omitempty"`
+	// ExpandWarning shows the post opened up, even when it has a content
+	// warning, for readers who prefer that
+	ExpandWarning bool `json:"-"`
+
+	// Media are the videos, audio and images the post consists of
+	Media []Attachment `json:"media,omitempty"`
+	// Options are a Question's choices
+	Options  []PollOption `json:"options,omitempty"`
+	Multiple bool         `json:"multiple,omitempty"`
+	// Start and End are when an Event happens, or End is when a Question
+	// closes
+	Start    time.Time `json:"-"`
+	End      time.Time `json:"-"`
+	Location string    `json:"location,omitempty"`
+
+	Owner *User `json:"owner"`
+}
+
+// Attachment is a media file that's part of a post.
+type Attachment struct {
+	URL       string `json:"url"`
+	MediaType string `json:"media_type"`
+	// Name is the file's alt text
+	Name     string `json:"name,omitempty"`
+	Width    int    `json:"width,omitempty"`
+	Height   int    `json:"height,omitempty"`
+	Blurhash string `json:"blurhash,omitempty"`
+}
+
+// ProxyURL returns where readers load the file from: the media proxy for
+// images, or the file's own URL.
+func (a Attachment) ProxyURL() string {
+	if !a.IsImage() {
+		return a.URL
+	}
+	return proxyURL(a.URL)
+}
+
+func (a Attachment) IsImage() bool {
+	return strings.HasPrefix(a.MediaType, "image/")
+}
+
+func (a Attachment) IsVideo() bool {
+	return strings.HasPrefix(a.MediaType, "video/")
+}
+
+func (a Attachment) IsAudio() bool {
+	return strings.HasPrefix(a.MediaType, "audio/")
+}
 
-	Owner *User
+// PollOption is one of the choices in a Question.
+type PollOption struct {
+	Name    string `json:"name"`
+	Votes   int    `json:"votes"`
+	Percent int    `json:"-"`
 }
 
+// postTypes are the ActivityStreams object types we store as posts, along
+// with what readers call them.
+var postTypes = []struct {
+	Type  string
+	Label string
+}{
+	{"Article", "Articles"},
+	{"Page", "Pages"},
+	{"Note", "Notes"},
+	{"Image", "Images"},
+	{"Video", "Videos"},
+	{"Audio", "Audio"},
+	{"Document", "Documents"},
+	{"Event", "Events"},
+	{"Question", "Polls"},
+}
+
+func isPostType(t interface{}) bool {
+	for _, pt := range postTypes {
+		if t == pt.Type {
+			return true
+		}
+	}
+	return false
+}
+
+// Images returns the post's image attachments.
+func (p *Post) Images() []Attachment {
+	return p.mediaOf(Attachment.IsImage)
+}
+
+// Videos returns the post's video attachments, which are usually the same
+// video in different formats and sizes.
+func (p *Post) Videos() []Attachment {
+	return p.mediaOf(Attachment.IsVideo)
+}
+
+// Audio returns the post's audio attachments.
+func (p *Post) Audio() []Attachment {
+	return p.mediaOf(Attachment.IsAudio)
+}
+
+func (p *Post) mediaOf(is func(Attachment) bool) []Attachment {
+	media := []Attachment{}
+	for _, a := range p.Media {
+		if is(a) {
+			media = append(media, a)
+		}
+	}
+	return media
+}
+
+// HasWarning returns whether the post should be hidden until the reader
+// chooses to see it.
+func (p *Post) HasWarning() bool {
+	return p.Warning != "" || p.Sensitive
+}
+
+// TotalVotes returns the number of votes on all of a Question's options.
+func (p *Post) TotalVotes() int {
+	total := 0
+	for _, o := range p.Options {
+		total += o.Votes
+	}
+	return total
+}
+
+// IsClosed returns whether a Question stopped taking votes.
+func (p *Post) IsClosed() bool {
+	return !p.End.IsZero() && p.End.Before(time.Now())
+}
+
+// MarshalJSON encodes the post for API clients, with its content sanitized
+// the same way it is for display.
+func (p Post) MarshalJSON() ([]byte, error) {
+	type post Post
+	pp := post(p)
+	pp.Content = string(p.SanitaryContent())
+	pp.Media = make([]Attachment, len(p.Media))
+	for i, a := range p.Media {
+		a.URL = a.ProxyURL()
+		pp.Media[i] = a
+	}
+	return json.Marshal(pp)
+}
+
+// SanitaryContent returns the post's content as safe HTML, with its images
+// loaded through the media proxy and its embeds behind placeholders.
 func (p *Post) SanitaryContent() template.HTML {
-	// Strip out bad HTML
-	policy := getSanitizationPolicy()
-	policy.RequireNoFollowOnLinks(true)
-	return template.HTML(policy.Sanitize(p.Content))
+	return template.HTML(placeholdEmbeds(proxyImages(string(p.OriginalContent()))))
+}
+
+// OriginalContent returns the post's content as safe HTML, with its images
+// still pointing where they're hosted, for exports.
+func (p *Post) OriginalContent() template.HTML {
+	return sanitize(p.Content)
 }
 
 func (p *Post) DisplayTitle() string {
@@ -40,9 +198,22 @@ func (p *Post) DisplayTitle() string {
 	return t + " by " + p.Owner.Name
 }
 
+// Summary returns the start of the post's text, without any HTML, for
+// excerpts. Posts with a content warning are summed up by their warning.
 func (p *Post) Summary() string {
-	// TODO: return truncated summary of post.
-	return ""
+	if p.Warning != "" {
+		return p.Warning
+	}
+	text := html.UnescapeString(textPolicy.Sanitize(strings.Replace(p.Content, "</p>", "</p> ", -1)))
+	text = strings.Join(strings.Fields(text), " ")
+	if len([]rune(text)) <= summaryLength {
+		return text
+	}
+	text = string([]rune(text)[:summaryLength])
+	if i := strings.LastIndexByte(text, ' '); i > 0 {
+		text = text[:i]
+	}
+	return strings.TrimRight(text, ".,;:!? ") + "…"
 }
 
 func (p *Post) PublishedDate() string {
@@ -53,18 +224,6 @@ func (p *Post) Published8601() string {
 	return p.Published.Format("2006-01-02T15:04:05Z")
 }
 
-func getSanitizationPolicy() *bluemonday.Policy {
-	policy := bluemonday.UGCPolicy()
-	policy.AllowAttrs("src", "style").OnElements("iframe", "video")
-	policy.AllowAttrs("frameborder", "width", "height").Matching(bluemonday.Integer).OnElements("iframe")
-	policy.AllowAttrs("allowfullscreen").OnElements("iframe")
-	policy.AllowAttrs("controls", "loop", "muted", "autoplay").OnElements("video")
-	policy.AllowAttrs("target").OnElements("a")
-	policy.AllowAttrs("style", "class", "id").Globally()
-	policy.AllowURLSchemes("http", "https", "mailto", "xmpp")
-	return policy
-}
-
 func handleViewPost(app *app, w http.ResponseWriter, r *http.Request) error {
 	vars := mux.Vars(r)
 	idStr := vars["id"]
@@ -86,17 +245,77 @@ func handleViewPost(app *app, w http.ResponseWriter, r *http.Request) error {
 		User         *LocalUser
 		Version      string
 		InstanceName string
+		CSRFToken    string
 		Post         *Post
 	}{
 		User:         u,
 		Version:      softwareVersion,
 		InstanceName: app.cfg.Name,
+		CSRFToken:    csrfToken(app, r),
 		Post:         &Post{},
 	}
-	p.Post, err = app.getPost(int64(id))
+	var userID int64
+	if u != nil {
+		userID = u.ID
+	}
+	p.Post, err = app.getPost(int64(id), userID)
 	if err != nil {
 		return err
 	}
+	if p.Post.Owner.Host != "" && !p.Post.Deleted {
+		go checkPostDeleted(app, p.Post.ActivityID)
+	}
+	p.Post.ExpandWarning = u != nil && u.ExpandWarnings
+	if u != nil && !p.Post.IsRead {
+		err = app.setPostRead(u.ID, p.Post.ID, true)
+		if err != nil {
+			logError("Couldn't mark post read: %v", err)
+		}
+	}
 
 	return renderTemplate(w, "post", p)
 }
+
+// handleSavePost saves a post for the logged-in user to read later, or
+// unsaves it when sent as a DELETE or to the web UI's unsave URL.
+func handleSavePost(app *app, w http.ResponseWriter, r *http.Request) error {
+	return setPostState(app, w, r, app.setPostSaved, "/unsave")
+}
+
+// handleMarkPostRead marks a post as read or, when sent as a DELETE or to the
+// web UI's unread URL, as unread.
+func handleMarkPostRead(app *app, w http.ResponseWriter, r *http.Request) error {
+	return setPostState(app, w, r, app.setPostRead, "/unread")
+}
+
+func setPostState(app *app, w http.ResponseWriter, r *http.Request, set func(userID, postID int64, on bool) error, offSuffix string) error {
+	cu := getUserSession(app, r)
+	if cu == nil {
+		return impart.HTTPError{http.StatusUnauthorized, "Not logged in."}
+	}
+
+	vars := mux.Vars(r)
+	id, err := strconv.ParseInt(vars["id"], 10, 64)
+	if err != nil {
+		return impart.HTTPError{http.StatusBadRequest, "Invalid post ID."}
+	}
+	p, err := app.getPost(id, cu.ID)
+	if err != nil {
+		return err
+	}
+
+	on := r.Method != "DELETE" && !strings.HasSuffix(r.URL.Path, offSuffix)
+	err = set(cu.ID, p.ID, on)
+	if err != nil {
+		return err
+	}
+
+	if strings.HasPrefix(r.URL.Path, "/api") {
+		p, err = app.getPost(id, cu.ID)
+		if err != nil {
+			return err
+		}
+		return impart.WriteSuccess(w, p, http.StatusOK)
+	}
+	return impart.HTTPError{http.StatusFound, fmt.Sprintf("/p/%d", p.ID)}
+}
@@ -0,0 +1,416 @@
+package readas
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/writeas/impart"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Remote images are shown through a media proxy on our own host, so readers'
+// browsers never contact the servers posts come from, and images keep working
+// after those servers remove them. Proxy URLs are signed, so the proxy only
+// fetches images we pointed it at.
+
+const (
+	maxProxyImageSize   = 10 << 20
+	defaultMediaCacheMB = 1024
+	proxyFetchTimeout   = 30 * time.Second
+	// maxProxyFetches is how many images the proxy downloads at once, since
+	// each is held in memory until it's checked
+	maxProxyFetches = 8
+	// mediaTouchInterval is how often we record that a cached image was used
+	mediaTouchInterval = time.Hour
+)
+
+// proxyImageTypes are the image formats the proxy serves. SVG is left out,
+// since it can carry scripts.
+var proxyImageTypes = map[string]bool{
+	"image/jpeg": true,
+	"image/png":  true,
+	"image/gif":  true,
+	"image/webp": true,
+	"image/bmp":  true,
+}
+
+// privateNets are the addresses the proxy won't fetch from, so signed URLs
+// can't reach services on our own network.
+var privateNets = parseCIDRs(
+	"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "127.0.0.0/8", "169.254.0.0/16",
+	"172.16.0.0/12", "192.0.0.0/24", "192.168.0.0/16", "198.18.0.0/15", "240.0.0.0/4",
+	"::/128", "::1/128", "64:ff9b::/96", "fc00::/7", "fe80::/10",
+)
+
+// publicTransport only connects to public addresses. It never goes through
+// an HTTP proxy from the environment, which would skip that check.
+var publicTransport = &http.Transport{
+	DialContext:         dialPublic,
+	TLSHandshakeTimeout: 10 * time.Second,
+}
+
+var proxyClient = &http.Client{
+	Timeout:   proxyFetchTimeout,
+	Transport: publicTransport,
+}
+
+// proxyFetches limits how many images are downloaded at once.
+var proxyFetches = make(chan struct{}, maxProxyFetches)
+
+// mediaProxy signs the URLs of proxied images. It's nil until the server
+// starts, so command line exports keep images pointing where they're hosted.
+var mediaProxy *proxySigner
+
+// evictMu keeps more than one eviction from running at once.
+var evictMu sync.Mutex
+
+type proxySigner struct {
+	host string
+	key  []byte
+}
+
+type cachedMedia struct {
+	ID        string
+	URL       string
+	MediaType string
+	Size      int64
+	Fetched   time.Time
+}
+
+func initMediaProxy(app *app) {
+	if app.cfg.MediaCacheMB <= 0 {
+		app.cfg.MediaCacheMB = defaultMediaCacheMB
+	}
+	mediaProxy = &proxySigner{
+		host: app.cfg.Host,
+		key:  app.keys.proxyKey,
+	}
+}
+
+func (s *proxySigner) sign(src string) string {
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write([]byte(src))
+	return hex.EncodeToString(mac.Sum(nil))[:32]
+}
+
+// proxyURL returns the local URL the given remote image is served from.
+// Anything that isn't a remote http(s) URL is returned as it is.
+func proxyURL(src string) string {
+	if mediaProxy == nil || src == "" || strings.HasPrefix(src, mediaProxy.host+"/") {
+		return src
+	}
+	if !strings.HasPrefix(src, "https://") && !strings.HasPrefix(src, "http://") {
+		return src
+	}
+	return mediaProxy.host + "/proxy/" + mediaProxy.sign(src) + "/" + base64.RawURLEncoding.EncodeToString([]byte(src))
+}
+
+// proxyImages points the images in the given sanitized HTML at the media
+// proxy.
+func proxyImages(content string) string {
+	if mediaProxy == nil || !strings.Contains(content, "<img") {
+		return content
+	}
+	var buf bytes.Buffer
+	z := html.NewTokenizer(strings.NewReader(content))
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			return buf.String()
+		}
+		if tt != html.StartTagToken && tt != html.SelfClosingTagToken {
+			buf.Write(z.Raw())
+			continue
+		}
+		raw := string(z.Raw())
+		t := z.Token()
+		if t.DataAtom != atom.Img {
+			buf.WriteString(raw)
+			continue
+		}
+		attrs := t.Attr[:0]
+		for _, a := range t.Attr {
+			switch a.Key {
+			case "src":
+				a.Val = proxyURL(a.Val)
+			case "srcset":
+				// Would load the other sizes straight from their host
+				continue
+			}
+			attrs = append(attrs, a)
+		}
+		t.Attr = attrs
+		buf.WriteString(t.String())
+	}
+}
+
+// postImages returns the URLs of every image in a post.
+func postImages(p *Post) []string {
+	srcs := []string{}
+	z := html.NewTokenizer(strings.NewReader(string(p.OriginalContent())))
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			break
+		}
+		if tt != html.StartTagToken && tt != html.SelfClosingTagToken {
+			continue
+		}
+		t := z.Token()
+		if t.DataAtom != atom.Img {
+			continue
+		}
+		for _, a := range t.Attr {
+			if a.Key == "src" {
+				srcs = append(srcs, a.Val)
+			}
+		}
+	}
+	for _, a := range p.Images() {
+		srcs = append(srcs, a.URL)
+	}
+	return srcs
+}
+
+// handleProxyMedia serves a remote image from the cache, fetching it the
+// first time it's asked for.
+func handleProxyMedia(app *app, w http.ResponseWriter, r *http.Request) error {
+	vars := mux.Vars(r)
+	src, err := base64.RawURLEncoding.DecodeString(vars["url"])
+	if err != nil || mediaProxy == nil || !hmac.Equal([]byte(vars["sig"]), []byte(mediaProxy.sign(string(src)))) {
+		return impart.HTTPError{http.StatusNotFound, "Image not found."}
+	}
+
+	m, err := app.cacheMedia(string(src))
+	if err != nil {
+		logInfo("Couldn't proxy %s: %v", src, err)
+		return impart.HTTPError{http.StatusBadGateway, "Couldn't load image."}
+	}
+	f, err := os.Open(app.mediaCachePath(m.ID))
+	if err != nil {
+		logError("Couldn't open cached image: %v", err)
+		return impart.HTTPError{http.StatusInternalServerError, "Couldn't load image."}
+	}
+	defer f.Close()
+
+	w.Header().Set("Content-Type", m.MediaType)
+	w.Header().Set("Cache-Control", "public, max-age=604800")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; sandbox")
+	http.ServeContent(w, r, "", m.Fetched, f)
+	return nil
+}
+
+func (app *app) mediaCachePath(id string) string {
+	return filepath.Join(app.cfg.MediaDir, "cache", id[:2], id)
+}
+
+// cacheMedia returns our copy of the image at src, fetching it if we don't
+// have it yet.
+func (app *app) cacheMedia(src string) (*cachedMedia, error) {
+	sum := sha256.Sum256([]byte(src))
+	id := hex.EncodeToString(sum[:])
+	m, err := app.getCachedMedia(id)
+	if err == nil {
+		if _, err = os.Stat(app.mediaCachePath(id)); err == nil {
+			app.touchCachedMedia(id)
+			return m, nil
+		}
+		// The file was removed by hand, so get it again
+	} else if err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	m, err = app.fetchMedia(id, src)
+	if err != nil {
+		return nil, err
+	}
+	err = app.addCachedMedia(m)
+	if err != nil {
+		return nil, err
+	}
+	go app.evictMedia()
+	return m, nil
+}
+
+// fetchMedia downloads the image at src into the cache, if it's an image we
+// serve.
+func (app *app) fetchMedia(id, src string) (*cachedMedia, error) {
+	u, err := url.Parse(src)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, fmt.Errorf("unsupported image URL")
+	}
+	req, err := http.NewRequest("GET", src, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", userAgent)
+	proxyFetches <- struct{}{}
+	defer func() { <-proxyFetches }()
+	resp, err := proxyClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status %d", resp.StatusCode)
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxProxyImageSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxProxyImageSize {
+		return nil, fmt.Errorf("image too large")
+	}
+	// Trust the file, not what the server says it is
+	mediaType := http.DetectContentType(data)
+	if !proxyImageTypes[mediaType] {
+		return nil, fmt.Errorf("unsupported image type %s", mediaType)
+	}
+
+	path := app.mediaCachePath(id)
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return nil, err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), id+".tmp")
+	if err != nil {
+		return nil, err
+	}
+	_, err = tmp.Write(data)
+	if cErr := tmp.Close(); err == nil {
+		err = cErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return nil, err
+	}
+	return &cachedMedia{
+		ID:        id,
+		URL:       src,
+		MediaType: mediaType,
+		Size:      int64(len(data)),
+		Fetched:   time.Now(),
+	}, nil
+}
+
+// evictMedia deletes the least recently used images until the cache fits in
+// its quota. Images in saved posts are never evicted.
+func (app *app) evictMedia() {
+	evictMu.Lock()
+	defer evictMu.Unlock()
+
+	quota := int64(app.cfg.MediaCacheMB) << 20
+	total, err := app.getMediaCacheSize()
+	if err != nil {
+		return
+	}
+	for total > quota {
+		media, err := app.getEvictableMedia(100)
+		if err != nil || len(media) == 0 {
+			return
+		}
+		for _, m := range media {
+			err = os.Remove(app.mediaCachePath(m.ID))
+			if err != nil && !os.IsNotExist(err) {
+				logError("Couldn't remove cached image %s: %v", m.ID, err)
+				return
+			}
+			err = app.deleteCachedMedia(m.ID)
+			if err != nil {
+				return
+			}
+			total -= m.Size
+			if total <= quota {
+				break
+			}
+		}
+	}
+}
+
+// pinPostMedia caches the images in a post someone saved, and keeps them
+// from being evicted for as long as anyone has the post saved.
+func pinPostMedia(app *app, postID int64) {
+	if mediaProxy == nil {
+		return
+	}
+	p, err := app.getPost(postID, 0)
+	if err != nil {
+		logError("Couldn't get saved post %d: %v", postID, err)
+		return
+	}
+	for _, src := range postImages(p) {
+		if strings.HasPrefix(src, mediaProxy.host+"/") {
+			continue
+		}
+		m, err := app.cacheMedia(src)
+		if err != nil {
+			logInfo("Couldn't cache %s for saved post %d: %v", src, postID, err)
+			continue
+		}
+		app.pinMedia(postID, m.ID)
+	}
+}
+
+// dialPublic connects to the given address, unless it's on a private
+// network.
+func dialPublic(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	d := &net.Dialer{Timeout: 10 * time.Second}
+	for _, ip := range ips {
+		if isPrivateIP(ip.IP) {
+			continue
+		}
+		return d.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+	}
+	return nil, fmt.Errorf("%s has no public address", host)
+}
+
+func isPrivateIP(ip net.IP) bool {
+	for _, n := range privateNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return ip.IsMulticast()
+}
+
+func parseCIDRs(cidrs ...string) []*net.IPNet {
+	nets := []*net.IPNet{}
+	for _, c := range cidrs {
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			panic(err)
+		}
+		nets = append(nets, n)
+	}
+	return nets
+}
@@ -0,0 +1,257 @@
+package readas
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"github.com/gorilla/mux"
+	"github.com/writeas/impart"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Each user can read their Read.as feed in other apps through private Atom and
+// RSS feeds, at URLs with a secret token in them.
+
+const (
+	feedPageSize    = 10
+	feedCacheMaxAge = 5 * time.Minute
+)
+
+type atomLink struct {
+	Rel  string `xml:"rel,attr,omitempty"`
+	Type string `xml:"type,attr,omitempty"`
+	Href string `xml:"href,attr"`
+}
+
+type atomPerson struct {
+	Name string `xml:"name"`
+	URI  string `xml:"uri,omitempty"`
+}
+
+type atomContent struct {
+	Type string `xml:"type,attr"`
+	Body string `xml:",chardata"`
+}
+
+type atomEntry struct {
+	Title     string      `xml:"title"`
+	ID        string      `xml:"id"`
+	Published string      `xml:"published"`
+	Updated   string      `xml:"updated"`
+	Links     []atomLink  `xml:"link"`
+	Author    atomPerson  `xml:"author"`
+	Content   atomContent `xml:"content"`
+}
+
+type atomFeed struct {
+	XMLName   xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Title     string      `xml:"title"`
+	ID        string      `xml:"id"`
+	Updated   string      `xml:"updated"`
+	Generator string      `xml:"generator"`
+	Links     []atomLink  `xml:"link"`
+	Entries   []atomEntry `xml:"entry"`
+}
+
+type rssGUID struct {
+	IsPermaLink bool   `xml:"isPermaLink,attr"`
+	Value       string `xml:",chardata"`
+}
+
+type rssItem struct {
+	Title       string  `xml:"title"`
+	Link        string  `xml:"link"`
+	GUID        rssGUID `xml:"guid"`
+	PubDate     string  `xml:"pubDate"`
+	Creator     string  `xml:"dc:creator"`
+	Description string  `xml:"description"`
+}
+
+type rssChannel struct {
+	Title         string     `xml:"title"`
+	Link          string     `xml:"link"`
+	Description   string     `xml:"description"`
+	LastBuildDate string     `xml:"lastBuildDate,omitempty"`
+	Generator     string     `xml:"generator"`
+	Links         []atomLink `xml:"atom:link"`
+	Items         []rssItem  `xml:"item"`
+}
+
+type rssFeed struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	AtomNS  string     `xml:"xmlns:atom,attr"`
+	DCNS    string     `xml:"xmlns:dc,attr"`
+	Channel rssChannel `xml:"channel"`
+}
+
+// feedLinks returns the links between pages of a feed, as described in RFC
+// 5005.
+func feedLinks(self string, page, count int) []atomLink {
+	links := []atomLink{
+		{Rel: "self", Href: self + "?page=" + strconv.Itoa(page)},
+		{Rel: "first", Href: self},
+	}
+	if page > 1 {
+		links = append(links, atomLink{Rel: "previous", Href: self + "?page=" + strconv.Itoa(page-1)})
+	}
+	if count == feedPageSize {
+		links = append(links, atomLink{Rel: "next", Href: self + "?page=" + strconv.Itoa(page+1)})
+	}
+	return links
+}
+
+func postTitle(p *Post) string {
+	if p.Name != "" {
+		return p.Name
+	}
+	return p.DisplayTitle()
+}
+
+func atomReaderFeed(app *app, u *LocalUser, self string, page int, posts []Post, updated time.Time) interface{} {
+	f := &atomFeed{
+		Title:     u.Name + "'s feed on " + app.cfg.Name,
+		ID:        self,
+		Updated:   updated.Format(time.RFC3339),
+		Generator: serverName,
+		Links: append(feedLinks(self, page, len(posts)), atomLink{
+			Rel:  "alternate",
+			Type: "text/html",
+			Href: app.cfg.Host + "/",
+		}),
+		Entries: []atomEntry{},
+	}
+	for i := range posts {
+		p := &posts[i]
+		f.Entries = append(f.Entries, atomEntry{
+			Title:     postTitle(p),
+			ID:        p.ActivityID,
+			Published: p.Published.UTC().Format(time.RFC3339),
+			Updated:   p.Published.UTC().Format(time.RFC3339),
+			Links:     []atomLink{{Rel: "alternate", Type: "text/html", Href: p.URL}},
+			Author:    atomPerson{Name: p.Owner.Name, URI: p.Owner.URL},
+			Content:   atomContent{Type: "html", Body: string(p.SanitaryContent())},
+		})
+	}
+	return f
+}
+
+func rssReaderFeed(app *app, u *LocalUser, self string, page int, posts []Post, updated time.Time) interface{} {
+	f := &rssFeed{
+		Version: "2.0",
+		AtomNS:  "http://www.w3.org/2005/Atom",
+		DCNS:    "http://purl.org/dc/elements/1.1/",
+		Channel: rssChannel{
+			Title:         u.Name + "'s feed on " + app.cfg.Name,
+			Link:          app.cfg.Host + "/",
+			Description:   "Posts from everyone " + u.Name + " follows on " + app.cfg.Name + ".",
+			LastBuildDate: updated.Format(time.RFC1123Z),
+			Generator:     serverName,
+			Links:         feedLinks(self, page, len(posts)),
+			Items:         []rssItem{},
+		},
+	}
+	for i := range posts {
+		p := &posts[i]
+		f.Channel.Items = append(f.Channel.Items, rssItem{
+			Title:       postTitle(p),
+			Link:        p.URL,
+			GUID:        rssGUID{Value: p.ActivityID},
+			PubDate:     p.Published.UTC().Format(time.RFC1123Z),
+			Creator:     p.Owner.Name,
+			Description: string(p.SanitaryContent()),
+		})
+	}
+	return f
+}
+
+// handleViewReaderFeed serves a page of the user's feed as Atom or RSS.
+// Responses can be cached, and are revalidated with their ETag or
+// Last-Modified date.
+func handleViewReaderFeed(app *app, w http.ResponseWriter, r *http.Request) error {
+	vars := mux.Vars(r)
+	u, err := app.getFeedTokenUser(vars["token"])
+	if err != nil {
+		return err
+	}
+
+	page := apiPage(r)
+	posts, err := app.getUserFeed(u.ID, page)
+	if err != nil {
+		return err
+	}
+	updated := time.Unix(0, 0).UTC()
+	for _, p := range *posts {
+		if p.Published.After(updated) {
+			updated = p.Published.UTC()
+		}
+	}
+
+	self := app.cfg.Host + "/feed/" + u.FeedToken + "." + vars["format"]
+	var doc interface{}
+	contentType := "application/atom+xml"
+	if vars["format"] == "rss" {
+		doc = rssReaderFeed(app, u, self, page, *posts, updated)
+		contentType = "application/rss+xml"
+	} else {
+		doc = atomReaderFeed(app, u, self, page, *posts, updated)
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header)
+	e := xml.NewEncoder(&buf)
+	e.Indent("", "  ")
+	err = e.Encode(doc)
+	if err != nil {
+		return err
+	}
+
+	h := sha256.Sum256(buf.Bytes())
+	etag := `"` + hex.EncodeToString(h[:16]) + `"`
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Last-Modified", updated.Format(http.TimeFormat))
+	w.Header().Set("Cache-Control", "private, max-age="+strconv.Itoa(int(feedCacheMaxAge.Seconds())))
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		if inm == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return nil
+		}
+	} else if ims, err := http.ParseTime(r.Header.Get("If-Modified-Since")); err == nil && !updated.Truncate(time.Second).After(ims) {
+		w.WriteHeader(http.StatusNotModified)
+		return nil
+	}
+
+	w.Header().Set("Content-Type", contentType+"; charset=utf-8")
+	_, err = buf.WriteTo(w)
+	return err
+}
+
+// handleResetFeedToken creates a new secret URL for the user's private feeds,
+// or turns them off. Either way, the old URLs stop working.
+func handleResetFeedToken(app *app, w http.ResponseWriter, r *http.Request) error {
+	cu := getUserSession(app, r)
+	if cu == nil || getTokenAuth(r) != nil {
+		return impart.HTTPError{http.StatusUnauthorized, "Not logged in."}
+	}
+
+	token := ""
+	msg := "Private feeds turned off."
+	if r.FormValue("disable") == "" {
+		var err error
+		token, err = generateToken()
+		if err != nil {
+			return err
+		}
+		msg = "Created new private feed URLs. Any old ones no longer work."
+	}
+	err := app.setFeedToken(cu.ID, token)
+	if err != nil {
+		return impart.HTTPError{http.StatusInternalServerError, "Couldn't update private feeds."}
+	}
+
+	addSessionFlash(app, w, r, msg)
+	return impart.HTTPError{http.StatusFound, "/settings"}
+}
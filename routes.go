@@ -4,7 +4,9 @@ import (
 	"github.com/gorilla/mux"
 	"github.com/writeas/go-nodeinfo"
 	"github.com/writeas/go-webfinger"
+	"github.com/writeas/impart"
 	"net/http"
+	"path/filepath"
 )
 
 func initRoutes(app *app) {
@@ -25,6 +27,7 @@ func initRoutes(app *app) {
 
 	api := app.router.PathPrefix("/api/").Subrouter()
 	api.HandleFunc("/auth/login", app.handler(handleLogin)).Methods("POST")
+	api.HandleFunc("/auth/2fa", app.handler(handleTwoFactorLogin)).Methods("POST")
 	api.HandleFunc("/collections/{alias}", app.handler(handleFetchUser)).Methods("GET")
 	collectionsAPI := api.PathPrefix("/collections/{alias}").Subrouter()
 	collectionsAPI.HandleFunc("/", app.handler(handleFetchUser)).Methods("GET")
@@ -33,12 +36,76 @@ func initRoutes(app *app) {
 	collectionsAPI.HandleFunc("/following", app.handler(handleFetchFollowing)).Methods("GET")
 	collectionsAPI.HandleFunc("/followers", app.handler(handleFetchFollowers)).Methods("GET")
 
-	api.HandleFunc("/follow", app.handler(handleFollowUser))
-	api.HandleFunc("/inbox", app.handler(handleFetchInbox))
+	api.HandleFunc("/me", app.handler(handleFetchMe)).Methods("GET")
+	api.HandleFunc("/me", app.handler(handleUpdateProfile)).Methods("POST")
+	api.HandleFunc("/me/password", app.handler(handleChangePassword)).Methods("POST")
+	api.HandleFunc("/feed", app.handler(handleFetchFeed)).Methods("GET")
+	api.HandleFunc("/saved", app.handler(handleFetchSaved)).Methods("GET")
+	api.HandleFunc("/posts/{id:[0-9]+}", app.handler(handleFetchPost)).Methods("GET")
+	api.HandleFunc("/posts/{id:[0-9]+}/read", app.handler(handleMarkPostRead)).Methods("POST", "DELETE")
+	api.HandleFunc("/posts/{id:[0-9]+}/save", app.handler(handleSavePost)).Methods("POST", "DELETE")
+	api.HandleFunc("/following", app.handler(handleFetchFollowingUsers)).Methods("GET")
+	api.HandleFunc("/follow", app.handler(handleFollowUser)).Methods("POST")
+	api.HandleFunc("/unfollow", app.handler(handleUnfollowUser)).Methods("POST")
+	api.HandleFunc("/inbox", app.handler(handleFetchInbox)).Methods("POST")
+	api.HandleFunc("/oauth/apps", app.handler(handleRegisterOAuthClient)).Methods("POST")
 
-	app.router.HandleFunc("/logout", app.handler(handleLogout))
+	// Mastodon-compatible API
+	api.HandleFunc("/v1/apps", app.handler(handleMastodonRegisterApp)).Methods("POST")
+	api.HandleFunc("/v1/instance", app.handler(handleMastodonInstance)).Methods("GET")
+	api.HandleFunc("/v1/accounts/verify_credentials", app.handler(handleMastodonVerifyCredentials)).Methods("GET")
+	api.HandleFunc("/v1/accounts/lookup", app.handler(handleMastodonLookupAccount)).Methods("GET")
+	api.HandleFunc("/v1/accounts/relationships", app.handler(handleMastodonRelationships)).Methods("GET")
+	api.HandleFunc("/v1/accounts/{id:[0-9]+}", app.handler(handleMastodonFetchAccount)).Methods("GET")
+	api.HandleFunc("/v1/accounts/{id:[0-9]+}/statuses", app.handler(handleMastodonAccountStatuses)).Methods("GET")
+	api.HandleFunc("/v1/accounts/{id:[0-9]+}/{action:follow|unfollow}", app.handler(handleMastodonFollow)).Methods("POST")
+	api.HandleFunc("/v1/timelines/home", app.handler(handleMastodonHomeTimeline)).Methods("GET")
+	api.HandleFunc("/v1/statuses/{id:[0-9]+}", app.handler(handleMastodonFetchStatus)).Methods("GET")
+	api.HandleFunc("/v1/statuses/{id:[0-9]+}/{action:bookmark|unbookmark}", app.handler(handleMastodonBookmark)).Methods("POST")
+	api.HandleFunc("/v2/search", app.handler(handleMastodonSearch)).Methods("GET")
+
+	// OAuth
+	app.router.HandleFunc("/oauth/authorize", app.handler(handleViewAuthorize)).Methods("GET")
+	app.router.HandleFunc("/oauth/authorize", app.handler(handleAuthorize)).Methods("POST")
+	app.router.HandleFunc("/oauth/token", app.handler(handleOAuthToken)).Methods("POST")
+	app.router.HandleFunc("/oauth/revoke", app.handler(handleOAuthRevoke)).Methods("POST")
+
+	app.router.HandleFunc("/login", app.handler(handleViewHome)).Methods("GET")
+	app.router.HandleFunc("/saved", app.handler(handleViewHome)).Methods("GET")
+	app.router.HandleFunc("/logout", app.handler(handleLogout)).Methods("POST")
+	app.router.HandleFunc("/follow", app.handler(handleFollowUser)).Methods("POST")
+	app.router.HandleFunc("/settings", app.handler(handleViewSettings)).Methods("GET")
+	app.router.HandleFunc("/settings", app.handler(handleUpdateProfile)).Methods("POST")
+	app.router.HandleFunc("/settings/password", app.handler(handleChangePassword)).Methods("POST")
+	app.router.HandleFunc("/settings/sessions", app.handler(handleRevokeSessions)).Methods("POST")
+	app.router.HandleFunc("/settings/2fa", app.handler(handleViewTwoFactorSetup)).Methods("GET")
+	app.router.HandleFunc("/settings/2fa", app.handler(handleEnableTwoFactor)).Methods("POST")
+	app.router.HandleFunc("/settings/2fa/disable", app.handler(handleDisableTwoFactor)).Methods("POST")
+	app.router.HandleFunc("/settings/tokens", app.handler(handleViewTokens)).Methods("GET")
+	app.router.HandleFunc("/settings/tokens", app.handler(handleCreateToken)).Methods("POST")
+	app.router.HandleFunc("/settings/tokens/revoke", app.handler(handleRevokeToken)).Methods("POST")
+	app.router.HandleFunc("/settings/feed", app.handler(handleResetFeedToken)).Methods("POST")
+	app.router.HandleFunc("/settings/reading", app.handler(handleUpdateReading)).Methods("POST")
+	app.router.HandleFunc("/settings/digest", app.handler(handleUpdateDigest)).Methods("POST")
+	app.router.HandleFunc("/settings/aliases", app.handler(handleUpdateAliases)).Methods("POST")
+	app.router.HandleFunc("/settings/move", app.handler(handleMoveAccount)).Methods("POST")
+	app.router.HandleFunc("/settings/delete", app.handler(handleDeleteAccount)).Methods("POST")
+	app.router.HandleFunc("/settings/import", app.handler(handleViewImport)).Methods("GET")
+	app.router.HandleFunc("/settings/import", app.handler(handleImport)).Methods("POST")
+	app.router.HandleFunc("/settings/export/subscriptions.opml", app.handler(handleExportOPML)).Methods("GET")
+	app.router.HandleFunc("/settings/export/following_accounts.csv", app.handler(handleExportFollowingCSV)).Methods("GET")
+	app.router.HandleFunc("/settings/export/posts.epub", app.handler(handleExportEPUB)).Methods("GET")
+	app.router.HandleFunc("/settings/export/archive.zip", app.handler(handleExportArchive)).Methods("GET")
+	app.router.HandleFunc("/login/2fa", app.handler(handleViewTwoFactorLogin)).Methods("GET")
+	app.router.HandleFunc("/digest/unsubscribe", app.handler(handleUnsubscribe)).Methods("GET", "POST")
+	app.router.HandleFunc("/feed/{token:[0-9a-f]{64}}.{format:atom|rss}", app.handler(handleViewReaderFeed)).Methods("GET")
+	app.router.HandleFunc("/proxy/{sig:[0-9a-f]{32}}/{url}", app.handler(handleProxyMedia)).Methods("GET", "HEAD")
 	app.router.HandleFunc("/p/{id}", app.handler(handleViewPost))
+	app.router.HandleFunc("/p/{id:[0-9]+}/{action:save|unsave}", app.handler(handleSavePost)).Methods("POST")
+	app.router.HandleFunc("/p/{id:[0-9]+}/{action:read|unread}", app.handler(handleMarkPostRead)).Methods("POST")
+	app.router.HandleFunc("/{alias:[a-zA-Z0-9_-]+}", app.handler(handleViewProfile)).Methods("GET")
 	app.router.HandleFunc("/", app.handler(handleViewHome))
+	app.router.PathPrefix("/media/avatars/").Handler(http.StripPrefix("/media/avatars/", http.FileServer(http.Dir(filepath.Join(app.cfg.MediaDir, "avatars")))))
 	app.router.PathPrefix("/").Handler(http.FileServer(http.Dir("static/")))
 }
 
@@ -57,23 +124,40 @@ func handleViewHome(app *app, w http.ResponseWriter, r *http.Request) error {
 		User         *LocalUser
 		Version      string
 		InstanceName string
+		CSRFToken    string
 		Username     string
 		Flash        string
+		Flashes      []string
 		To           string
+		Saved        bool
 		Posts        *[]Post
 	}{
 		User:         u,
 		Version:      softwareVersion,
 		InstanceName: app.cfg.Name,
+		CSRFToken:    csrfToken(app, r),
 		Username:     r.FormValue("username"),
-		To:           r.FormValue("to"),
+		Flashes:      getSessionFlashes(app, w, r),
 		Posts:        &[]Post{},
 	}
+	if to := r.FormValue("to"); to != "" {
+		p.To = safeRedirect(to)
+	}
 	if u != nil {
-		p.Posts, err = app.getUserFeed(u.ID, 1)
+		if r.URL.Path == "/saved" {
+			p.Saved = true
+			p.Posts, err = app.getSavedPosts(u.ID, 1)
+		} else {
+			p.Posts, err = app.getUserFeed(u.ID, 1)
+		}
 		if err != nil {
 			return err
 		}
+		for i := range *p.Posts {
+			(*p.Posts)[i].ExpandWarning = u.ExpandWarnings
+		}
+	} else if r.URL.Path == "/saved" {
+		return impart.HTTPError{http.StatusUnauthorized, "Not logged in."}
 	}
 
 	if err := renderTemplate(w, "index", p); err != nil {
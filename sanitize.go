@@ -0,0 +1,131 @@
+package readas
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/microcosm-cc/bluemonday"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+	"html/template"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// Post content comes from anyone on the fediverse, so it's run through a
+// policy that only keeps HTML that's safe to show in our pages. Classes and
+// ids are removed, so posts can't take on our own styles or clash with the
+// page's elements. Iframes are only kept from the hosts in the embed_hosts
+// option, and are shown as placeholders that readers click to load, so just
+// opening a post doesn't contact those hosts.
+
+// defaultEmbedHosts are the hosts embeds are allowed from when embed_hosts
+// isn't set.
+var defaultEmbedHosts = []string{
+	"www.youtube.com",
+	"youtube.com",
+	"www.youtube-nocookie.com",
+	"player.vimeo.com",
+}
+
+// contentPolicy is the sanitization policy for posts and bios. It's built
+// with the default options until the configuration is read.
+var contentPolicy = newContentPolicy(&config{})
+
+// textPolicy strips all HTML, for plain text like excerpts.
+var textPolicy = bluemonday.StrictPolicy()
+
+func initContentPolicy(cfg *config) {
+	contentPolicy = newContentPolicy(cfg)
+}
+
+// newContentPolicy compiles the sanitization policy for the given
+// configuration.
+func newContentPolicy(cfg *config) *bluemonday.Policy {
+	policy := bluemonday.UGCPolicy()
+	policy.RequireNoFollowOnLinks(true)
+	policy.AllowAttrs("src").OnElements("video")
+	policy.AllowAttrs("controls", "loop", "muted", "autoplay").OnElements("video")
+	policy.AllowAttrs("target").OnElements("a")
+	if !cfg.StripStyles {
+		policy.AllowAttrs("style").Globally()
+	}
+	policy.AllowURLSchemes("http", "https", "mailto", "xmpp")
+
+	hosts := cfg.EmbedHosts
+	if hosts == nil {
+		hosts = defaultEmbedHosts
+	}
+	if len(hosts) > 0 {
+		quoted := make([]string, len(hosts))
+		for i, h := range hosts {
+			quoted[i] = regexp.QuoteMeta(strings.ToLower(h))
+		}
+		embedSrc := regexp.MustCompile(`^https://(` + strings.Join(quoted, "|") + `)/`)
+		policy.AllowAttrs("src").Matching(embedSrc).OnElements("iframe")
+		policy.AllowAttrs("width", "height").Matching(bluemonday.Integer).OnElements("iframe")
+		// Keep iframes from other hosts, without their src, so their fallback
+		// text is dropped along with them in placeholdEmbeds
+		policy.AllowNoAttrs().OnElements("iframe")
+	}
+	return policy
+}
+
+// sanitize returns the given user-supplied HTML with everything our policy
+// doesn't allow removed.
+func sanitize(s string) template.HTML {
+	return template.HTML(contentPolicy.Sanitize(s))
+}
+
+// placeholdEmbeds swaps the iframes in the given sanitized HTML for links
+// that load them when clicked. Iframes left without a src, because their
+// host isn't allowed, are dropped.
+func placeholdEmbeds(content string) string {
+	if !strings.Contains(content, "<iframe") {
+		return content
+	}
+	var buf bytes.Buffer
+	z := html.NewTokenizer(strings.NewReader(content))
+	inFrame := false
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			return buf.String()
+		}
+		if tt != html.StartTagToken && tt != html.SelfClosingTagToken && tt != html.EndTagToken {
+			if !inFrame {
+				buf.Write(z.Raw())
+			}
+			continue
+		}
+		raw := string(z.Raw())
+		t := z.Token()
+		if t.DataAtom != atom.Iframe {
+			if !inFrame {
+				buf.WriteString(raw)
+			}
+			continue
+		}
+		if tt == html.EndTagToken {
+			inFrame = false
+			continue
+		}
+		inFrame = tt == html.StartTagToken
+
+		var src, size string
+		for _, a := range t.Attr {
+			switch a.Key {
+			case "src":
+				src = a.Val
+			case "width", "height":
+				size += fmt.Sprintf(` data-%s="%s"`, a.Key, html.EscapeString(a.Val))
+			}
+		}
+		u, err := url.Parse(src)
+		if src == "" || err != nil {
+			continue
+		}
+		fmt.Fprintf(&buf, `<div class="embed" data-src="%s"%s><a href="%s" target="_blank" rel="nofollow noopener">Load embedded content from %s</a></div>`,
+			html.EscapeString(src), size, html.EscapeString(src), html.EscapeString(u.Host))
+	}
+}
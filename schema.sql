@@ -1,3 +1,96 @@
+--
+-- Table structure for table `accesstokens`
+--
+
+CREATE TABLE IF NOT EXISTS `accesstokens` (
+  `id` int(11) NOT NULL AUTO_INCREMENT,
+  `user_id` int(11) NOT NULL,
+  `name` varchar(100) CHARACTER SET utf8mb4 COLLATE utf8mb4_bin NOT NULL,
+  `token_hash` char(64) NOT NULL,
+  `scope` varchar(10) NOT NULL,
+  `client_id` varchar(64) DEFAULT NULL,
+  `refresh_hash` char(64) DEFAULT NULL,
+  `created` datetime NOT NULL,
+  `last_used` datetime DEFAULT NULL,
+  `expires` datetime DEFAULT NULL,
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `token_hash` (`token_hash`),
+  UNIQUE KEY `refresh_hash` (`refresh_hash`),
+  KEY `user_id` (`user_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=latin1;
+
+--
+-- Table structure for table `attachments`
+--
+
+CREATE TABLE IF NOT EXISTS `attachments` (
+  `post_id` int(11) NOT NULL,
+  `position` int(11) NOT NULL,
+  `url` varchar(255) NOT NULL,
+  `media_type` varchar(100) NOT NULL,
+  `name` varchar(1500) CHARACTER SET utf8mb4 COLLATE utf8mb4_bin DEFAULT NULL,
+  `width` int(11) DEFAULT NULL,
+  `height` int(11) DEFAULT NULL,
+  `blurhash` varchar(100) DEFAULT NULL,
+  PRIMARY KEY (`post_id`,`position`)
+) ENGINE=InnoDB DEFAULT CHARSET=latin1;
+
+--
+-- Table structure for table `cachedmedia`
+--
+
+CREATE TABLE IF NOT EXISTS `cachedmedia` (
+  `id` char(64) NOT NULL,
+  `url` text NOT NULL,
+  `media_type` varchar(100) NOT NULL,
+  `size` int(11) NOT NULL,
+  `fetched` datetime NOT NULL,
+  `last_used` datetime NOT NULL,
+  PRIMARY KEY (`id`),
+  KEY `last_used` (`last_used`)
+) ENGINE=InnoDB DEFAULT CHARSET=latin1;
+
+--
+-- Table structure for table `digestposts`
+--
+
+CREATE TABLE IF NOT EXISTS `digestposts` (
+  `digest_id` int(11) NOT NULL,
+  `post_id` int(11) NOT NULL,
+  PRIMARY KEY (`digest_id`,`post_id`),
+  KEY `post_id` (`post_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=latin1;
+
+--
+-- Table structure for table `digests`
+--
+
+CREATE TABLE IF NOT EXISTS `digests` (
+  `id` int(11) NOT NULL AUTO_INCREMENT,
+  `user_id` int(11) NOT NULL,
+  `frequency` varchar(10) NOT NULL,
+  `recipient` varchar(255) NOT NULL,
+  `subject` varchar(255) CHARACTER SET utf8mb4 COLLATE utf8mb4_bin NOT NULL,
+  `posts` int(11) NOT NULL,
+  `sent` datetime NOT NULL,
+  PRIMARY KEY (`id`),
+  KEY `user_id` (`user_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=latin1;
+
+--
+-- Table structure for table `feeds`
+--
+
+CREATE TABLE IF NOT EXISTS `feeds` (
+  `user_id` int(11) NOT NULL,
+  `url` varchar(255) NOT NULL,
+  `etag` varchar(255) DEFAULT NULL,
+  `last_modified` varchar(64) DEFAULT NULL,
+  `last_fetched` datetime DEFAULT NULL,
+  PRIMARY KEY (`user_id`),
+  UNIQUE KEY `url` (`url`)
+) ENGINE=InnoDB DEFAULT CHARSET=latin1;
+
 --
 -- Table structure for table `follows`
 --
@@ -22,6 +115,60 @@ CREATE TABLE IF NOT EXISTS `foundusers` (
   UNIQUE KEY `actor_iri` (`actor_id`)
 ) ENGINE=InnoDB DEFAULT CHARSET=latin1;
 
+--
+-- Table structure for table `oauthclients`
+--
+
+CREATE TABLE IF NOT EXISTS `oauthclients` (
+  `id` varchar(64) NOT NULL,
+  `secret_hash` char(64) NOT NULL,
+  `name` varchar(100) CHARACTER SET utf8mb4 COLLATE utf8mb4_bin NOT NULL,
+  `website` varchar(255) DEFAULT NULL,
+  `redirect_uris` text NOT NULL,
+  `long_lived_tokens` tinyint(1) NOT NULL DEFAULT '0',
+  `created` datetime NOT NULL,
+  PRIMARY KEY (`id`)
+) ENGINE=InnoDB DEFAULT CHARSET=latin1;
+
+--
+-- Table structure for table `oauthcodes`
+--
+
+CREATE TABLE IF NOT EXISTS `oauthcodes` (
+  `code_hash` char(64) NOT NULL,
+  `client_id` varchar(64) NOT NULL,
+  `user_id` int(11) NOT NULL,
+  `redirect_uri` text NOT NULL,
+  `scope` varchar(10) NOT NULL,
+  `code_challenge` varchar(128) DEFAULT NULL,
+  `code_challenge_method` varchar(10) DEFAULT NULL,
+  `expires` datetime NOT NULL,
+  PRIMARY KEY (`code_hash`)
+) ENGINE=InnoDB DEFAULT CHARSET=latin1;
+
+--
+-- Table structure for table `pinnedmedia`
+--
+
+CREATE TABLE IF NOT EXISTS `pinnedmedia` (
+  `post_id` int(11) NOT NULL,
+  `media_id` char(64) NOT NULL,
+  PRIMARY KEY (`post_id`,`media_id`),
+  KEY `media_id` (`media_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=latin1;
+
+--
+-- Table structure for table `polloptions`
+--
+
+CREATE TABLE IF NOT EXISTS `polloptions` (
+  `post_id` int(11) NOT NULL,
+  `position` int(11) NOT NULL,
+  `name` varchar(255) CHARACTER SET utf8mb4 COLLATE utf8mb4_bin NOT NULL,
+  `votes` int(11) NOT NULL DEFAULT '0',
+  PRIMARY KEY (`post_id`,`position`)
+) ENGINE=InnoDB DEFAULT CHARSET=latin1;
+
 --
 -- Table structure for table `posts`
 --
@@ -35,10 +182,65 @@ CREATE TABLE IF NOT EXISTS `posts` (
   `url` varchar(255) NOT NULL,
   `name` varchar(255) CHARACTER SET utf8mb4 COLLATE utf8mb4_bin DEFAULT NULL,
   `content` mediumtext CHARACTER SET utf8mb4 COLLATE utf8mb4_bin,
+  `summary` varchar(500) CHARACTER SET utf8mb4 COLLATE utf8mb4_bin DEFAULT NULL,
+  `sensitive` tinyint(1) NOT NULL DEFAULT '0',
+  `deleted` datetime DEFAULT NULL,
+  `start_time` datetime DEFAULT NULL,
+  `end_time` datetime DEFAULT NULL,
+  `location` varchar(255) CHARACTER SET utf8mb4 COLLATE utf8mb4_bin DEFAULT NULL,
+  `multiple` tinyint(1) NOT NULL DEFAULT '0',
   PRIMARY KEY (`id`),
   UNIQUE KEY `activity_id` (`activity_id`)
 ) ENGINE=InnoDB DEFAULT CHARSET=latin1;
 
+--
+-- Table structure for table `readposts`
+--
+
+CREATE TABLE IF NOT EXISTS `readposts` (
+  `user_id` int(11) NOT NULL,
+  `post_id` int(11) NOT NULL,
+  `created` datetime NOT NULL,
+  PRIMARY KEY (`user_id`,`post_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=latin1;
+
+--
+-- Table structure for table `recoverycodes`
+--
+
+CREATE TABLE IF NOT EXISTS `recoverycodes` (
+  `user_id` int(11) NOT NULL,
+  `code_hash` char(64) NOT NULL,
+  PRIMARY KEY (`user_id`,`code_hash`)
+) ENGINE=InnoDB DEFAULT CHARSET=latin1;
+
+--
+-- Table structure for table `savedposts`
+--
+
+CREATE TABLE IF NOT EXISTS `savedposts` (
+  `user_id` int(11) NOT NULL,
+  `post_id` int(11) NOT NULL,
+  `created` datetime NOT NULL,
+  PRIMARY KEY (`user_id`,`post_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=latin1;
+
+--
+-- Table structure for table `sessions`
+--
+
+CREATE TABLE IF NOT EXISTS `sessions` (
+  `id` int(11) NOT NULL AUTO_INCREMENT,
+  `token` char(64) NOT NULL,
+  `user_id` int(11) NOT NULL,
+  `user_agent` varchar(255) DEFAULT NULL,
+  `created` datetime NOT NULL,
+  `last_seen` datetime NOT NULL,
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `token` (`token`),
+  KEY `user_id` (`user_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=latin1;
+
 --
 -- Table structure for table `userkeys`
 --
@@ -60,7 +262,7 @@ CREATE TABLE IF NOT EXISTS `users` (
   `actor_id` varchar(255) NOT NULL,
   `username` varchar(60) NOT NULL,
   `password` char(60) DEFAULT NULL,
-  `type` varchar(10) DEFAULT NULL,
+  `type` varchar(20) DEFAULT NULL,
   `name` varchar(100) CHARACTER SET utf8mb4 COLLATE utf8mb4_bin NOT NULL,
   `summary` varchar(255) CHARACTER SET utf8mb4 COLLATE utf8mb4_bin NOT NULL,
   `created` datetime NOT NULL,
@@ -70,8 +272,21 @@ CREATE TABLE IF NOT EXISTS `users` (
   `inbox_iri` varchar(255) DEFAULT NULL,
   `outbox_iri` varchar(255) DEFAULT NULL,
   `shared_inbox_iri` varchar(255) DEFAULT NULL,
+  `last_fetched` datetime DEFAULT NULL,
   `avatar` varchar(255) DEFAULT NULL,
   `avatar_type` varchar(255) DEFAULT NULL,
+  `totp_secret` varchar(64) DEFAULT NULL,
+  `totp_step` bigint(20) DEFAULT NULL,
+  `feed_token` char(64) DEFAULT NULL,
+  `email` varchar(255) DEFAULT NULL,
+  `digest` varchar(10) DEFAULT NULL,
+  `digest_sent` datetime DEFAULT NULL,
+  `also_known_as` text,
+  `moved_to` varchar(255) DEFAULT NULL,
+  `feed_types` varchar(255) DEFAULT NULL,
+  `expand_warnings` tinyint(1) NOT NULL DEFAULT '0',
+  `deleted` datetime DEFAULT NULL,
   PRIMARY KEY (`id`),
-  UNIQUE KEY `actor_id` (`actor_id`)
+  UNIQUE KEY `actor_id` (`actor_id`),
+  UNIQUE KEY `feed_token` (`feed_token`)
 ) ENGINE=InnoDB DEFAULT CHARSET=latin1;
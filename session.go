@@ -1,10 +1,16 @@
 package readas
 
 import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
 	"encoding/gob"
+	"encoding/hex"
 	"github.com/gorilla/sessions"
 	"net/http"
+	"net/url"
 	"strings"
+	"time"
 )
 
 const (
@@ -12,6 +18,16 @@ const (
 	sessionLength = 180 * day
 )
 
+// Session is a record of a device a user is logged in on. The cookie only
+// references it, so it can be revoked from the server.
+type Session struct {
+	ID        int64
+	UserAgent string
+	Created   time.Time
+	LastSeen  time.Time
+	IsCurrent bool
+}
+
 // initSession creates the cookie store. It depends on the keychain already
 // being loaded.
 func initSession(app *app) error {
@@ -29,7 +45,55 @@ func initSession(app *app) error {
 	return nil
 }
 
+// startSession records a new session for the given user and saves a
+// reference to it in their cookie.
+func startSession(app *app, w http.ResponseWriter, r *http.Request, u *LocalUser) error {
+	session, err := app.sStore.Get(r, "u")
+	if err != nil {
+		// The cookie should still save, even if there's an error.
+		logError("Session: %v; ignoring", err)
+	}
+
+	b := make([]byte, 32)
+	_, err = rand.Read(b)
+	if err != nil {
+		return err
+	}
+	token := hex.EncodeToString(b)
+	err = app.createSession(u.ID, token, r.UserAgent())
+	if err != nil {
+		return err
+	}
+
+	// Remove unwanted data
+	session.Values["user"] = u.cookie()
+	session.Values["sid"] = token
+	err = session.Save(r, w)
+	if err != nil {
+		logError("Couldn't save session: %v", err)
+		return err
+	}
+	return nil
+}
+
+// getSessionToken returns the server-side session referenced by the request's
+// cookie, if any.
+func getSessionToken(app *app, r *http.Request) string {
+	session, err := app.sStore.Get(r, "u")
+	if err != nil {
+		return ""
+	}
+	token, _ := session.Values["sid"].(string)
+	return token
+}
+
+// getUserSession returns the logged-in user, whether they authenticated with
+// their session cookie or an access token.
 func getUserSession(app *app, r *http.Request) *LocalUser {
+	if ta := getTokenAuth(r); ta != nil {
+		return ta.user
+	}
+
 	session, err := app.sStore.Get(r, "u")
 	if err == nil {
 		// Got the currently logged-in user
@@ -37,9 +101,101 @@ func getUserSession(app *app, r *http.Request) *LocalUser {
 		var u = &LocalUser{}
 		var ok bool
 		if u, ok = val.(*LocalUser); ok {
+			// Make sure the session hasn't been revoked
+			token, _ := session.Values["sid"].(string)
+			if token == "" || !app.isSessionValid(token, u.ID) {
+				return nil
+			}
 			return u
 		}
 	}
 
 	return nil
 }
+
+// csrfToken returns the token that forms submitted by the logged-in user must
+// include. It's derived from their server-side session, so it changes when
+// they log in again and stops working when the session is revoked.
+func csrfToken(app *app, r *http.Request) string {
+	token := getSessionToken(app, r)
+	if token == "" {
+		return ""
+	}
+	mac := hmac.New(sha256.New, app.keys.cookieAuthKey)
+	mac.Write([]byte("csrf:" + token))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// verifyCSRF checks that a state-changing request made with a session cookie
+// includes the session's CSRF token, either as the `csrf` form value or the
+// X-CSRF-Token header. Requests without a logged-in session pass, since they
+// have nothing for a forged request to use.
+func verifyCSRF(app *app, r *http.Request) bool {
+	switch r.Method {
+	case "GET", "HEAD", "OPTIONS":
+		return true
+	}
+	if getTokenAuth(r) != nil {
+		// Tokens are sent explicitly, so they can't be used by forged requests
+		return true
+	}
+	if getUserSession(app, r) == nil {
+		return true
+	}
+
+	expected := csrfToken(app, r)
+	sent := r.Header.Get("X-CSRF-Token")
+	if sent == "" {
+		sent = r.FormValue("csrf")
+	}
+	return expected != "" && hmac.Equal([]byte(sent), []byte(expected))
+}
+
+// safeRedirect returns the given redirect destination if it's a path on this
+// site, or the home page otherwise, so that links can't send users elsewhere.
+func safeRedirect(to string) string {
+	if !strings.HasPrefix(to, "/") || strings.HasPrefix(to, "//") || strings.Contains(to, "\\") {
+		return "/"
+	}
+	u, err := url.Parse(to)
+	if err != nil || u.Scheme != "" || u.Host != "" {
+		return "/"
+	}
+	return to
+}
+
+// addSessionFlash saves a message to show the user on the next page they view.
+func addSessionFlash(app *app, w http.ResponseWriter, r *http.Request, msg string) {
+	session, err := app.sStore.Get(r, "u")
+	if err != nil {
+		logError("Unable to get session for flash: %v", err)
+		return
+	}
+	session.AddFlash(msg)
+	err = session.Save(r, w)
+	if err != nil {
+		logError("Unable to save flash: %v", err)
+	}
+}
+
+// getSessionFlashes returns and clears any messages saved for the user.
+func getSessionFlashes(app *app, w http.ResponseWriter, r *http.Request) []string {
+	session, err := app.sStore.Get(r, "u")
+	if err != nil {
+		return nil
+	}
+
+	flashes := []string{}
+	for _, f := range session.Flashes() {
+		if msg, ok := f.(string); ok {
+			flashes = append(flashes, msg)
+		}
+	}
+	if len(flashes) > 0 {
+		err = session.Save(r, w)
+		if err != nil {
+			logError("Unable to clear flashes: %v", err)
+		}
+	}
+	return flashes
+}
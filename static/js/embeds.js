@@ -0,0 +1,26 @@
+// Embedded content is shown as a placeholder until the reader clicks it, so
+// nothing is loaded from the embed's host before then.
+(function() {
+	document.addEventListener('click', function(e) {
+		var el = e.target;
+		while (el && !(el.classList && el.classList.contains('embed'))) {
+			el = el.parentNode;
+		}
+		if (!el || !el.getAttribute('data-src')) {
+			return;
+		}
+		e.preventDefault();
+
+		var frame = document.createElement('iframe');
+		frame.src = el.getAttribute('data-src');
+		frame.setAttribute('allowfullscreen', '');
+		frame.setAttribute('sandbox', 'allow-scripts allow-same-origin allow-popups allow-presentation');
+		if (el.getAttribute('data-width')) {
+			frame.width = el.getAttribute('data-width');
+		}
+		if (el.getAttribute('data-height')) {
+			frame.height = el.getAttribute('data-height');
+		}
+		el.parentNode.replaceChild(frame, el);
+	});
+})();
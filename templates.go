@@ -4,15 +4,41 @@ import (
 	"html/template"
 	"io"
 	"log"
+	texttemplate "text/template"
 )
 
 var templates = map[string]*template.Template{}
 
+// Email templates
+var (
+	digestHTMLTemplate *template.Template
+	digestTextTemplate *texttemplate.Template
+)
+
+// Export templates
+var (
+	epubTemplates    *template.Template
+	archiveTemplates *template.Template
+)
+
 const templatesDir = "templates/"
 
 func init() {
 	initTemplate("post")
 	initTemplate("index")
+	initTemplate("settings")
+	initTemplate("profile")
+	initTemplate("twofactor")
+	initTemplate("twofactor-setup")
+	initTemplate("tokens")
+	initTemplate("authorize")
+	initTemplate("import")
+	initTemplate("unsubscribe")
+
+	digestHTMLTemplate = template.Must(template.ParseFiles(templatesDir + "email/digest.html"))
+	digestTextTemplate = texttemplate.Must(texttemplate.ParseFiles(templatesDir + "email/digest.txt"))
+	epubTemplates = template.Must(template.ParseGlob(templatesDir + "epub/*"))
+	archiveTemplates = template.Must(template.ParseGlob(templatesDir + "archive/*"))
 }
 
 func initTemplate(name string) {
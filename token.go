@@ -0,0 +1,167 @@
+package readas
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/writeas/impart"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	scopeRead  = "read"
+	scopeWrite = "write"
+)
+
+type contextKey int
+
+const tokenAuthKey contextKey = iota
+
+// AccessToken is a personal access token a user created for an API client.
+type AccessToken struct {
+	ID       int64
+	Name     string
+	Scope    string
+	Created  time.Time
+	LastUsed *time.Time
+}
+
+// tokenAuth is the user and scope a request was authenticated with.
+type tokenAuth struct {
+	user  *LocalUser
+	scope string
+}
+
+func hashToken(token string) string {
+	h := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(h[:])
+}
+
+func generateToken() (string, error) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// authenticateToken checks the bearer token in the request's Authorization
+// header, returning the request with the token's user attached for
+// getUserSession. Read-only tokens can only make safe requests.
+func authenticateToken(app *app, r *http.Request) (*http.Request, error) {
+	token := strings.TrimSpace(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "))
+	if token == "" {
+		return r, impart.HTTPError{http.StatusUnauthorized, "Invalid access token."}
+	}
+
+	u, scope, err := app.getAccessTokenUser(hashToken(token))
+	if err != nil {
+		return r, err
+	}
+	switch r.Method {
+	case "GET", "HEAD", "OPTIONS":
+	default:
+		if scope != scopeWrite {
+			return r, impart.HTTPError{http.StatusForbidden, "This access token is read-only."}
+		}
+	}
+
+	return r.WithContext(context.WithValue(r.Context(), tokenAuthKey, &tokenAuth{user: u, scope: scope})), nil
+}
+
+// getTokenAuth returns the token information the request was authenticated
+// with, if any.
+func getTokenAuth(r *http.Request) *tokenAuth {
+	ta, _ := r.Context().Value(tokenAuthKey).(*tokenAuth)
+	return ta
+}
+
+func handleViewTokens(app *app, w http.ResponseWriter, r *http.Request) error {
+	cu := getUserSession(app, r)
+	if cu == nil {
+		return impart.HTTPError{http.StatusUnauthorized, "Not logged in."}
+	}
+	u, err := app.getLocalUser(cu.PreferredUsername)
+	if err != nil {
+		return err
+	}
+
+	p := struct {
+		User         *LocalUser
+		Version      string
+		InstanceName string
+		CSRFToken    string
+		Flashes      []string
+		Tokens       *[]AccessToken
+	}{
+		User:         u,
+		Version:      softwareVersion,
+		InstanceName: app.cfg.Name,
+		CSRFToken:    csrfToken(app, r),
+		Flashes:      getSessionFlashes(app, w, r),
+	}
+	p.Tokens, err = app.getAccessTokens(u.ID)
+	if err != nil {
+		return err
+	}
+
+	return renderTemplate(w, "tokens", p)
+}
+
+// handleCreateToken creates a new personal access token and shows it to the
+// user once.
+func handleCreateToken(app *app, w http.ResponseWriter, r *http.Request) error {
+	cu := getUserSession(app, r)
+	if cu == nil || getTokenAuth(r) != nil {
+		return impart.HTTPError{http.StatusUnauthorized, "Not logged in."}
+	}
+
+	name := strings.TrimSpace(r.FormValue("name"))
+	if name == "" {
+		return impart.HTTPError{http.StatusBadRequest, "A name is required."}
+	}
+	if len(name) > 100 {
+		return impart.HTTPError{http.StatusBadRequest, "Name is too long."}
+	}
+	scope := r.FormValue("scope")
+	if scope != scopeRead && scope != scopeWrite {
+		return impart.HTTPError{http.StatusBadRequest, "Scope must be read or write."}
+	}
+
+	token, err := generateToken()
+	if err != nil {
+		return err
+	}
+	err = app.createAccessToken(cu.ID, name, scope, hashToken(token))
+	if err != nil {
+		return err
+	}
+
+	addSessionFlash(app, w, r, "Created token \""+name+"\": "+token+". Copy it now; it won't be shown again.")
+	return impart.HTTPError{http.StatusFound, "/settings/tokens"}
+}
+
+func handleRevokeToken(app *app, w http.ResponseWriter, r *http.Request) error {
+	cu := getUserSession(app, r)
+	if cu == nil || getTokenAuth(r) != nil {
+		return impart.HTTPError{http.StatusUnauthorized, "Not logged in."}
+	}
+
+	id, err := strconv.ParseInt(r.FormValue("id"), 10, 64)
+	if err != nil {
+		return impart.HTTPError{http.StatusBadRequest, "Invalid token."}
+	}
+	err = app.deleteAccessToken(cu.ID, id)
+	if err != nil {
+		logError("Couldn't delete access token: %v", err)
+		return impart.HTTPError{http.StatusInternalServerError, "Couldn't revoke token."}
+	}
+
+	addSessionFlash(app, w, r, "Token revoked.")
+	return impart.HTTPError{http.StatusFound, "/settings/tokens"}
+}
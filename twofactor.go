@@ -0,0 +1,412 @@
+package readas
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"github.com/pquerna/otp"
+	"github.com/pquerna/otp/totp"
+	"github.com/writeas/impart"
+	"github.com/writeas/web-core/auth"
+	"html/template"
+	"image/png"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// twoFactorTimeout is how long someone has to enter their TOTP code after
+	// entering their password.
+	twoFactorTimeout = 5 * time.Minute
+
+	// maxTwoFactorAttempts is how many codes can be tried for each time
+	// someone enters their password.
+	maxTwoFactorAttempts = 5
+
+	totpPeriod = 30
+
+	recoveryCodesCount = 10
+)
+
+// twoFactorAttempts counts the codes tried for each partial login, by the id
+// in its session. Sessions are kept in cookies, so the count can't be kept
+// there, or replaying an older cookie would reset it.
+var twoFactorAttempts = struct {
+	sync.Mutex
+	logins map[string]*twoFactorLogin
+}{logins: map[string]*twoFactorLogin{}}
+
+type twoFactorLogin struct {
+	attempts int
+	expires  time.Time
+}
+
+// countTwoFactorAttempt records a code being tried for the given partial
+// login, returning whether it's still allowed.
+func countTwoFactorAttempt(id string) bool {
+	twoFactorAttempts.Lock()
+	defer twoFactorAttempts.Unlock()
+	now := time.Now()
+	for k, l := range twoFactorAttempts.logins {
+		if now.After(l.expires) {
+			delete(twoFactorAttempts.logins, k)
+		}
+	}
+	l, ok := twoFactorAttempts.logins[id]
+	if !ok {
+		l = &twoFactorLogin{expires: now.Add(twoFactorTimeout)}
+		twoFactorAttempts.logins[id] = l
+	}
+	l.attempts++
+	return l.attempts <= maxTwoFactorAttempts
+}
+
+// startTwoFactor remembers that the given user entered the right password, so
+// they can finish logging in with their second factor.
+func startTwoFactor(app *app, w http.ResponseWriter, r *http.Request, u *LocalUser, to string) error {
+	session, err := app.sStore.Get(r, "u")
+	if err != nil {
+		logError("2FA: Session: %v; ignoring", err)
+	}
+	id, err := generateToken()
+	if err != nil {
+		return err
+	}
+
+	session.Values["2fa_id"] = id
+	session.Values["2fa_user"] = u.PreferredUsername
+	session.Values["2fa_expires"] = time.Now().Add(twoFactorTimeout).Unix()
+	session.Values["2fa_to"] = to
+	err = session.Save(r, w)
+	if err != nil {
+		logError("2FA: Couldn't save session: %v", err)
+		return err
+	}
+	return nil
+}
+
+// getTwoFactorUser returns the user who is partway through logging in, along
+// with where they want to go afterwards.
+func getTwoFactorUser(app *app, r *http.Request) (*LocalUser, string, error) {
+	u, to, _, err := getTwoFactorLogin(app, r)
+	return u, to, err
+}
+
+// getTwoFactorLogin is getTwoFactorUser, along with the id of the partial
+// login.
+func getTwoFactorLogin(app *app, r *http.Request) (*LocalUser, string, string, error) {
+	session, err := app.sStore.Get(r, "u")
+	if err != nil {
+		return nil, "", "", impart.HTTPError{http.StatusUnauthorized, "Not logged in."}
+	}
+	id, _ := session.Values["2fa_id"].(string)
+	username, _ := session.Values["2fa_user"].(string)
+	expires, _ := session.Values["2fa_expires"].(int64)
+	if id == "" || username == "" || time.Now().Unix() > expires {
+		return nil, "", "", impart.HTTPError{http.StatusUnauthorized, "Not logged in."}
+	}
+	to, _ := session.Values["2fa_to"].(string)
+
+	u, err := app.getLocalUser(username)
+	if err != nil {
+		return nil, "", "", err
+	}
+	return u, to, id, nil
+}
+
+// finishTwoFactor clears the partial login and logs the user in.
+func finishTwoFactor(app *app, w http.ResponseWriter, r *http.Request, u *LocalUser) error {
+	session, err := app.sStore.Get(r, "u")
+	if err == nil {
+		delete(session.Values, "2fa_id")
+		delete(session.Values, "2fa_user")
+		delete(session.Values, "2fa_expires")
+		delete(session.Values, "2fa_to")
+		delete(session.Values, "totp_url")
+	}
+	return startSession(app, w, r, u)
+}
+
+// validateTOTP checks the given code against the time steps around now. The
+// step it matches is used up, so the same code can't be entered twice.
+func validateTOTP(app *app, u *LocalUser, code string) (bool, error) {
+	now := time.Now().Unix() / totpPeriod
+	for step := now - 1; step <= now+1; step++ {
+		c, err := totp.GenerateCode(u.totpSecret, time.Unix(step*totpPeriod, 0))
+		if err != nil {
+			return false, err
+		}
+		if subtle.ConstantTimeCompare([]byte(c), []byte(code)) == 1 {
+			return app.useTOTPStep(u.ID, step)
+		}
+	}
+	return false, nil
+}
+
+func hashRecoveryCode(code string) string {
+	code = strings.ToLower(strings.Replace(strings.TrimSpace(code), "-", "", -1))
+	h := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(h[:])
+}
+
+func generateRecoveryCodes() ([]string, error) {
+	codes := make([]string, recoveryCodesCount)
+	for i := range codes {
+		b := make([]byte, 5)
+		_, err := rand.Read(b)
+		if err != nil {
+			return nil, err
+		}
+		c := hex.EncodeToString(b)
+		codes[i] = c[:5] + "-" + c[5:]
+	}
+	return codes, nil
+}
+
+func handleViewTwoFactorLogin(app *app, w http.ResponseWriter, r *http.Request) error {
+	if _, _, err := getTwoFactorUser(app, r); err != nil {
+		return impart.HTTPError{http.StatusFound, "/"}
+	}
+
+	p := struct {
+		User         *LocalUser
+		Version      string
+		InstanceName string
+		CSRFToken    string
+	}{
+		Version:      softwareVersion,
+		InstanceName: app.cfg.Name,
+		CSRFToken:    csrfToken(app, r),
+	}
+	return renderTemplate(w, "twofactor", p)
+}
+
+// handleTwoFactorLogin completes a login with either a TOTP code or one of the
+// user's recovery codes.
+func handleTwoFactorLogin(app *app, w http.ResponseWriter, r *http.Request) error {
+	u, to, id, err := getTwoFactorLogin(app, r)
+	if err != nil {
+		return impart.HTTPError{http.StatusFound, "/"}
+	}
+
+	code := strings.TrimSpace(r.FormValue("code"))
+	if code == "" {
+		return impart.HTTPError{http.StatusBadRequest, "A code is required."}
+	}
+	if !countTwoFactorAttempt(id) {
+		return impart.HTTPError{http.StatusTooManyRequests, "Too many incorrect codes. Please log in again."}
+	}
+
+	ok, err := validateTOTP(app, u, code)
+	if err != nil {
+		logError("Couldn't check TOTP code: %v", err)
+		return impart.HTTPError{http.StatusInternalServerError, "Couldn't check code."}
+	}
+	if !ok {
+		ok, err := app.useRecoveryCode(u.ID, hashRecoveryCode(code))
+		if err != nil {
+			logError("Couldn't check recovery code: %v", err)
+			return impart.HTTPError{http.StatusInternalServerError, "Couldn't check code."}
+		}
+		if !ok {
+			return impart.HTTPError{http.StatusUnauthorized, "Incorrect code."}
+		}
+		logInfo("User %s logged in with a recovery code", u.PreferredUsername)
+	}
+
+	err = finishTwoFactor(app, w, r, u)
+	if err != nil {
+		return err
+	}
+	if to == "" {
+		to = "/"
+	}
+	return impart.HTTPError{http.StatusFound, to}
+}
+
+// getTwoFactorSetupUser returns the user setting up 2FA: either the logged-in
+// user, or, when 2FA is required, someone who just entered their password.
+func getTwoFactorSetupUser(app *app, r *http.Request) (*LocalUser, bool, error) {
+	if getTokenAuth(r) != nil {
+		return nil, false, impart.HTTPError{http.StatusUnauthorized, "Not logged in."}
+	}
+	if cu := getUserSession(app, r); cu != nil {
+		u, err := app.getLocalUser(cu.PreferredUsername)
+		return u, false, err
+	}
+	if app.cfg.Require2FA {
+		u, _, err := getTwoFactorUser(app, r)
+		if err == nil && !u.HasTwoFactor() {
+			return u, true, nil
+		}
+	}
+	return nil, false, impart.HTTPError{http.StatusUnauthorized, "Not logged in."}
+}
+
+// handleViewTwoFactorSetup shows a new TOTP secret and its QR code for the
+// user to enroll in their authenticator app.
+func handleViewTwoFactorSetup(app *app, w http.ResponseWriter, r *http.Request) error {
+	u, _, err := getTwoFactorSetupUser(app, r)
+	if err != nil {
+		return err
+	}
+	if u.HasTwoFactor() {
+		return impart.HTTPError{http.StatusFound, "/settings"}
+	}
+
+	key, err := totp.Generate(totp.GenerateOpts{
+		Issuer:      app.cfg.Name,
+		AccountName: u.PreferredUsername + "@" + app.cfg.Host[strings.LastIndexByte(app.cfg.Host, '/')+1:],
+	})
+	if err != nil {
+		logError("Unable to generate TOTP key: %v", err)
+		return err
+	}
+	img, err := key.Image(200, 200)
+	if err != nil {
+		logError("Unable to generate QR code: %v", err)
+		return err
+	}
+	var buf bytes.Buffer
+	err = png.Encode(&buf, img)
+	if err != nil {
+		return err
+	}
+
+	// Hold onto the secret until they confirm they've saved it
+	session, err := app.sStore.Get(r, "u")
+	if err != nil {
+		logError("2FA setup: Session: %v; ignoring", err)
+	}
+	session.Values["totp_url"] = key.URL()
+	err = session.Save(r, w)
+	if err != nil {
+		return err
+	}
+
+	p := struct {
+		User         *LocalUser
+		Version      string
+		InstanceName string
+		CSRFToken    string
+		Flashes      []string
+		Secret       string
+		QRCode       template.URL
+	}{
+		User:         u,
+		Version:      softwareVersion,
+		InstanceName: app.cfg.Name,
+		CSRFToken:    csrfToken(app, r),
+		Flashes:      getSessionFlashes(app, w, r),
+		Secret:       key.Secret(),
+		QRCode:       template.URL("data:image/png;base64," + base64.StdEncoding.EncodeToString(buf.Bytes())),
+	}
+	return renderTemplate(w, "twofactor-setup", p)
+}
+
+// handleEnableTwoFactor turns on 2FA once the user proves their authenticator
+// app has the secret, then shows their recovery codes.
+func handleEnableTwoFactor(app *app, w http.ResponseWriter, r *http.Request) error {
+	u, enrolling, err := getTwoFactorSetupUser(app, r)
+	if err != nil {
+		return err
+	}
+	if u.HasTwoFactor() {
+		// Replacing the secret would let anyone with the session skip the
+		// current one, so it has to be disabled first
+		addSessionFlash(app, w, r, "Two-factor authentication is already enabled.")
+		return impart.HTTPError{http.StatusFound, "/settings"}
+	}
+
+	session, err := app.sStore.Get(r, "u")
+	if err != nil {
+		return impart.HTTPError{http.StatusFound, "/settings/2fa"}
+	}
+	keyURL, _ := session.Values["totp_url"].(string)
+	key, err := otp.NewKeyFromURL(keyURL)
+	if err != nil {
+		return impart.HTTPError{http.StatusFound, "/settings/2fa"}
+	}
+	if !totp.Validate(strings.TrimSpace(r.FormValue("code")), key.Secret()) {
+		addSessionFlash(app, w, r, "That code didn't match. Please scan the new code and try again.")
+		return impart.HTTPError{http.StatusFound, "/settings/2fa"}
+	}
+
+	codes, err := generateRecoveryCodes()
+	if err != nil {
+		return err
+	}
+	hashes := make([]string, len(codes))
+	for i, c := range codes {
+		hashes[i] = hashRecoveryCode(c)
+	}
+	err = app.enableTwoFactor(u.ID, key.Secret(), hashes)
+	if err != nil {
+		logError("Couldn't enable 2FA: %v", err)
+		return impart.HTTPError{http.StatusInternalServerError, "Couldn't enable two-factor authentication."}
+	}
+
+	to := "/settings"
+	if enrolling {
+		_, to, _ = getTwoFactorUser(app, r)
+		if to == "" {
+			to = "/"
+		}
+		err = finishTwoFactor(app, w, r, u)
+	} else {
+		delete(session.Values, "totp_url")
+		err = session.Save(r, w)
+	}
+	if err != nil {
+		return err
+	}
+
+	p := struct {
+		User          *LocalUser
+		Version       string
+		InstanceName  string
+		CSRFToken     string
+		RecoveryCodes []string
+		To            string
+	}{
+		User:          u,
+		Version:       softwareVersion,
+		InstanceName:  app.cfg.Name,
+		CSRFToken:     csrfToken(app, r),
+		RecoveryCodes: codes,
+		To:            to,
+	}
+	return renderTemplate(w, "twofactor-setup", p)
+}
+
+func handleDisableTwoFactor(app *app, w http.ResponseWriter, r *http.Request) error {
+	cu := getUserSession(app, r)
+	if cu == nil || getTokenAuth(r) != nil {
+		return impart.HTTPError{http.StatusUnauthorized, "Not logged in."}
+	}
+	if app.cfg.Require2FA {
+		return impart.HTTPError{http.StatusForbidden, "Two-factor authentication is required on this instance."}
+	}
+	u, err := app.getLocalUser(cu.PreferredUsername)
+	if err != nil {
+		return err
+	}
+
+	if !auth.Authenticated(u.HashedPass, []byte(r.FormValue("password"))) {
+		return impart.HTTPError{http.StatusBadRequest, "Incorrect password."}
+	}
+
+	err = app.disableTwoFactor(u.ID)
+	if err != nil {
+		logError("Couldn't disable 2FA: %v", err)
+		return impart.HTTPError{http.StatusInternalServerError, "Couldn't disable two-factor authentication."}
+	}
+
+	addSessionFlash(app, w, r, "Two-factor authentication disabled.")
+	return impart.HTTPError{http.StatusFound, "/settings"}
+}
@@ -0,0 +1,76 @@
+--
+-- Upgrades for databases created with an earlier version of schema.sql.
+-- schema.sql only creates tables that don't exist yet, so the columns added
+-- to existing tables are listed here, oldest first.
+--
+
+--
+-- Two-factor authentication
+--
+
+ALTER TABLE `users` ADD `totp_secret` varchar(64) DEFAULT NULL AFTER `avatar_type`;
+ALTER TABLE `users` ADD `totp_step` bigint(20) DEFAULT NULL AFTER `totp_secret`;
+
+--
+-- Private reader feeds
+--
+
+ALTER TABLE `users` ADD `feed_token` char(64) DEFAULT NULL AFTER `totp_step`;
+ALTER TABLE `users` ADD UNIQUE KEY `feed_token` (`feed_token`);
+
+--
+-- Email digests
+--
+
+ALTER TABLE `users` ADD `email` varchar(255) DEFAULT NULL AFTER `feed_token`;
+ALTER TABLE `users` ADD `digest` varchar(10) DEFAULT NULL AFTER `email`;
+ALTER TABLE `users` ADD `digest_sent` datetime DEFAULT NULL AFTER `digest`;
+
+--
+-- Account moves
+--
+
+ALTER TABLE `users` ADD `also_known_as` text AFTER `digest_sent`;
+ALTER TABLE `users` ADD `moved_to` varchar(255) DEFAULT NULL AFTER `also_known_as`;
+
+--
+-- Account deletion
+--
+
+ALTER TABLE `users` ADD `deleted` datetime DEFAULT NULL AFTER `moved_to`;
+
+--
+-- Deleted posts
+--
+
+ALTER TABLE `posts` ADD `deleted` datetime DEFAULT NULL AFTER `content`;
+
+--
+-- Actor refreshes
+--
+
+ALTER TABLE `users` ADD `last_fetched` datetime DEFAULT NULL AFTER `shared_inbox_iri`;
+
+--
+-- Longer actor types, like Organization
+--
+
+ALTER TABLE `users` MODIFY `type` varchar(20) DEFAULT NULL;
+
+--
+-- More object types
+--
+
+ALTER TABLE `users` ADD `feed_types` varchar(255) DEFAULT NULL AFTER `moved_to`;
+ALTER TABLE `posts` ADD `start_time` datetime DEFAULT NULL AFTER `deleted`;
+ALTER TABLE `posts` ADD `end_time` datetime DEFAULT NULL AFTER `start_time`;
+ALTER TABLE `posts` ADD `location` varchar(255) CHARACTER SET utf8mb4 COLLATE utf8mb4_bin DEFAULT NULL AFTER `end_time`;
+ALTER TABLE `posts` ADD `multiple` tinyint(1) NOT NULL DEFAULT '0' AFTER `location`;
+
+--
+-- Content warnings
+--
+
+ALTER TABLE `users` ADD `expand_warnings` tinyint(1) NOT NULL DEFAULT '0' AFTER `feed_types`;
+ALTER TABLE `posts` ADD `summary` varchar(500) CHARACTER SET utf8mb4 COLLATE utf8mb4_bin DEFAULT NULL AFTER `content`;
+ALTER TABLE `posts` ADD `sensitive` tinyint(1) NOT NULL DEFAULT '0' AFTER `summary`;
@@ -1,13 +1,37 @@
 package readas
 
 import (
+	"crypto/rand"
+	"encoding/hex"
+	"github.com/gorilla/mux"
 	"github.com/writeas/impart"
 	"github.com/writeas/web-core/activitystreams"
 	"github.com/writeas/web-core/auth"
+	"io/ioutil"
+	"mime/multipart"
 	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"time"
+	"unicode/utf8"
 )
 
+const (
+	maxNameLen    = 100
+	maxSummaryLen = 255
+	maxAvatarSize = 2 << 20
+)
+
+// avatarTypes maps the image types we accept for avatars to the extension
+// they're stored with.
+var avatarTypes = map[string]string{
+	"image/png":  ".png",
+	"image/jpeg": ".jpg",
+	"image/gif":  ".gif",
+}
+
 // User is a remote user
 type User struct {
 	activitystreams.Person
@@ -16,6 +40,15 @@ type User struct {
 	Created time.Time `json:"-"`
 }
 
+// Handle returns the user's fediverse handle, or for feeds, which don't have
+// handles, their URL.
+func (u *User) Handle() string {
+	if u.Host == "" {
+		return u.BaseObject.ID
+	}
+	return u.PreferredUsername + "@" + u.Host
+}
+
 func (u *User) AsPerson() *activitystreams.Person {
 	p := u.Person
 	p.Context = []interface{}{
@@ -26,16 +59,42 @@ func (u *User) AsPerson() *activitystreams.Person {
 
 // LocalUser is a local user
 type LocalUser struct {
-	ID                int64  `json:"-"`
-	PreferredUsername string `json:"preferredUsername"`
-	HashedPass        []byte `json:"-"`
-	Name              string `json:"name"`
-	Summary           string `json:"summary"`
+	ID                int64    `json:"-"`
+	PreferredUsername string   `json:"preferredUsername"`
+	HashedPass        []byte   `json:"-"`
+	Name              string   `json:"name"`
+	Summary           string   `json:"summary"`
+	Avatar            string   `json:"-"`
+	AvatarType        string   `json:"-"`
+	FeedToken         string   `json:"-"`
+	Email             string   `json:"-"`
+	Digest            string   `json:"-"`
+	AlsoKnownAs       []string `json:"-"`
+	MovedTo           string   `json:"-"`
+	FeedTypes         []string `json:"-"`
+	ExpandWarnings    bool     `json:"-"`
+	totpSecret        string
 	privKey           []byte
 	pubKey            []byte
 }
 
-func (u *LocalUser) AsPerson(app *app) *activitystreams.Person {
+// person is a local user's actor. Along with activitystreams.Person, it has
+// the properties other servers use to follow an account when it moves.
+type person struct {
+	*activitystreams.Person
+	AlsoKnownAs []string `json:"alsoKnownAs,omitempty"`
+	MovedTo     string   `json:"movedTo,omitempty"`
+}
+
+// migrationContext defines alsoKnownAs and movedTo for JSON-LD, the same way
+// Mastodon does.
+var migrationContext = map[string]interface{}{
+	"as":          "https://www.w3.org/ns/activitystreams#",
+	"alsoKnownAs": map[string]string{"@id": "as:alsoKnownAs", "@type": "@id"},
+	"movedTo":     map[string]string{"@id": "as:movedTo", "@type": "@id"},
+}
+
+func (u *LocalUser) AsPerson(app *app) *person {
 	accountRoot := u.AccountRoot(app)
 	p := activitystreams.NewPerson(accountRoot)
 	p.Endpoints.SharedInbox = app.cfg.Host + "/api/inbox"
@@ -43,6 +102,13 @@ func (u *LocalUser) AsPerson(app *app) *activitystreams.Person {
 	p.URL = app.cfg.Host + "/" + u.PreferredUsername
 	p.Name = u.Name
 	p.Summary = u.Summary
+	if u.Avatar != "" {
+		p.Icon = activitystreams.Image{
+			Type:      "Image",
+			MediaType: u.AvatarType,
+			URL:       u.AvatarURL(app),
+		}
+	}
 
 	// Add key
 	p.Context = append(p.Context, "https://w3id.org/security/v1")
@@ -52,13 +118,35 @@ func (u *LocalUser) AsPerson(app *app) *activitystreams.Person {
 		PublicKeyPEM: string(u.pubKey),
 	}
 	p.SetPrivKey(u.privKey)
-	return p
+
+	if len(u.AlsoKnownAs) > 0 || u.MovedTo != "" {
+		p.Context = append(p.Context, migrationContext)
+	}
+	return &person{
+		Person:      p,
+		AlsoKnownAs: u.AlsoKnownAs,
+		MovedTo:     u.MovedTo,
+	}
 }
 
 func (u *LocalUser) AccountRoot(app *app) string {
 	return app.cfg.Host + "/api/collections/" + u.PreferredUsername
 }
 
+// AvatarURL returns the public URL of the user's uploaded avatar, or an empty
+// string if they haven't uploaded one.
+func (u *LocalUser) AvatarURL(app *app) string {
+	if u.Avatar == "" {
+		return ""
+	}
+	return app.cfg.Host + "/media/avatars/" + u.Avatar
+}
+
+// HasTwoFactor returns whether the user must enter a TOTP code to log in.
+func (u *LocalUser) HasTwoFactor() bool {
+	return u.totpSecret != ""
+}
+
 func (u *LocalUser) cookie() LocalUser {
 	return LocalUser{
 		ID:                u.ID,
@@ -89,23 +177,27 @@ func handleLogin(app *app, w http.ResponseWriter, r *http.Request) error {
 		return impart.HTTPError{http.StatusUnauthorized, "Incorrect password."}
 	}
 
-	// Set cookie
-	session, err := app.sStore.Get(r, "u")
-	if err != nil {
-		// The cookie should still save, even if there's an error.
-		logError("Login: Session: %v; ignoring", err)
+	if authUser.HasTwoFactor() || app.cfg.Require2FA {
+		// Hold off on logging in until we have the second factor
+		err = startTwoFactor(app, w, r, authUser, safeRedirect(r.FormValue("to")))
+		if err != nil {
+			return err
+		}
+		if !authUser.HasTwoFactor() {
+			return impart.HTTPError{http.StatusFound, "/settings/2fa"}
+		}
+		return impart.HTTPError{http.StatusFound, "/login/2fa"}
 	}
 
-	// Remove unwanted data
-	session.Values["user"] = authUser.cookie()
-	err = session.Save(r, w)
+	// Set cookie
+	err = startSession(app, w, r, authUser)
 	if err != nil {
-		logError("Login: Couldn't save session: %v", err)
-		// TODO: return error
+		logError("Login: Couldn't start session: %v", err)
+		return err
 	}
 
 	if redir := r.FormValue("to"); redir != "" {
-		to = redir
+		to = safeRedirect(redir)
 	}
 	return impart.HTTPError{http.StatusFound, to}
 }
@@ -129,6 +221,12 @@ func handleLogout(app *app, w http.ResponseWriter, r *http.Request) error {
 		return impart.HTTPError{http.StatusFound, "/"}
 	}
 
+	if token, ok := session.Values["sid"].(string); ok {
+		err = app.deleteSessionByToken(token)
+		if err != nil {
+			logError("Couldn't delete session on logout: %v", err)
+		}
+	}
 	session.Options.MaxAge = -1
 
 	err = session.Save(r, w)
@@ -139,3 +237,376 @@ func handleLogout(app *app, w http.ResponseWriter, r *http.Request) error {
 
 	return impart.HTTPError{http.StatusFound, "/"}
 }
+
+// handleViewProfile shows a local user's public profile page, or their actor
+// object when requested by an ActivityPub client.
+func handleViewProfile(app *app, w http.ResponseWriter, r *http.Request) error {
+	w.Header().Add("Vary", "Accept")
+	if wantsActivityJSON(r) {
+		return handleFetchUser(app, w, r)
+	}
+
+	vars := mux.Vars(r)
+	u, err := app.getLocalUser(vars["alias"])
+	if err != nil {
+		if _, dErr := app.getDeletedUser(vars["alias"]); dErr == nil {
+			return impart.HTTPError{http.StatusGone, "This account was deleted."}
+		}
+		return err
+	}
+
+	cu := getUserSession(app, r)
+	var viewer *LocalUser
+	if cu != nil {
+		viewer, err = app.getLocalUser(cu.PreferredUsername)
+		if err != nil {
+			return err
+		}
+	}
+
+	p := struct {
+		User           *LocalUser
+		Version        string
+		InstanceName   string
+		CSRFToken      string
+		Profile        *LocalUser
+		Host           string
+		AvatarURL      string
+		AccountRoot    string
+		FollowersCount uint64
+		FollowingCount uint64
+	}{
+		User:         viewer,
+		Version:      softwareVersion,
+		InstanceName: app.cfg.Name,
+		CSRFToken:    csrfToken(app, r),
+		Profile:      u,
+		Host:         app.cfg.Host[strings.LastIndexByte(app.cfg.Host, '/')+1:],
+		AvatarURL:    u.AvatarURL(app),
+		AccountRoot:  u.AccountRoot(app),
+	}
+	p.FollowersCount, err = app.getFollowersCount(u.ID)
+	if err != nil {
+		return err
+	}
+	p.FollowingCount, err = app.getFollowingCount(u.ID)
+	if err != nil {
+		return err
+	}
+
+	return renderTemplate(w, "profile", p)
+}
+
+func handleViewSettings(app *app, w http.ResponseWriter, r *http.Request) error {
+	cu := getUserSession(app, r)
+	if cu == nil {
+		return impart.HTTPError{http.StatusUnauthorized, "Not logged in."}
+	}
+	u, err := app.getLocalUser(cu.PreferredUsername)
+	if err != nil {
+		return err
+	}
+
+	p := struct {
+		User         *LocalUser
+		Version      string
+		InstanceName string
+		CSRFToken    string
+		Flashes      []string
+		AvatarURL    string
+		Sessions     *[]Session
+		Require2FA   bool
+		FeedURL      string
+		EmailEnabled bool
+		Digests      []Digest
+		Handle       string
+		PostTypes    interface{}
+	}{
+		User:         u,
+		Version:      softwareVersion,
+		InstanceName: app.cfg.Name,
+		CSRFToken:    csrfToken(app, r),
+		Flashes:      getSessionFlashes(app, w, r),
+		AvatarURL:    u.AvatarURL(app),
+		Require2FA:   app.cfg.Require2FA,
+		EmailEnabled: app.cfg.SMTPHost != "",
+		Handle:       u.PreferredUsername + "@" + app.cfg.Host[strings.LastIndexByte(app.cfg.Host, '/')+1:],
+		PostTypes:    postTypes,
+	}
+	if u.FeedToken != "" {
+		p.FeedURL = app.cfg.Host + "/feed/" + u.FeedToken
+	}
+	p.Sessions, err = app.getUserSessions(u.ID, getSessionToken(app, r))
+	if err != nil {
+		return err
+	}
+	if p.EmailEnabled {
+		digests, err := app.getDigests(u.ID)
+		if err != nil {
+			return err
+		}
+		p.Digests = *digests
+	}
+
+	return renderTemplate(w, "settings", p)
+}
+
+func handleFetchMe(app *app, w http.ResponseWriter, r *http.Request) error {
+	cu := getUserSession(app, r)
+	if cu == nil {
+		return impart.HTTPError{http.StatusUnauthorized, "Not logged in."}
+	}
+	u, err := app.getLocalUser(cu.PreferredUsername)
+	if err != nil {
+		return err
+	}
+
+	return impart.WriteSuccess(w, u.AsPerson(app), http.StatusOK)
+}
+
+// handleUpdateProfile changes the logged-in user's display name, bio and
+// avatar, then lets their followers know about it. It serves both the
+// settings page form and the JSON API.
+func handleUpdateProfile(app *app, w http.ResponseWriter, r *http.Request) error {
+	isAPI := strings.HasPrefix(r.URL.Path, "/api")
+
+	cu := getUserSession(app, r)
+	if cu == nil {
+		return impart.HTTPError{http.StatusUnauthorized, "Not logged in."}
+	}
+	u, err := app.getLocalUser(cu.PreferredUsername)
+	if err != nil {
+		return err
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxAvatarSize+(64<<10))
+	err = r.ParseMultipartForm(maxAvatarSize)
+	if err != nil && err != http.ErrNotMultipart {
+		return impart.HTTPError{http.StatusBadRequest, "Unable to read form. Avatars can be at most 2 MB."}
+	}
+
+	if _, ok := r.Form["name"]; ok {
+		u.Name = strings.TrimSpace(r.FormValue("name"))
+		if u.Name == "" {
+			return impart.HTTPError{http.StatusBadRequest, "A display name is required."}
+		}
+		if utf8.RuneCountInString(u.Name) > maxNameLen {
+			return impart.HTTPError{http.StatusBadRequest, "Display name is too long."}
+		}
+	}
+	if _, ok := r.Form["summary"]; ok {
+		u.Summary = strings.TrimSpace(r.FormValue("summary"))
+		if utf8.RuneCountInString(u.Summary) > maxSummaryLen {
+			return impart.HTTPError{http.StatusBadRequest, "Bio is too long."}
+		}
+	}
+
+	oldAvatar := u.Avatar
+	if r.FormValue("remove_avatar") != "" {
+		u.Avatar = ""
+		u.AvatarType = ""
+	}
+	f, _, err := r.FormFile("avatar")
+	if err == nil {
+		defer f.Close()
+		u.Avatar, u.AvatarType, err = app.saveAvatar(u, f)
+		if err != nil {
+			return err
+		}
+	} else if err != http.ErrMissingFile && err != http.ErrNotMultipart {
+		return impart.HTTPError{http.StatusBadRequest, "Unable to read avatar."}
+	}
+
+	err = app.updateLocalUser(u)
+	if err != nil {
+		return err
+	}
+	if oldAvatar != "" && oldAvatar != u.Avatar {
+		err = os.Remove(filepath.Join(app.cfg.MediaDir, "avatars", oldAvatar))
+		if err != nil {
+			logError("Unable to remove old avatar: %v", err)
+		}
+	}
+
+	go sendProfileUpdate(app, u)
+
+	if isAPI {
+		return impart.WriteSuccess(w, u.AsPerson(app), http.StatusOK)
+	}
+	addSessionFlash(app, w, r, "Profile updated.")
+	return impart.HTTPError{http.StatusFound, "/settings"}
+}
+
+// saveAvatar stores the given uploaded image in the media directory, returning
+// the new file's name and media type.
+func (app *app) saveAvatar(u *LocalUser, f multipart.File) (string, string, error) {
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		return "", "", impart.HTTPError{http.StatusBadRequest, "Unable to read avatar."}
+	}
+	if len(data) > maxAvatarSize {
+		return "", "", impart.HTTPError{http.StatusRequestEntityTooLarge, "Avatars can be at most 2 MB."}
+	}
+
+	mediaType := http.DetectContentType(data)
+	ext, ok := avatarTypes[mediaType]
+	if !ok {
+		return "", "", impart.HTTPError{http.StatusBadRequest, "Avatars must be a PNG, JPEG or GIF image."}
+	}
+
+	suffix := make([]byte, 8)
+	_, err = rand.Read(suffix)
+	if err != nil {
+		return "", "", err
+	}
+	filename := u.PreferredUsername + "-" + hex.EncodeToString(suffix) + ext
+
+	dir := filepath.Join(app.cfg.MediaDir, "avatars")
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		logError("Unable to create avatars directory: %v", err)
+		return "", "", err
+	}
+	err = ioutil.WriteFile(filepath.Join(dir, filename), data, 0644)
+	if err != nil {
+		logError("Unable to write avatar: %v", err)
+		return "", "", err
+	}
+
+	return filename, mediaType, nil
+}
+
+// ShowsType returns whether the user wants posts of the given type in their
+// feed.
+func (u *LocalUser) ShowsType(t string) bool {
+	if len(u.FeedTypes) == 0 {
+		return true
+	}
+	for _, ft := range u.FeedTypes {
+		if ft == t {
+			return true
+		}
+	}
+	return false
+}
+
+// handleUpdateReading saves which types of posts the user wants in their
+// feed, and whether to expand posts with content warnings.
+func handleUpdateReading(app *app, w http.ResponseWriter, r *http.Request) error {
+	cu := getUserSession(app, r)
+	if cu == nil || getTokenAuth(r) != nil {
+		return impart.HTTPError{http.StatusUnauthorized, "Not logged in."}
+	}
+	u, err := app.getLocalUser(cu.PreferredUsername)
+	if err != nil {
+		return err
+	}
+
+	r.ParseForm()
+	types := []string{}
+	for _, t := range r.Form["types"] {
+		if isPostType(t) {
+			types = append(types, t)
+		}
+	}
+	if len(types) == 0 {
+		return impart.HTTPError{http.StatusBadRequest, "Choose at least one type of post to show."}
+	}
+	if len(types) == len(postTypes) {
+		// Show everything, including any types we support later
+		types = nil
+	}
+	err = app.updateReadingSettings(u.ID, types, r.FormValue("expand_warnings") == "1")
+	if err != nil {
+		return impart.HTTPError{http.StatusInternalServerError, "Couldn't save settings."}
+	}
+
+	addSessionFlash(app, w, r, "Reading settings saved.")
+	return impart.HTTPError{http.StatusFound, "/settings"}
+}
+
+// handleChangePassword sets a new password for the logged-in user after
+// checking their current one. All of the user's other sessions are logged out.
+func handleChangePassword(app *app, w http.ResponseWriter, r *http.Request) error {
+	isAPI := strings.HasPrefix(r.URL.Path, "/api")
+
+	cu := getUserSession(app, r)
+	if cu == nil {
+		return impart.HTTPError{http.StatusUnauthorized, "Not logged in."}
+	}
+	u, err := app.getLocalUser(cu.PreferredUsername)
+	if err != nil {
+		return err
+	}
+
+	current := r.FormValue("current")
+	newPass := r.FormValue("new")
+	if newPass == "" {
+		return impart.HTTPError{http.StatusBadRequest, "A new password is required."}
+	}
+	if confirm, ok := r.Form["confirm"]; ok && confirm[0] != newPass {
+		return impart.HTTPError{http.StatusBadRequest, "New passwords don't match."}
+	}
+	if !auth.Authenticated(u.HashedPass, []byte(current)) {
+		return impart.HTTPError{http.StatusBadRequest, "Incorrect current password."}
+	}
+
+	hashedPass, err := auth.HashPass([]byte(newPass))
+	if err != nil {
+		logError("Unable to hash pass: %v", err)
+		return impart.HTTPError{http.StatusInternalServerError, "Couldn't update password."}
+	}
+	err = app.updatePassword(u.ID, hashedPass)
+	if err != nil {
+		return err
+	}
+
+	// Log out everywhere, but keep this device logged in with a new session
+	err = app.deleteUserSessions(u.ID, "")
+	if err != nil {
+		logError("Couldn't delete sessions after password change: %v", err)
+		return impart.HTTPError{http.StatusInternalServerError, "Password updated, but couldn't log out other sessions."}
+	}
+	err = startSession(app, w, r, u)
+	if err != nil {
+		return err
+	}
+
+	if isAPI {
+		return impart.WriteSuccess(w, "", http.StatusOK)
+	}
+	addSessionFlash(app, w, r, "Password updated. You've been logged out everywhere else.")
+	return impart.HTTPError{http.StatusFound, "/settings"}
+}
+
+// handleRevokeSessions logs the user out of one of their other sessions, or
+// all of them when `id` is "others".
+func handleRevokeSessions(app *app, w http.ResponseWriter, r *http.Request) error {
+	cu := getUserSession(app, r)
+	if cu == nil || getTokenAuth(r) != nil {
+		return impart.HTTPError{http.StatusUnauthorized, "Not logged in."}
+	}
+
+	idStr := r.FormValue("id")
+	if idStr == "others" {
+		err := app.deleteUserSessions(cu.ID, getSessionToken(app, r))
+		if err != nil {
+			logError("Couldn't delete other sessions: %v", err)
+			return impart.HTTPError{http.StatusInternalServerError, "Couldn't log out other sessions."}
+		}
+		addSessionFlash(app, w, r, "Logged out of all other sessions.")
+		return impart.HTTPError{http.StatusFound, "/settings"}
+	}
+
+	id, err := strconv.ParseInt(idStr, 10, 64)
+	if err != nil {
+		return impart.HTTPError{http.StatusBadRequest, "Invalid session."}
+	}
+	err = app.deleteSession(cu.ID, id)
+	if err != nil {
+		logError("Couldn't delete session: %v", err)
+		return impart.HTTPError{http.StatusInternalServerError, "Couldn't log out session."}
+	}
+	addSessionFlash(app, w, r, "Session logged out.")
+	return impart.HTTPError{http.StatusFound, "/settings"}
+}